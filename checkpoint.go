@@ -0,0 +1,159 @@
+// checkpoint.go
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "io"
+)
+
+// checkpointMagic starts a checkpoint, followed by a version byte.
+const checkpointMagic = "sofia checkpoint"
+
+const checkpointVersion = 4
+
+// SegmentCount is the number of segments added so far, including those
+// added before a Restore. A resumed capture carries on with the segment at
+// this index.
+func (r *Remuxer) SegmentCount() int {
+   return r.segmentCount
+}
+
+// Checkpoint serializes the state of the Remuxer after the segments added
+// so far: the init segments, the samples and chunks, where the output ends,
+// and how far trimming got. Together with the output as written up to that
+// point, it lets Restore carry on after a crash. The caller makes sure the
+// output is durable first, for example with File.Sync. A Remuxer with
+// Output cannot be checkpointed unless the caller supplied its Spool.
+func (r *Remuxer) Checkpoint() ([]byte, error) {
+   if r.Moov == nil {
+      return nil, errors.New("not initialized")
+   }
+   if r.spoolFile != nil {
+      return nil, errors.New("cannot checkpoint a temporary spool")
+   }
+   if len(r.held) > 0 {
+      return nil, errors.New("cannot checkpoint samples held before Start")
+   }
+   end, err := r.writer().Seek(0, io.SeekCurrent)
+   if err != nil {
+      return nil, fmt.Errorf("seeking to get output end offset: %w", err)
+   }
+   buffer := []byte(checkpointMagic)
+   buffer = append(buffer, checkpointVersion)
+   buffer = binary.AppendUvarint(buffer, uint64(r.mdatStartOffset))
+   buffer = binary.AppendUvarint(buffer, uint64(end))
+   buffer = binary.AppendUvarint(buffer, uint64(r.segmentCount))
+   buffer = binary.AppendUvarint(buffer, r.decodeTime)
+   buffer = appendBool(buffer, r.trimStarted)
+   buffer = binary.AppendUvarint(buffer, r.trimOrigin)
+   buffer = binary.AppendUvarint(buffer, uint64(len(r.initSegment)))
+   buffer = append(buffer, r.initSegment...)
+   buffer = binary.AppendUvarint(buffer, uint64(len(r.inits)))
+   for _, init := range r.inits {
+      buffer = binary.AppendUvarint(buffer, uint64(len(init)))
+      buffer = append(buffer, init...)
+   }
+   buffer = binary.AppendUvarint(buffer, uint64(r.description))
+   buffer = appendBool(buffer, r.rebase)
+   buffer = binary.AppendVarint(buffer, r.tfdtOffset)
+   buffer = r.index.append(buffer)
+   return buffer, nil
+}
+
+// Restore resumes from a checkpoint in place of Initialize. Writer, or
+// Output and Spool, must be the output the checkpoint was taken of. Any
+// payload written to Writer after the checkpoint, such as half a segment,
+// is cut off by its Truncate method, as an *os.File has; a Writer without
+// one is an error unless it ends where the checkpoint was taken. The Spool
+// needs no truncating, as Finish copies it only up to where the samples
+// end. OnSample, Transform, Start and End are not part of the checkpoint,
+// so the caller sets them again.
+func (r *Remuxer) Restore(checkpoint []byte) error {
+   if r.Moov != nil {
+      return errors.New("already initialized")
+   }
+   if r.Output != nil && r.Spool == nil {
+      return errors.New("restoring Output needs the Spool")
+   }
+   if r.writer() == nil {
+      return errors.New("writer is nil")
+   }
+   header := len(checkpointMagic) + 1
+   if len(checkpoint) < header {
+      return sizeError("checkpoint too short", header, len(checkpoint))
+   }
+   if string(checkpoint[:len(checkpointMagic)]) != checkpointMagic {
+      return errors.New("not a sofia checkpoint")
+   }
+   if version := checkpoint[len(checkpointMagic)]; version != checkpointVersion {
+      return fmt.Errorf("unsupported checkpoint version %d", version)
+   }
+   v := varintReader{data: checkpoint[header:]}
+   mdatStartOffset := int64(v.uvarint())
+   end := int64(v.uvarint())
+   segmentCount := int(v.uvarint())
+   decodeTime := v.uvarint()
+   trimStarted := v.uvarint() == 1
+   trimOrigin := v.uvarint()
+   initSegment := v.bytes(v.length(1))
+   inits := make([][]byte, v.length(1))
+   for i := range inits {
+      inits[i] = v.bytes(v.length(1))
+   }
+   description := uint32(v.uvarint())
+   rebase := v.uvarint() == 1
+   tfdtOffset := v.varint()
+   var index sampleIndex
+   if err := index.decode(&v); err != nil {
+      return fmt.Errorf("decoding checkpoint: %w", err)
+   }
+
+   if err := r.decodeInit(initSegment); err != nil {
+      return err
+   }
+   for _, init := range inits {
+      if err := r.addInit(init); err != nil {
+         r.Moov = nil
+         return fmt.Errorf("restoring init segment: %w", err)
+      }
+   }
+   w := r.writer()
+   if truncater, ok := w.(interface{ Truncate(int64) error }); ok {
+      if err := truncater.Truncate(end); err != nil {
+         r.Moov = nil
+         return fmt.Errorf("truncating output: %w", err)
+      }
+   } else if r.Output == nil {
+      // Finish writes moov where the samples end, so anything after it
+      // would be left behind
+      size, err := w.Seek(0, io.SeekEnd)
+      if err != nil {
+         r.Moov = nil
+         return fmt.Errorf("seeking to end of output: %w", err)
+      }
+      if size > end {
+         r.Moov = nil
+         return fmt.Errorf(
+            "output has %d bytes after the checkpoint and no Truncate method",
+            size-end,
+         )
+      }
+   }
+   if _, err := w.Seek(end, io.SeekStart); err != nil {
+      r.Moov = nil
+      return fmt.Errorf("seeking to end of checkpoint: %w", err)
+   }
+   r.mdatStartOffset = mdatStartOffset
+   r.segmentCount = segmentCount
+   r.decodeTime = decodeTime
+   r.trimStarted = trimStarted
+   r.trimOrigin = trimOrigin
+   r.index = index
+   r.inits = inits
+   r.description = description
+   r.rebase = rebase
+   r.tfdtOffset = tfdtOffset
+   return nil
+}
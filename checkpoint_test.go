@@ -0,0 +1,108 @@
+// checkpoint_test.go
+package sofia
+
+import (
+   "bytes"
+   "io"
+   "os"
+   "path/filepath"
+   "testing"
+)
+
+// seekBuffer is an io.WriteSeeker in memory, with no Truncate method.
+type seekBuffer struct {
+   data   []byte
+   offset int64
+}
+
+func (s *seekBuffer) Write(p []byte) (int, error) {
+   if grow := s.offset + int64(len(p)) - int64(len(s.data)); grow > 0 {
+      s.data = append(s.data, make([]byte, grow)...)
+   }
+   n := copy(s.data[s.offset:], p)
+   s.offset += int64(n)
+   return n, nil
+}
+
+func (s *seekBuffer) Seek(offset int64, whence int) (int64, error) {
+   switch whence {
+   case io.SeekCurrent:
+      offset += s.offset
+   case io.SeekEnd:
+      offset += int64(len(s.data))
+   }
+   s.offset = offset
+   return offset, nil
+}
+
+// testCheckpoint adds the first segment to a Remuxer writing to w, and
+// returns a checkpoint taken after it.
+func testCheckpoint(t *testing.T, w io.WriteSeeker, segments [][]byte) []byte {
+   t.Helper()
+   r := Remuxer{Writer: w}
+   if err := r.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   if err := r.AddSegment(segments[0]); err != nil {
+      t.Fatal(err)
+   }
+   checkpoint, err := r.Checkpoint()
+   if err != nil {
+      t.Fatal(err)
+   }
+   // a crash halfway through the next segment
+   if _, err := w.Write(segments[1][:20]); err != nil {
+      t.Fatal(err)
+   }
+   return checkpoint
+}
+
+func TestRestore(t *testing.T) {
+   segments := testSegments()
+   var uninterrupted seekBuffer
+   r := Remuxer{Writer: &uninterrupted}
+   if err := r.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   for _, segment := range segments {
+      if err := r.AddSegment(segment); err != nil {
+         t.Fatal(err)
+      }
+   }
+   if err := r.Finish(); err != nil {
+      t.Fatal(err)
+   }
+
+   file, err := os.Create(filepath.Join(t.TempDir(), "out.mp4"))
+   if err != nil {
+      t.Fatal(err)
+   }
+   defer file.Close()
+   checkpoint := testCheckpoint(t, file, segments)
+   r = Remuxer{Writer: file}
+   if err := r.Restore(checkpoint); err != nil {
+      t.Fatal(err)
+   }
+   for _, segment := range segments[1:] {
+      if err := r.AddSegment(segment); err != nil {
+         t.Fatal(err)
+      }
+   }
+   if err := r.Finish(); err != nil {
+      t.Fatal(err)
+   }
+   got, err := os.ReadFile(file.Name())
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(got, uninterrupted.data) {
+      t.Error("restored output differs from an uninterrupted remux")
+   }
+
+   var buffer seekBuffer
+   checkpoint = testCheckpoint(t, &buffer, segments)
+   r = Remuxer{Writer: &buffer}
+   if err := r.Restore(checkpoint); err == nil {
+      t.Error("restored over data that cannot be truncated")
+   }
+}
@@ -0,0 +1,458 @@
+// main.go
+package main
+
+import (
+   "crypto/aes"
+   "crypto/cipher"
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/hex"
+   "errors"
+   "flag"
+   "fmt"
+   "io"
+   "os"
+   "strings"
+
+   "41.neocities.org/sofia"
+)
+
+const usage = `usage: sofia <command> [flags] [input ...]
+
+commands:
+   inspect   print the box tree of the input
+   remux     join init + segments into a progressive MP4
+   decrypt   like remux, decrypting samples with -key KID:KEY
+   fragment  turn a progressive MP4 into a fragmented one
+   pssh      extract and decode PSSH boxes
+
+An input of "-" or no input at all reads standard input. The first input
+of remux and decrypt is the init segment; any fragments following the
+moov in that input are remuxed as well. A later input with its own moov
+starts another init + segments sequence, joined on one timeline. An
+output of "-" writes standard output, spooling the samples to a temporary
+file.`
+
+func main() {
+   if len(os.Args) < 2 {
+      fmt.Fprintln(os.Stderr, usage)
+      os.Exit(2)
+   }
+   var err error
+   switch os.Args[1] {
+   case "inspect":
+      err = inspect(os.Args[2:])
+   case "remux":
+      err = remux(os.Args[2:], false)
+   case "decrypt":
+      err = remux(os.Args[2:], true)
+   case "fragment":
+      err = fragment(os.Args[2:])
+   case "pssh":
+      err = pssh(os.Args[2:])
+   case "-h", "-help", "--help", "help":
+      fmt.Println(usage)
+      return
+   default:
+      fmt.Fprintln(os.Stderr, usage)
+      os.Exit(2)
+   }
+   if err != nil {
+      fmt.Fprintln(os.Stderr, "sofia:", err)
+      os.Exit(1)
+   }
+}
+
+func inspect(args []string) error {
+   set := flag.NewFlagSet("inspect", flag.ExitOnError)
+   asJSON := set.Bool("json", false, "write JSON instead of a text tree")
+   fragments := set.Bool("fragments", false, "list the fragments instead")
+   output := set.String("o", "-", "output file")
+   set.Parse(args)
+   data, err := readInputs(set.Args())
+   if err != nil {
+      return err
+   }
+   out, err := createOutput(*output)
+   if err != nil {
+      return err
+   }
+   defer out.Close()
+   if *fragments {
+      return listFragments(out, data)
+   }
+   nodes := sofia.Dump(data)
+   if *asJSON {
+      return sofia.WriteDumpJSON(out, nodes)
+   }
+   return sofia.WriteDump(out, nodes)
+}
+
+func remux(args []string, decrypt bool) error {
+   name := "remux"
+   if decrypt {
+      name = "decrypt"
+   }
+   set := flag.NewFlagSet(name, flag.ExitOnError)
+   output := set.String("o", "", "output file")
+   start := set.Duration("start", 0, "trim to start at this time, such as 10m")
+   end := set.Duration("end", 0, "trim to end at this time, such as 12m30s")
+   keys := keyFlag{}
+   if decrypt {
+      set.Var(keys, "key", "KID:KEY in hex, may be repeated")
+   }
+   set.Parse(args)
+   if *output == "" {
+      return errors.New("remux: -o is required")
+   }
+   inputs := set.Args()
+   if len(inputs) == 0 {
+      inputs = []string{"-"}
+   }
+   first, err := readInput(inputs[0])
+   if err != nil {
+      return err
+   }
+   initSegment, firstSegment, err := splitInit(first)
+   if err != nil {
+      return err
+   }
+   out, err := createOutput(*output)
+   if err != nil {
+      return err
+   }
+   defer out.Close()
+   remuxer := sofia.Remuxer{Writer: out}
+   if *output == "-" {
+      remuxer = sofia.Remuxer{Output: out}
+   }
+   remuxer.Start, remuxer.End = *start, *end
+   if err := remuxer.Initialize(initSegment); err != nil {
+      return err
+   }
+   // removes the spool of -o - if the remux is not finished
+   defer remuxer.Close()
+   var block cipher.Block
+   if decrypt {
+      block, err = keys.block(remuxer.Moov)
+      if err != nil {
+         return err
+      }
+      remuxer.OnSample = func(data []byte, sample *sofia.SencSample) {
+         sofia.Decrypt(data, sample, block)
+      }
+   }
+   if len(firstSegment) > 0 {
+      if err := remuxer.AddSegment(firstSegment); err != nil {
+         return err
+      }
+   }
+   for _, name := range inputs[1:] {
+      data, err := readInput(name)
+      if err != nil {
+         return err
+      }
+      segment := data
+      // an input with a moov starts another source, such as after an
+      // encoder restart
+      init, rest, err := splitInit(data)
+      if err != nil {
+         return fmt.Errorf("%s: %w", name, err)
+      }
+      if moov, ok := initMoov(init); ok {
+         if err := remuxer.AddInit(init); err != nil {
+            return fmt.Errorf("%s: %w", name, err)
+         }
+         if decrypt {
+            block, err = keys.block(moov)
+            if err != nil {
+               return err
+            }
+         }
+         segment = rest
+      }
+      if len(segment) > 0 {
+         if err := remuxer.AddSegment(segment); err != nil {
+            return fmt.Errorf("%s: %w", name, err)
+         }
+      }
+   }
+   return remuxer.Finish()
+}
+
+func fragment(args []string) error {
+   set := flag.NewFlagSet("fragment", flag.ExitOnError)
+   duration := set.Duration(
+      "duration", 0, "fragment length, starting each at a sync sample; 0 means every sync sample",
+   )
+   output := set.String("o", "-", "output file")
+   set.Parse(args)
+   data, err := readInputs(set.Args())
+   if err != nil {
+      return err
+   }
+   out, err := createOutput(*output)
+   if err != nil {
+      return err
+   }
+   defer out.Close()
+   return sofia.WriteFragmented(out, data, *duration)
+}
+
+// listFragments prints a line for each fragment of a segmented stream.
+func listFragments(w io.Writer, data []byte) error {
+   boxes, err := sofia.DecodeBoxes(data)
+   if err != nil {
+      return err
+   }
+   fmt.Fprintln(w, "index\ttrack\tsamples\tsync\tduration\tbytes\tencrypted")
+   index := 0
+   for _, box := range boxes {
+      if box.Moof == nil || box.Moof.Traf == nil || box.Moof.Traf.Tfhd == nil {
+         continue
+      }
+      index++
+      traf := box.Moof.Traf
+      var samples, sync int
+      var duration, size uint64
+      for _, trun := range traf.Trun {
+         for i, sample := range trun.Samples {
+            samples++
+            d, s, flags := traf.Tfhd.DefaultSampleDuration, traf.Tfhd.DefaultSampleSize, traf.Tfhd.DefaultSampleFlags
+            if trun.Flags&0x000100 != 0 {
+               d = sample.Duration
+            }
+            if trun.Flags&0x000200 != 0 {
+               s = sample.Size
+            }
+            if trun.Flags&0x000400 != 0 {
+               flags = sample.Flags
+            }
+            if i == 0 && trun.Flags&0x000004 != 0 {
+               flags = trun.FirstSampleFlags
+            }
+            if flags&0x00010000 == 0 {
+               sync++
+            }
+            duration += uint64(d)
+            size += uint64(s)
+         }
+      }
+      fmt.Fprintf(
+         w, "%d\t%d\t%d\t%d\t%d\t%d\t%t\n", index, traf.Tfhd.TrackID, samples,
+         sync, duration, size, traf.Senc != nil,
+      )
+   }
+   return nil
+}
+
+func pssh(args []string) error {
+   set := flag.NewFlagSet("pssh", flag.ExitOnError)
+   set.Parse(args)
+   data, err := readInputs(set.Args())
+   if err != nil {
+      return err
+   }
+   found := false
+   var walk func(nodes []*sofia.DumpNode)
+   walk = func(nodes []*sofia.DumpNode) {
+      for _, node := range nodes {
+         walk(node.Children)
+         if node.Type != "pssh" {
+            continue
+         }
+         if message, ok := node.Fields["Error"]; ok {
+            fmt.Printf("offset %d: %v\n\n", node.Offset, message)
+            continue
+         }
+         raw := data[node.Offset : node.Offset+node.Size]
+         box, err := sofia.DecodePsshBox(raw)
+         if err != nil {
+            fmt.Printf("offset %d: %v\n\n", node.Offset, err)
+            continue
+         }
+         found = true
+         fmt.Println("offset", node.Offset)
+         system := sofia.FormatUUID(box.SystemID)
+         if name, ok := systemNames[system]; ok {
+            system += " (" + name + ")"
+         }
+         fmt.Println("system", system)
+         kids, err := box.KeyIDs()
+         if err != nil {
+            fmt.Println("error", err)
+            kids = box.KIDs
+         }
+         for _, kid := range kids {
+            fmt.Println("kid", hex.EncodeToString(kid[:]))
+         }
+         switch box.SystemID {
+         case sofia.WidevineSystemID:
+            printWidevine(box.Data)
+         case sofia.PlayReadySystemID:
+            printPlayReady(box.Data)
+         }
+         fmt.Println("data", base64.StdEncoding.EncodeToString(box.Data))
+         fmt.Println("box", base64.StdEncoding.EncodeToString(raw))
+         fmt.Println()
+      }
+   }
+   walk(sofia.Dump(data))
+   if !found {
+      return errors.New("no pssh found")
+   }
+   return nil
+}
+
+func printWidevine(data []byte) {
+   widevine, err := sofia.DecodeWidevinePsshData(data)
+   if err != nil {
+      return // already reported by KeyIDs
+   }
+   if widevine.Provider != "" {
+      fmt.Println("provider", widevine.Provider)
+   }
+   if len(widevine.ContentID) > 0 {
+      fmt.Println("content_id", hex.EncodeToString(widevine.ContentID))
+   }
+   if scheme := widevine.ProtectionScheme; scheme != 0 {
+      fmt.Println("protection_scheme", string(binary.BigEndian.AppendUint32(nil, scheme)))
+   }
+}
+
+func printPlayReady(data []byte) {
+   object, err := sofia.DecodePlayReadyObject(data)
+   if err != nil {
+      return // already reported by KeyIDs
+   }
+   header, err := object.Header()
+   if err != nil {
+      return
+   }
+   fmt.Println("version", header.Version)
+   if header.LAURL != "" {
+      fmt.Println("la_url", header.LAURL)
+   }
+}
+
+var systemNames = map[string]string{
+   "1077efec-c0b2-4d02-ace3-3c1e52e2fb4b": "W3C Common",
+   "94ce86fb-07ff-4f43-adb8-93d2fa968ca2": "FairPlay",
+   "9a04f079-9840-4286-ab92-e65be0885f95": "PlayReady",
+   "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed": "Widevine",
+}
+
+// --- keys ---
+type keyFlag map[string][]byte
+
+func (k keyFlag) String() string {
+   return ""
+}
+
+func (k keyFlag) Set(value string) error {
+   kid, key, ok := strings.Cut(value, ":")
+   if !ok {
+      return errors.New("key must be KID:KEY")
+   }
+   kidBytes, err := hex.DecodeString(kid)
+   if err != nil || len(kidBytes) != 16 {
+      return fmt.Errorf("invalid KID %q", kid)
+   }
+   keyBytes, err := hex.DecodeString(key)
+   if err != nil || len(keyBytes) != 16 {
+      return fmt.Errorf("invalid key %q", key)
+   }
+   k[hex.EncodeToString(kidBytes)] = keyBytes
+   return nil
+}
+
+// block returns the cipher for the default KID of the first track, the
+// one that the remuxer writes.
+func (k keyFlag) block(moov *sofia.MoovBox) (cipher.Block, error) {
+   if len(k) == 0 {
+      return nil, errors.New("decrypt: at least one -key is required")
+   }
+   if len(moov.Trak) == 0 {
+      return nil, errors.New("decrypt: no track")
+   }
+   trak := moov.Trak[0]
+   if trak.Mdia == nil || trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil ||
+      trak.Mdia.Minf.Stbl.Stsd == nil {
+      return nil, errors.New("decrypt: first track has no sample description")
+   }
+   sinf, _, ok := trak.Mdia.Minf.Stbl.Stsd.Sinf()
+   if !ok || sinf.Schi == nil || sinf.Schi.Tenc == nil {
+      return nil, errors.New("decrypt: first track is not encrypted")
+   }
+   kid := hex.EncodeToString(sinf.Schi.Tenc.DefaultKID[:])
+   key, ok := k[kid]
+   if !ok {
+      return nil, fmt.Errorf("decrypt: no key for KID %s", kid)
+   }
+   return aes.NewCipher(key)
+}
+
+// --- input and output ---
+func readInput(name string) ([]byte, error) {
+   if name == "-" {
+      return io.ReadAll(os.Stdin)
+   }
+   return os.ReadFile(name)
+}
+
+// readInputs concatenates the inputs, reading standard input if there
+// are none.
+func readInputs(names []string) ([]byte, error) {
+   if len(names) == 0 {
+      return readInput("-")
+   }
+   var data []byte
+   for _, name := range names {
+      input, err := readInput(name)
+      if err != nil {
+         return nil, err
+      }
+      data = append(data, input...)
+   }
+   return data, nil
+}
+
+func createOutput(name string) (*os.File, error) {
+   if name == "-" {
+      return os.Stdout, nil
+   }
+   return os.Create(name)
+}
+
+// splitInit splits data before its first moof, so a complete fragmented
+// file can be used in place of an init segment.
+func splitInit(data []byte) ([]byte, []byte, error) {
+   offset := 0
+   for offset < len(data) {
+      header, err := sofia.DecodeBoxHeader(data[offset:])
+      if err != nil {
+         break
+      }
+      if string(header.Type[:]) == "moof" {
+         return data[:offset], data[offset:], nil
+      }
+      boxSize := int(header.Size)
+      if boxSize == 0 {
+         boxSize = len(data) - offset
+      }
+      if boxSize < 8 || offset+boxSize > len(data) {
+         return nil, nil, errors.New("invalid box size in init segment")
+      }
+      offset += boxSize
+   }
+   return data, nil, nil
+}
+
+// initMoov returns the moov of an init segment, if it has one.
+func initMoov(data []byte) (*sofia.MoovBox, bool) {
+   boxes, err := sofia.DecodeBoxes(data)
+   if err != nil {
+      return nil, false
+   }
+   return sofia.FindMoov(boxes)
+}
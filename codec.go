@@ -0,0 +1,1038 @@
+// codec.go
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "math/bits"
+   "strings"
+)
+
+// --- AVCC ---
+// AvcCBox holds the AVCDecoderConfigurationRecord.
+// Specification: ISO/IEC 14496-15
+type AvcCBox struct {
+   Header               *BoxHeader
+   ConfigurationVersion byte
+   Profile              byte
+   ProfileCompatibility byte
+   Level                byte
+   LengthSize           byte // size of the NAL unit length prefix, 1 to 4
+   SPS                  [][]byte
+   PPS                  [][]byte
+   RemainingData        []byte // High profile chroma and bit depth fields
+}
+
+func DecodeAvcCBox(data []byte) (*AvcCBox, error) {
+   b := &AvcCBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 14 {
+      return nil, sizeError("avcC box too short", 14, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   b.ConfigurationVersion = p.Byte()
+   b.Profile = p.Byte()
+   b.ProfileCompatibility = p.Byte()
+   b.Level = p.Byte()
+   b.LengthSize = p.Byte()&0x03 + 1
+   spsCount := int(p.Byte() & 0x1F)
+   b.SPS, err = parseNALUnits(&p, spsCount)
+   if err != nil {
+      return nil, err
+   }
+   if len(data) < p.offset+1 {
+      return nil, sizeError("avcC box too short for PPS count", p.offset+1, len(data))
+   }
+   ppsCount := int(p.Byte())
+   b.PPS, err = parseNALUnits(&p, ppsCount)
+   if err != nil {
+      return nil, err
+   }
+   b.RemainingData = data[p.offset:]
+   return b, nil
+}
+
+func (b *AvcCBox) Encode() []byte {
+   buffer := make([]byte, 8, 64)
+   buffer = append(
+      buffer, b.ConfigurationVersion, b.Profile, b.ProfileCompatibility,
+      b.Level, 0xFC|(b.LengthSize-1)&0x03, 0xE0|byte(len(b.SPS))&0x1F,
+   )
+   buffer = appendNALUnits(buffer, b.SPS)
+   buffer = append(buffer, byte(len(b.PPS)))
+   buffer = appendNALUnits(buffer, b.PPS)
+   buffer = append(buffer, b.RemainingData...)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// --- HVCC ---
+// HvcCBox holds the HEVCDecoderConfigurationRecord.
+// Specification: ISO/IEC 14496-15
+type HvcCBox struct {
+   Header                           *BoxHeader
+   ConfigurationVersion             byte
+   GeneralProfileSpace              byte
+   GeneralTierFlag                  bool
+   GeneralProfileIDC                byte
+   GeneralProfileCompatibilityFlags uint32
+   GeneralConstraintIndicatorFlags  uint64 // 48 bits
+   GeneralLevelIDC                  byte
+   MinSpatialSegmentationIDC        uint16
+   ParallelismType                  byte
+   ChromaFormatIDC                  byte
+   BitDepthLumaMinus8               byte
+   BitDepthChromaMinus8             byte
+   AvgFrameRate                     uint16
+   ConstantFrameRate                byte
+   NumTemporalLayers                byte
+   TemporalIDNested                 bool
+   LengthSize                       byte // size of the NAL unit length prefix, 1 to 4
+   Arrays                           []HvcCArray
+}
+
+type HvcCArray struct {
+   ArrayCompleteness bool
+   NALUnitType       byte
+   NALUnits          [][]byte
+}
+
+func DecodeHvcCBox(data []byte) (*HvcCBox, error) {
+   b := &HvcCBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 31 { // 8 byte header + 23 bytes of fixed fields
+      return nil, sizeError("hvcC box too short", 31, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   b.ConfigurationVersion = p.Byte()
+   profile := p.Byte()
+   b.GeneralProfileSpace = profile >> 6
+   b.GeneralTierFlag = profile&0x20 != 0
+   b.GeneralProfileIDC = profile & 0x1F
+   b.GeneralProfileCompatibilityFlags = p.Uint32()
+   b.GeneralConstraintIndicatorFlags = uint64(p.Uint16())<<32 | uint64(p.Uint32())
+   b.GeneralLevelIDC = p.Byte()
+   b.MinSpatialSegmentationIDC = p.Uint16() & 0x0FFF
+   b.ParallelismType = p.Byte() & 0x03
+   b.ChromaFormatIDC = p.Byte() & 0x03
+   b.BitDepthLumaMinus8 = p.Byte() & 0x07
+   b.BitDepthChromaMinus8 = p.Byte() & 0x07
+   b.AvgFrameRate = p.Uint16()
+   last := p.Byte()
+   b.ConstantFrameRate = last >> 6
+   b.NumTemporalLayers = last >> 3 & 0x07
+   b.TemporalIDNested = last&0x04 != 0
+   b.LengthSize = last&0x03 + 1
+   arrayCount := int(p.Byte())
+   b.Arrays = make([]HvcCArray, arrayCount)
+   for i := range b.Arrays {
+      if len(data) < p.offset+3 {
+         return nil, sizeError("hvcC box too short for NAL unit array", p.offset+3, len(data))
+      }
+      nalType := p.Byte()
+      b.Arrays[i].ArrayCompleteness = nalType&0x80 != 0
+      b.Arrays[i].NALUnitType = nalType & 0x3F
+      b.Arrays[i].NALUnits, err = parseNALUnits(&p, int(p.Uint16()))
+      if err != nil {
+         return nil, err
+      }
+   }
+   return b, nil
+}
+
+func (b *HvcCBox) Encode() []byte {
+   buffer := make([]byte, 31, 128)
+   w := writer{buf: buffer, offset: 8}
+   w.PutByte(b.ConfigurationVersion)
+   profile := b.GeneralProfileSpace<<6 | b.GeneralProfileIDC&0x1F
+   if b.GeneralTierFlag {
+      profile |= 0x20
+   }
+   w.PutByte(profile)
+   w.PutUint32(b.GeneralProfileCompatibilityFlags)
+   w.PutUint16(uint16(b.GeneralConstraintIndicatorFlags >> 32))
+   w.PutUint32(uint32(b.GeneralConstraintIndicatorFlags))
+   w.PutByte(b.GeneralLevelIDC)
+   w.PutUint16(0xF000 | b.MinSpatialSegmentationIDC)
+   w.PutByte(0xFC | b.ParallelismType)
+   w.PutByte(0xFC | b.ChromaFormatIDC)
+   w.PutByte(0xF8 | b.BitDepthLumaMinus8)
+   w.PutByte(0xF8 | b.BitDepthChromaMinus8)
+   w.PutUint16(b.AvgFrameRate)
+   last := b.ConstantFrameRate<<6 | b.NumTemporalLayers<<3 | (b.LengthSize-1)&0x03
+   if b.TemporalIDNested {
+      last |= 0x04
+   }
+   w.PutByte(last)
+   w.PutByte(byte(len(b.Arrays)))
+   for _, array := range b.Arrays {
+      nalType := array.NALUnitType & 0x3F
+      if array.ArrayCompleteness {
+         nalType |= 0x80
+      }
+      buffer = append(buffer, nalType)
+      buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(array.NALUnits)))
+      buffer = appendNALUnits(buffer, array.NALUnits)
+   }
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// --- AV1C ---
+// Av1CBox holds the AV1CodecConfigurationRecord.
+// Specification: AV1 Codec ISO Media File Format Binding
+type Av1CBox struct {
+   Header                           *BoxHeader
+   Version                          byte
+   SeqProfile                       byte
+   SeqLevelIdx0                     byte
+   SeqTier0                         byte
+   HighBitdepth                     bool
+   TwelveBit                        bool
+   Monochrome                       bool
+   ChromaSubsamplingX               bool
+   ChromaSubsamplingY               bool
+   ChromaSamplePosition             byte
+   InitialPresentationDelayPresent  bool
+   InitialPresentationDelayMinusOne byte
+   ConfigOBUs                       []byte
+}
+
+func DecodeAv1CBox(data []byte) (*Av1CBox, error) {
+   b := &Av1CBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 12 {
+      return nil, sizeError("av1C box too short", 12, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   b.Version = p.Byte() & 0x7F
+   profile := p.Byte()
+   b.SeqProfile = profile >> 5
+   b.SeqLevelIdx0 = profile & 0x1F
+   flags := p.Byte()
+   b.SeqTier0 = flags >> 7
+   b.HighBitdepth = flags&0x40 != 0
+   b.TwelveBit = flags&0x20 != 0
+   b.Monochrome = flags&0x10 != 0
+   b.ChromaSubsamplingX = flags&0x08 != 0
+   b.ChromaSubsamplingY = flags&0x04 != 0
+   b.ChromaSamplePosition = flags & 0x03
+   delay := p.Byte()
+   b.InitialPresentationDelayPresent = delay&0x10 != 0
+   b.InitialPresentationDelayMinusOne = delay & 0x0F
+   b.ConfigOBUs = data[p.offset:]
+   return b, nil
+}
+
+func (b *Av1CBox) Encode() []byte {
+   buffer := make([]byte, 12, 12+len(b.ConfigOBUs))
+   buffer[8] = 0x80 | b.Version
+   buffer[9] = b.SeqProfile<<5 | b.SeqLevelIdx0&0x1F
+   flags := b.SeqTier0<<7 | b.ChromaSamplePosition&0x03
+   for i, set := range []bool{
+      b.HighBitdepth, b.TwelveBit, b.Monochrome, b.ChromaSubsamplingX,
+      b.ChromaSubsamplingY,
+   } {
+      if set {
+         flags |= 0x40 >> i
+      }
+   }
+   buffer[10] = flags
+   if b.InitialPresentationDelayPresent {
+      buffer[11] = 0x10 | b.InitialPresentationDelayMinusOne&0x0F
+   }
+   buffer = append(buffer, b.ConfigOBUs...)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// BitDepth returns 8, 10 or 12.
+func (b *Av1CBox) BitDepth() int {
+   switch {
+   case b.SeqProfile == 2 && b.HighBitdepth && b.TwelveBit:
+      return 12
+   case b.HighBitdepth:
+      return 10
+   }
+   return 8
+}
+
+// --- VPCC ---
+// VpcCBox holds the VPCodecConfigurationRecord.
+// Specification: VP Codec ISO Media File Format Binding
+type VpcCBox struct {
+   Header                  *BoxHeader
+   Version                 byte
+   Flags                   uint32
+   Profile                 byte
+   Level                   byte
+   BitDepth                byte
+   ChromaSubsampling       byte
+   VideoFullRangeFlag      bool
+   ColourPrimaries         byte
+   TransferCharacteristics byte
+   MatrixCoefficients      byte
+   CodecInitializationData []byte
+}
+
+func DecodeVpcCBox(data []byte) (*VpcCBox, error) {
+   b := &VpcCBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 20 {
+      return nil, sizeError("vpcC box too short", 20, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   b.Profile = p.Byte()
+   b.Level = p.Byte()
+   depth := p.Byte()
+   b.BitDepth = depth >> 4
+   b.ChromaSubsampling = depth >> 1 & 0x07
+   b.VideoFullRangeFlag = depth&0x01 != 0
+   b.ColourPrimaries = p.Byte()
+   b.TransferCharacteristics = p.Byte()
+   b.MatrixCoefficients = p.Byte()
+   size := int(p.Uint16())
+   if len(data) < p.offset+size {
+      return nil, sizeError(
+         "vpcC box too short for codec initialization data",
+         p.offset+size, len(data),
+      )
+   }
+   b.CodecInitializationData = p.Bytes(size)
+   return b, nil
+}
+
+func (b *VpcCBox) Encode() []byte {
+   size := 20 + len(b.CodecInitializationData)
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.PutByte(b.Profile)
+   w.PutByte(b.Level)
+   depth := b.BitDepth<<4 | (b.ChromaSubsampling&0x07)<<1
+   if b.VideoFullRangeFlag {
+      depth |= 0x01
+   }
+   w.PutByte(depth)
+   w.PutByte(b.ColourPrimaries)
+   w.PutByte(b.TransferCharacteristics)
+   w.PutByte(b.MatrixCoefficients)
+   w.PutUint16(uint16(len(b.CodecInitializationData)))
+   w.PutBytes(b.CodecInitializationData)
+   b.Header.Size = uint32(size)
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// --- DVCC ---
+// DoviBox holds the DOVIDecoderConfigurationRecord of a Dolby Vision
+// stream, in a dvcC box for profiles up to 7, dvvC for profiles 8 to 10 and
+// dvwC for later ones.
+// Specification: Dolby Vision Streams Within the ISO Base Media File Format
+type DoviBox struct {
+   Header                  *BoxHeader
+   VersionMajor            byte
+   VersionMinor            byte
+   Profile                 byte
+   Level                   byte
+   RPUPresent              bool
+   ELPresent               bool
+   BLPresent               bool
+   BLSignalCompatibilityID byte
+   Reserved                []byte // from the byte holding the compatibility ID
+}
+
+func DecodeDoviBox(data []byte) (*DoviBox, error) {
+   b := &DoviBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 13 {
+      return nil, sizeError("Dolby Vision configuration box too short", 13, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   b.VersionMajor = p.Byte()
+   b.VersionMinor = p.Byte()
+   bits := p.Uint16()
+   b.Profile = byte(bits >> 9)
+   b.Level = byte(bits >> 3 & 0x3F)
+   b.RPUPresent = bits&0x04 != 0
+   b.ELPresent = bits&0x02 != 0
+   b.BLPresent = bits&0x01 != 0
+   b.BLSignalCompatibilityID = data[p.offset] >> 4
+   b.Reserved = data[p.offset:]
+   return b, nil
+}
+
+func (b *DoviBox) Encode() []byte {
+   size := 12 + max(len(b.Reserved), 20)
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutByte(b.VersionMajor)
+   w.PutByte(b.VersionMinor)
+   bits := uint16(b.Profile&0x7F)<<9 | uint16(b.Level&0x3F)<<3
+   for i, flag := range []bool{b.BLPresent, b.ELPresent, b.RPUPresent} {
+      if flag {
+         bits |= 1 << i
+      }
+   }
+   w.PutUint16(bits)
+   w.PutBytes(b.Reserved)
+   buffer[12] = b.BLSignalCompatibilityID<<4 | buffer[12]&0x0F
+   b.Header.Size = uint32(size)
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// --- ESDS ---
+// EsdsBox holds the ES_Descriptor of an MPEG-4 audio or visual stream.
+// Specification: ISO/IEC 14496-1 and ISO/IEC 14496-14
+type EsdsBox struct {
+   Header               *BoxHeader
+   Version              byte
+   Flags                uint32
+   ESID                 uint16
+   ObjectTypeIndication byte // 0x40 for MPEG-4 audio
+   StreamType           byte // 0x05 for audio
+   BufferSizeDB         uint32
+   MaxBitrate           uint32
+   AvgBitrate           uint32
+   DecoderSpecificInfo  []byte // AudioSpecificConfig for MPEG-4 audio
+}
+
+const (
+   esDescrTag              = 0x03
+   decoderConfigDescrTag   = 0x04
+   decoderSpecificInfoTag  = 0x05
+   slConfigDescrTag        = 0x06
+   esdsFlagStreamDependent = 0x80
+   esdsFlagURL             = 0x40
+   esdsFlagOCRStream       = 0x20
+)
+
+func DecodeEsdsBox(data []byte) (*EsdsBox, error) {
+   b := &EsdsBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 12 {
+      return nil, sizeError("esds box too short", 12, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+
+   tag, descr, err := parseDescriptor(data[p.offset:])
+   if err != nil {
+      return nil, err
+   }
+   es := descr.data
+   if tag != esDescrTag {
+      return nil, errors.New("esds does not start with an ES_Descriptor")
+   }
+   if len(es) < 3 {
+      return nil, sizeError("ES_Descriptor too short", 3, len(es))
+   }
+   b.ESID = binary.BigEndian.Uint16(es)
+   flags := es[2]
+   es = es[3:]
+   if flags&esdsFlagStreamDependent != 0 {
+      if len(es) < 2 {
+         return nil, sizeError("ES_Descriptor too short for dependsOn_ES_ID", 2, len(es))
+      }
+      es = es[2:]
+   }
+   if flags&esdsFlagURL != 0 {
+      if len(es) < 1 || len(es) < 1+int(es[0]) {
+         return nil, errors.New("ES_Descriptor too short for URL")
+      }
+      es = es[1+int(es[0]):]
+   }
+   if flags&esdsFlagOCRStream != 0 {
+      if len(es) < 2 {
+         return nil, sizeError("ES_Descriptor too short for OCR_ES_ID", 2, len(es))
+      }
+      es = es[2:]
+   }
+   for len(es) > 0 {
+      tag, descr, err := parseDescriptor(es)
+      if err != nil {
+         return nil, err
+      }
+      es = descr.rest
+      if tag != decoderConfigDescrTag {
+         continue
+      }
+      config := descr.data
+      if len(config) < 13 {
+         return nil, sizeError("DecoderConfigDescriptor too short", 13, len(config))
+      }
+      b.ObjectTypeIndication = config[0]
+      b.StreamType = config[1] >> 2
+      b.BufferSizeDB = uint32(config[2])<<16 | uint32(config[3])<<8 | uint32(config[4])
+      b.MaxBitrate = binary.BigEndian.Uint32(config[5:])
+      b.AvgBitrate = binary.BigEndian.Uint32(config[9:])
+      config = config[13:]
+      for len(config) > 0 {
+         tag, info, err := parseDescriptor(config)
+         if err != nil {
+            return nil, err
+         }
+         config = info.rest
+         if tag == decoderSpecificInfoTag {
+            b.DecoderSpecificInfo = info.data
+         }
+      }
+   }
+   return b, nil
+}
+
+// Encode writes the descriptors in their usual form for MP4 files: no
+// optional ES_Descriptor fields and a predefined SLConfigDescriptor.
+func (b *EsdsBox) Encode() []byte {
+   var config []byte
+   config = append(config, b.ObjectTypeIndication, b.StreamType<<2|0x01)
+   config = append(config, byte(b.BufferSizeDB>>16), byte(b.BufferSizeDB>>8), byte(b.BufferSizeDB))
+   config = binary.BigEndian.AppendUint32(config, b.MaxBitrate)
+   config = binary.BigEndian.AppendUint32(config, b.AvgBitrate)
+   if b.DecoderSpecificInfo != nil {
+      config = appendDescriptor(config, decoderSpecificInfoTag, b.DecoderSpecificInfo)
+   }
+   es := binary.BigEndian.AppendUint16(nil, b.ESID)
+   es = append(es, 0)
+   es = appendDescriptor(es, decoderConfigDescrTag, config)
+   es = appendDescriptor(es, slConfigDescrTag, []byte{0x02})
+
+   buffer := make([]byte, 12)
+   binary.BigEndian.PutUint32(buffer[8:], uint32(b.Version)<<24|b.Flags)
+   buffer = appendDescriptor(buffer, esDescrTag, es)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// AudioObjectType returns the MPEG-4 audio object type from the
+// AudioSpecificConfig, such as 2 for AAC LC or 5 for HE-AAC.
+func (b *EsdsBox) AudioObjectType() byte {
+   if len(b.DecoderSpecificInfo) == 0 {
+      return 0
+   }
+   objectType := b.DecoderSpecificInfo[0] >> 3
+   if objectType == 31 && len(b.DecoderSpecificInfo) >= 2 {
+      objectType = 32 + (b.DecoderSpecificInfo[0]&0x07)<<3 | b.DecoderSpecificInfo[1]>>5
+   }
+   return objectType
+}
+
+type descriptor struct {
+   data []byte
+   rest []byte
+}
+
+// parseDescriptor reads one tag, expandable size and body.
+func parseDescriptor(data []byte) (byte, descriptor, error) {
+   if len(data) < 2 {
+      return 0, descriptor{}, sizeError("descriptor too short", 2, len(data))
+   }
+   tag := data[0]
+   size := 0
+   offset := 1
+   for i := 0; i < 4; i++ {
+      if offset >= len(data) {
+         return 0, descriptor{}, errors.New("descriptor size truncated")
+      }
+      next := data[offset]
+      offset++
+      size = size<<7 | int(next&0x7F)
+      if next&0x80 == 0 {
+         break
+      }
+   }
+   if len(data) < offset+size {
+      return 0, descriptor{}, sizeError("descriptor too short", offset+size, len(data))
+   }
+   return tag, descriptor{data[offset : offset+size], data[offset+size:]}, nil
+}
+
+func appendDescriptor(buffer []byte, tag byte, body []byte) []byte {
+   buffer = append(buffer, tag)
+   size := len(body)
+   shift := 0
+   for size>>(shift+7) > 0 && shift < 21 {
+      shift += 7
+   }
+   for ; shift > 0; shift -= 7 {
+      buffer = append(buffer, 0x80|byte(size>>shift)&0x7F)
+   }
+   buffer = append(buffer, byte(size)&0x7F)
+   return append(buffer, body...)
+}
+
+// --- DOPS ---
+// DOpsBox holds the Opus specific configuration.
+// Specification: Encapsulation of Opus in ISO Base Media File Format
+type DOpsBox struct {
+   Header               *BoxHeader
+   Version              byte
+   OutputChannelCount   byte
+   PreSkip              uint16
+   InputSampleRate      uint32
+   OutputGain           int16
+   ChannelMappingFamily byte
+   StreamCount          byte
+   CoupledCount         byte
+   ChannelMapping       []byte
+}
+
+func DecodeDOpsBox(data []byte) (*DOpsBox, error) {
+   b := &DOpsBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 19 {
+      return nil, sizeError("dOps box too short", 19, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   b.Version = p.Byte()
+   b.OutputChannelCount = p.Byte()
+   b.PreSkip = p.Uint16()
+   b.InputSampleRate = p.Uint32()
+   b.OutputGain = int16(p.Uint16())
+   b.ChannelMappingFamily = p.Byte()
+   if b.ChannelMappingFamily != 0 {
+      if len(data) < p.offset+2+int(b.OutputChannelCount) {
+         return nil, sizeError(
+            "dOps box too short for channel mapping",
+            p.offset+2+int(b.OutputChannelCount), len(data),
+         )
+      }
+      b.StreamCount = p.Byte()
+      b.CoupledCount = p.Byte()
+      b.ChannelMapping = p.Bytes(int(b.OutputChannelCount))
+   }
+   return b, nil
+}
+
+func (b *DOpsBox) Encode() []byte {
+   buffer := make([]byte, 19, 21+len(b.ChannelMapping))
+   w := writer{buf: buffer, offset: 8}
+   w.PutByte(b.Version)
+   w.PutByte(b.OutputChannelCount)
+   w.PutUint16(b.PreSkip)
+   w.PutUint32(b.InputSampleRate)
+   w.PutUint16(uint16(b.OutputGain))
+   w.PutByte(b.ChannelMappingFamily)
+   if b.ChannelMappingFamily != 0 {
+      buffer = append(buffer, b.StreamCount, b.CoupledCount)
+      buffer = append(buffer, b.ChannelMapping...)
+   }
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// --- DAC3 ---
+// Dac3Box holds the AC3SpecificBox.
+// Specification: ETSI TS 102 366 Annex F
+type Dac3Box struct {
+   Header      *BoxHeader
+   Fscod       byte
+   Bsid        byte
+   Bsmod       byte
+   Acmod       byte
+   LfeOn       bool
+   BitRateCode byte
+}
+
+func DecodeDac3Box(data []byte) (*Dac3Box, error) {
+   b := &Dac3Box{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   if len(data) < 11 {
+      return nil, sizeError("dac3 box too short", 11, len(data))
+   }
+   r := bitReader{data: data[8:11]}
+   b.Fscod = byte(r.Bits(2))
+   b.Bsid = byte(r.Bits(5))
+   b.Bsmod = byte(r.Bits(3))
+   b.Acmod = byte(r.Bits(3))
+   b.LfeOn = r.Bits(1) == 1
+   b.BitRateCode = byte(r.Bits(5))
+   return b, nil
+}
+
+func (b *Dac3Box) Encode() []byte {
+   var w bitWriter
+   w.PutBits(uint64(b.Fscod), 2)
+   w.PutBits(uint64(b.Bsid), 5)
+   w.PutBits(uint64(b.Bsmod), 3)
+   w.PutBits(uint64(b.Acmod), 3)
+   w.PutBool(b.LfeOn)
+   w.PutBits(uint64(b.BitRateCode), 5)
+   w.PutBits(0, 5)
+   buffer := append(make([]byte, 8), w.data...)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// ChannelCount returns the number of channels, including the LFE channel.
+func (b *Dac3Box) ChannelCount() int {
+   return ac3ChannelCount(b.Acmod, b.LfeOn)
+}
+
+// --- DEC3 ---
+// Dec3Box holds the EC3SpecificBox.
+// Specification: ETSI TS 102 366 Annex F
+type Dec3Box struct {
+   Header        *BoxHeader
+   DataRate      uint16 // kbit/s
+   Substreams    []Ec3Substream
+   RemainingData []byte // extension fields, such as the Atmos complexity index
+}
+
+type Ec3Substream struct {
+   Fscod     byte
+   Bsid      byte
+   Asvc      bool
+   Bsmod     byte
+   Acmod     byte
+   LfeOn     bool
+   NumDepSub byte
+   ChanLoc   uint16
+}
+
+func DecodeDec3Box(data []byte) (*Dec3Box, error) {
+   b := &Dec3Box{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 10 {
+      return nil, sizeError("dec3 box too short", 10, len(data))
+   }
+   r := bitReader{data: data[8:]}
+   b.DataRate = uint16(r.Bits(13))
+   count := int(r.Bits(3)) + 1
+   if len(data) < 10+count*3 {
+      return nil, sizeError("dec3 box too short for substreams", 10+count*3, len(data))
+   }
+   b.Substreams = make([]Ec3Substream, count)
+   for i := range b.Substreams {
+      sub := &b.Substreams[i]
+      sub.Fscod = byte(r.Bits(2))
+      sub.Bsid = byte(r.Bits(5))
+      r.Bits(1)
+      sub.Asvc = r.Bits(1) == 1
+      sub.Bsmod = byte(r.Bits(3))
+      sub.Acmod = byte(r.Bits(3))
+      sub.LfeOn = r.Bits(1) == 1
+      r.Bits(3)
+      sub.NumDepSub = byte(r.Bits(4))
+      if sub.NumDepSub > 0 {
+         sub.ChanLoc = uint16(r.Bits(9))
+      } else {
+         r.Bits(1)
+      }
+   }
+   b.RemainingData = data[8+r.offset/8:]
+   return b, nil
+}
+
+func (b *Dec3Box) Encode() []byte {
+   var w bitWriter
+   w.PutBits(uint64(b.DataRate), 13)
+   w.PutBits(uint64(len(b.Substreams)-1), 3)
+   for _, sub := range b.Substreams {
+      w.PutBits(uint64(sub.Fscod), 2)
+      w.PutBits(uint64(sub.Bsid), 5)
+      w.PutBits(0, 1)
+      w.PutBool(sub.Asvc)
+      w.PutBits(uint64(sub.Bsmod), 3)
+      w.PutBits(uint64(sub.Acmod), 3)
+      w.PutBool(sub.LfeOn)
+      w.PutBits(0, 3)
+      w.PutBits(uint64(sub.NumDepSub), 4)
+      if sub.NumDepSub > 0 {
+         w.PutBits(uint64(sub.ChanLoc), 9)
+      } else {
+         w.PutBits(0, 1)
+      }
+   }
+   buffer := append(make([]byte, 8), w.data...)
+   buffer = append(buffer, b.RemainingData...)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// ChannelCount returns the number of channels of the independent
+// substreams, including LFE channels.
+func (b *Dec3Box) ChannelCount() int {
+   count := 0
+   for _, sub := range b.Substreams {
+      count += ac3ChannelCount(sub.Acmod, sub.LfeOn)
+   }
+   return count
+}
+
+// ac3ChannelCount follows the audio coding mode table of ETSI TS 102 366.
+func ac3ChannelCount(acmod byte, lfeOn bool) int {
+   count := [8]int{2, 1, 2, 3, 3, 4, 4, 5}[acmod&0x07]
+   if lfeOn {
+      count++
+   }
+   return count
+}
+
+// --- DFLA ---
+// DfLaBox holds the FLAC metadata blocks, the first of which is always
+// STREAMINFO.
+// Specification: Encapsulation of FLAC in ISO Base Media File Format
+type DfLaBox struct {
+   Header  *BoxHeader
+   Version byte
+   Flags   uint32
+   Blocks  []FlacMetadataBlock
+}
+
+type FlacMetadataBlock struct {
+   Type byte
+   Data []byte
+}
+
+type FlacStreamInfo struct {
+   MinBlockSize  uint16
+   MaxBlockSize  uint16
+   MinFrameSize  uint32
+   MaxFrameSize  uint32
+   SampleRate    uint32
+   ChannelCount  byte
+   BitsPerSample byte
+   TotalSamples  uint64
+   MD5           [16]byte
+}
+
+func DecodeDfLaBox(data []byte) (*DfLaBox, error) {
+   b := &DfLaBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 12 {
+      return nil, sizeError("dfLa box too short", 12, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   for p.offset < len(data) {
+      if len(data) < p.offset+4 {
+         return nil, sizeError("dfLa box too short for block header", p.offset+4, len(data))
+      }
+      blockHeader := p.Uint32()
+      size := int(blockHeader & 0x00FFFFFF)
+      if len(data) < p.offset+size {
+         return nil, sizeError("dfLa box too short for block", p.offset+size, len(data))
+      }
+      b.Blocks = append(b.Blocks, FlacMetadataBlock{
+         Type: byte(blockHeader>>24) & 0x7F,
+         Data: p.Bytes(size),
+      })
+      if blockHeader&0x80000000 != 0 { // last-metadata-block flag
+         break
+      }
+   }
+   return b, nil
+}
+
+func (b *DfLaBox) Encode() []byte {
+   buffer := make([]byte, 12)
+   binary.BigEndian.PutUint32(buffer[8:], uint32(b.Version)<<24|b.Flags)
+   for i, block := range b.Blocks {
+      blockHeader := uint32(block.Type&0x7F)<<24 | uint32(len(block.Data))
+      if i == len(b.Blocks)-1 {
+         blockHeader |= 0x80000000
+      }
+      buffer = binary.BigEndian.AppendUint32(buffer, blockHeader)
+      buffer = append(buffer, block.Data...)
+   }
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// StreamInfo decodes the STREAMINFO block.
+func (b *DfLaBox) StreamInfo() (*FlacStreamInfo, error) {
+   if len(b.Blocks) == 0 || b.Blocks[0].Type != 0 {
+      return nil, errors.New("dfLa has no STREAMINFO block")
+   }
+   data := b.Blocks[0].Data
+   if len(data) < 34 {
+      return nil, sizeError("STREAMINFO block too short", 34, len(data))
+   }
+   info := &FlacStreamInfo{}
+   r := bitReader{data: data}
+   info.MinBlockSize = uint16(r.Bits(16))
+   info.MaxBlockSize = uint16(r.Bits(16))
+   info.MinFrameSize = uint32(r.Bits(24))
+   info.MaxFrameSize = uint32(r.Bits(24))
+   info.SampleRate = uint32(r.Bits(20))
+   info.ChannelCount = byte(r.Bits(3)) + 1
+   info.BitsPerSample = byte(r.Bits(5)) + 1
+   info.TotalSamples = r.Bits(36)
+   copy(info.MD5[:], data[18:34])
+   return info, nil
+}
+
+// --- NAL UNIT HELPERS ---
+
+func parseNALUnits(p *parser, count int) ([][]byte, error) {
+   units := make([][]byte, count)
+   for i := range units {
+      if len(p.data) < p.offset+2 {
+         return nil, sizeError("too short for NAL unit length", p.offset+2, len(p.data))
+      }
+      size := int(p.Uint16())
+      if len(p.data) < p.offset+size {
+         return nil, sizeError("too short for NAL unit", p.offset+size, len(p.data))
+      }
+      units[i] = p.Bytes(size)
+   }
+   return units, nil
+}
+
+func appendNALUnits(buffer []byte, units [][]byte) []byte {
+   for _, unit := range units {
+      buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(unit)))
+      buffer = append(buffer, unit...)
+   }
+   return buffer
+}
+
+// --- BIT HELPERS ---
+
+type bitReader struct {
+   data   []byte
+   offset int // in bits
+}
+
+// Bits reads n bits, most significant first. Bits past the end read as 0.
+func (r *bitReader) Bits(n int) uint64 {
+   var val uint64
+   for i := 0; i < n; i++ {
+      val <<= 1
+      index := r.offset / 8
+      if index < len(r.data) {
+         val |= uint64(r.data[index]>>(7-r.offset%8)) & 1
+      }
+      r.offset++
+   }
+   return val
+}
+
+type bitWriter struct {
+   data   []byte
+   offset int // in bits
+}
+
+func (w *bitWriter) PutBits(val uint64, n int) {
+   for i := n - 1; i >= 0; i-- {
+      if w.offset%8 == 0 {
+         w.data = append(w.data, 0)
+      }
+      if val>>i&1 == 1 {
+         w.data[len(w.data)-1] |= 0x80 >> (w.offset % 8)
+      }
+      w.offset++
+   }
+}
+
+func (w *bitWriter) PutBool(val bool) {
+   if val {
+      w.PutBits(1, 1)
+   } else {
+      w.PutBits(0, 1)
+   }
+}
+
+// codec returns the part of the codecs parameter after the format, such as
+// "2.4.L120.B0", following ISO/IEC 14496-15 Annex E.
+func (b *HvcCBox) codec() string {
+   var builder strings.Builder
+   if b.GeneralProfileSpace > 0 {
+      builder.WriteByte('A' + b.GeneralProfileSpace - 1)
+   }
+   fmt.Fprintf(&builder, "%d.", b.GeneralProfileIDC)
+   fmt.Fprintf(&builder, "%X.", bits.Reverse32(b.GeneralProfileCompatibilityFlags))
+   if b.GeneralTierFlag {
+      builder.WriteByte('H')
+   } else {
+      builder.WriteByte('L')
+   }
+   fmt.Fprintf(&builder, "%d", b.GeneralLevelIDC)
+   var constraints [8]byte
+   binary.BigEndian.PutUint64(constraints[:], b.GeneralConstraintIndicatorFlags)
+   // 48 bits, with trailing zero bytes omitted
+   end := 8
+   for end > 2 && constraints[end-1] == 0 {
+      end--
+   }
+   for _, constraint := range constraints[2:end] {
+      fmt.Fprintf(&builder, ".%X", constraint)
+   }
+   return builder.String()
+}
@@ -0,0 +1,100 @@
+// concat.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "fmt"
+)
+
+// AddInit starts a new source, such as after an encoder restart, whose
+// segments follow with AddSegment. The track must have the same track ID,
+// handler type and timescale. A sample entry unlike those in moov is added
+// to its stsd, and the samples of the source refer to it through the
+// sample_description_index of stsc. Decode times are rebased so that the
+// source carries on where the last one ended.
+func (r *Remuxer) AddInit(initSegment []byte) error {
+   if r.Moov == nil {
+      return errors.New("must call Initialize")
+   }
+   if err := r.addInit(initSegment); err != nil {
+      return err
+   }
+   r.inits = append(r.inits, initSegment)
+   return nil
+}
+
+func (r *Remuxer) addInit(initSegment []byte) error {
+   boxes, err := DecodeBoxes(initSegment)
+   if err != nil {
+      return fmt.Errorf("parsing init segment: %w", err)
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      return errors.New("no moov found")
+   }
+   stsd, mdhd, err := sampleDescriptions(r.Moov)
+   if err != nil {
+      return err
+   }
+   newStsd, newMdhd, err := sampleDescriptions(moov)
+   if err != nil {
+      return fmt.Errorf("init segment: %w", err)
+   }
+   if kind, newKind := r.Moov.Trak[0].HandlerType(), moov.Trak[0].HandlerType(); kind != newKind {
+      return fmt.Errorf("handler type %q does not match %q", newKind, kind)
+   }
+   if id, newID := trakID(r.Moov.Trak[0]), trakID(moov.Trak[0]); id != newID {
+      return fmt.Errorf("track ID %d does not match %d", newID, id)
+   }
+   if mdhd.Timescale != newMdhd.Timescale {
+      return fmt.Errorf(
+         "timescale %d does not match %d", newMdhd.Timescale, mdhd.Timescale,
+      )
+   }
+   description, err := addSampleEntry(stsd, newStsd)
+   if err != nil {
+      return err
+   }
+   r.description = description
+   // samples held before Start cannot lead into another source
+   r.held, r.heldData = nil, nil
+   r.rebase = true
+   return nil
+}
+
+// addSampleEntry returns the index, from 1, of the entry of stsd equal to
+// the first of newStsd, adding it after the others if there is none.
+func addSampleEntry(stsd, newStsd *StsdBox) (uint32, error) {
+   newEntries := newStsd.children()
+   if len(newEntries) == 0 {
+      return 0, errors.New("init segment has no sample entry")
+   }
+   entry := newEntries[0].encode()
+   entries := stsd.children()
+   for i, child := range entries {
+      if bytes.Equal(child.encode(), entry) {
+         return uint32(i + 1), nil
+      }
+   }
+   stsd.add(newEntries[0])
+   index := uint32(len(entries) + 1)
+   binary.BigEndian.PutUint32(stsd.HeaderFields[4:], index)
+   return index, nil
+}
+
+// sampleDescriptions returns the stsd and mdhd of the first trak.
+func sampleDescriptions(moov *MoovBox) (*StsdBox, *MdhdBox, error) {
+   if len(moov.Trak) == 0 {
+      return nil, nil, errors.New("no trak found")
+   }
+   mdia := moov.Trak[0].Mdia
+   if mdia == nil || mdia.Mdhd == nil {
+      return nil, nil, errors.New("missing mdhd")
+   }
+   if mdia.Minf == nil || mdia.Minf.Stbl == nil || mdia.Minf.Stbl.Stsd == nil {
+      return nil, nil, errors.New("missing stsd")
+   }
+   return mdia.Minf.Stbl.Stsd, mdia.Mdhd, nil
+}
@@ -0,0 +1,112 @@
+// concat_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "slices"
+   "testing"
+)
+
+// testEntry returns a sample entry sofia does not model, told apart by
+// its data_reference_index.
+func testEntry(reference byte) []byte {
+   return containerBox("wvtt", []byte{0, 0, 0, 0, 0, 0, 0, reference})
+}
+
+func TestAddInitRawEntries(t *testing.T) {
+   avc1 := containerBox("avc1", testVisualFields(), testAvcC)
+   var b bytes.Buffer
+   r := Remuxer{Output: &b}
+   defer r.Close()
+   if err := r.Initialize(testTrackInit("vide", avc1, testEntry(1))); err != nil {
+      t.Fatal(err)
+   }
+   stsd := r.Moov.Trak[0].Mdia.Minf.Stbl.Stsd
+   for _, test := range []struct {
+      entry []byte
+      index uint32
+   }{
+      {testEntry(1), 2},
+      {avc1, 1},
+      {testEntry(2), 3},
+   } {
+      if err := r.AddInit(testTrackInit("vide", test.entry)); err != nil {
+         t.Fatal(err)
+      }
+      if r.description != test.index {
+         t.Errorf("%q entry: got index %d, want %d", test.entry[4:8], r.description, test.index)
+      }
+   }
+   if count := binary.BigEndian.Uint32(stsd.HeaderFields[4:]); count != 3 {
+      t.Errorf("entry_count %d, want 3", count)
+   }
+   // a modelled entry goes after the raw ones
+   visual := testVisualFields()
+   visual[30] = 1
+   if err := r.AddInit(testTrackInit("vide", containerBox("avc1", visual, testAvcC))); err != nil {
+      t.Fatal(err)
+   }
+   if r.description != 4 {
+      t.Errorf("got index %d, want 4", r.description)
+   }
+   var types []string
+   for _, entry := range stsd.children() {
+      types = append(types, string(entry.encode()[4:8]))
+   }
+   if want := []string{"avc1", "wvtt", "wvtt", "avc1"}; !slices.Equal(types, want) {
+      t.Errorf("got entries %q, want %q", types, want)
+   }
+}
+
+func TestAddInitEncrypted(t *testing.T) {
+   var b bytes.Buffer
+   r := Remuxer{Output: &b}
+   defer r.Close()
+   if err := r.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   // a clear lead followed by encrypted content
+   for _, test := range []struct {
+      init  []byte
+      index uint32
+   }{
+      {testTrackInit("vide", testEncv(1)), 2},
+      {testInit(), 1},
+      {testTrackInit("vide", testEncv(1)), 2},
+   } {
+      if err := r.AddInit(test.init); err != nil {
+         t.Fatal(err)
+      }
+      if r.description != test.index {
+         t.Errorf("got index %d, want %d", r.description, test.index)
+      }
+   }
+   want := containerBox(
+      "stsd", []byte{0, 0, 0, 0, 0, 0, 0, 2},
+      containerBox("avc1", testVisualFields(), testAvcC), testEncv(1),
+   )
+   if got := r.Moov.Trak[0].Mdia.Minf.Stbl.Stsd.Encode(); !bytes.Equal(got, want) {
+      t.Errorf("got stsd %x\nwant %x", got, want)
+   }
+}
+
+func TestAddInitTrackID(t *testing.T) {
+   var b bytes.Buffer
+   r := Remuxer{Output: &b}
+   defer r.Close()
+   if err := r.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   init := testInit()
+   moov := testMoov(t, init)
+   moov.Trak[0].Tkhd.TrackID = 2
+   boxes, err := DecodeBoxes(init)
+   if err != nil {
+      t.Fatal(err)
+   }
+   other := append(boxes[0].Encode(), moov.Encode()...)
+   if err := r.AddInit(other); err == nil {
+      t.Error("added an init segment of another track")
+   }
+}
@@ -2,19 +2,29 @@
 package sofia
 
 import (
-   "errors"
+   "bytes"
    "fmt"
 )
 
 // --- ENC (Encrypted Sample Entry) ---
+// EncBox is an encv or enca sample entry. EntryHeader holds the raw fixed
+// fields; when they are complete they are also decoded into Visual or
+// Audio, which then take precedence on Encode.
 type EncBox struct {
    Header      *BoxHeader
    EntryHeader []byte
+   SampleEntry
    Sinf        *SinfBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeEncBox(data []byte) (*EncBox, error) {
+   var d decoder
+   return d.enc(data)
+}
+
+func (d *decoder) enc(data []byte) (*EncBox, error) {
    b := &EncBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -33,48 +43,50 @@ func DecodeEncBox(data []byte) (*EncBox, error) {
    }
    payloadOffset := 8
    if len(data) < payloadOffset+entrySize {
-      b.EntryHeader = data[payloadOffset:b.Header.Size]
+      b.EntryHeader = data[payloadOffset:b.Header.end(data)]
       return b, nil
    }
    b.EntryHeader = data[payloadOffset : payloadOffset+entrySize]
+   err = b.decodeFields(b.EntryHeader, entrySize)
+   if err != nil {
+      return nil, err
+   }
 
-   payload := data[payloadOffset+entrySize : b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
+   childOffset := payloadOffset + entrySize
+   payload := data[childOffset:b.Header.end(data)]
+   err = d.boxes(payload, childOffset, func(header *BoxHeader, content []byte) error {
+      ok, err := b.decodeConfig(header, content)
+      if ok || err != nil {
+         return err
       }
-
-      content := payload[offset : offset+boxSize]
       switch string(header.Type[:]) {
       case "sinf":
-         sinf, err := DecodeSinfBox(content)
+         sinf, err := d.sinf(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Sinf = sinf
+         b.layout = append(b.layout, "sinf")
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         b.layout = append(b.layout, "")
+         return keepChild(string(b.Header.Type[:]), content, &b.Custom, &b.RawChildren)
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
 
 func (b *EncBox) Encode() []byte {
    buffer := make([]byte, 8)
-   buffer = append(buffer, b.EntryHeader...)
-   for _, child := range b.RawChildren {
-      buffer = append(buffer, child...)
+   if b.Visual != nil || b.Audio != nil {
+      buffer = append(buffer, b.encodeFields()...)
+   } else {
+      buffer = append(buffer, b.EntryHeader...)
    }
+   buffer = b.encodeChildren(buffer, b.Custom, b.RawChildren, b.Sinf)
    b.Header.Size = uint32(len(buffer))
    b.Header.Put(buffer)
    return buffer
@@ -95,20 +107,90 @@ func DecodeFrmaBox(data []byte) (*FrmaBox, error) {
    }
 
    if len(data) < 12 {
-      return nil, errors.New("frma box is too small")
+      return nil, sizeError("frma box is too small", 12, len(data))
    }
    copy(b.DataFormat[:], data[8:12])
    return b, nil
 }
 
+func (b *FrmaBox) Encode() []byte {
+   buffer := make([]byte, 12)
+   copy(buffer[8:], b.DataFormat[:])
+   b.Header.Size = 12
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// --- SCHM (Scheme Type) ---
+type SchmBox struct {
+   Header        *BoxHeader
+   Version       byte
+   Flags         uint32
+   SchemeType    [4]byte // such as cenc or cbcs
+   SchemeVersion uint32  // 0x00010000 for version 1.0
+   SchemeURI     string  // present if Flags&0x000001 != 0
+}
+
+func DecodeSchmBox(data []byte) (*SchmBox, error) {
+   b := &SchmBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 20 {
+      return nil, sizeError("schm box is too small", 20, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   copy(b.SchemeType[:], p.Bytes(4))
+   b.SchemeVersion = p.Uint32()
+   if b.Flags&0x000001 != 0 {
+      uri := data[p.offset:]
+      if end := bytes.IndexByte(uri, 0); end >= 0 {
+         uri = uri[:end]
+      }
+      b.SchemeURI = string(uri)
+   }
+   return b, nil
+}
+
+func (b *SchmBox) Encode() []byte {
+   size := 20
+   if b.Flags&0x000001 != 0 {
+      size += len(b.SchemeURI) + 1 // null terminated
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.PutBytes(b.SchemeType[:])
+   w.PutUint32(b.SchemeVersion)
+   if b.Flags&0x000001 != 0 {
+      w.PutBytes([]byte(b.SchemeURI))
+   }
+   b.Header.Size = uint32(size)
+   b.Header.Put(buffer)
+   return buffer
+}
+
 // --- SCHI (Scheme Information) ---
 type SchiBox struct {
    Header      *BoxHeader
    Tenc        *TencBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeSchiBox(data []byte) (*SchiBox, error) {
+   var d decoder
+   return d.schi(data)
+}
+
+func (d *decoder) schi(data []byte) (*SchiBox, error) {
    b := &SchiBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -116,46 +198,54 @@ func DecodeSchiBox(data []byte) (*SchiBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "tenc":
          tenc, err := DecodeTencBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Tenc = tenc
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("schi", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
 
+func (b *SchiBox) Encode() []byte {
+   buffer := make([]byte, 8)
+   if b.Tenc != nil {
+      buffer = append(buffer, b.Tenc.Encode()...)
+   }
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
 // --- SINF ---
 type SinfBox struct {
    Header      *BoxHeader
    Frma        *FrmaBox
+   Schm        *SchmBox
    Schi        *SchiBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeSinfBox(data []byte) (*SinfBox, error) {
+   var d decoder
+   return d.sinf(data)
+}
+
+func (d *decoder) sinf(data []byte) (*SinfBox, error) {
    b := &SinfBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -163,52 +253,76 @@ func DecodeSinfBox(data []byte) (*SinfBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "frma":
          frma, err := DecodeFrmaBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Frma = frma
+      case "schm":
+         schm, err := DecodeSchmBox(content)
+         if err != nil {
+            return err
+         }
+         b.Schm = schm
       case "schi":
-         schi, err := DecodeSchiBox(content)
+         schi, err := d.schi(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Schi = schi
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("sinf", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
 
+func (b *SinfBox) Encode() []byte {
+   buffer := make([]byte, 8)
+   if b.Frma != nil {
+      buffer = append(buffer, b.Frma.Encode()...)
+   }
+   if b.Schm != nil {
+      buffer = append(buffer, b.Schm.Encode()...)
+   }
+   if b.Schi != nil {
+      buffer = append(buffer, b.Schi.Encode()...)
+   }
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
 // --- STSD ---
 type StsdBox struct {
    Header       *BoxHeader
    HeaderFields [8]byte // Ver(1)+Flags(3)+EntryCount(4)
    EncChildren  []*EncBox
+   Entries      []*SampleEntryBox
+   Custom       []*CustomBox
    RawChildren  [][]byte
+   // the kinds of the entries in the order decoded: "enc" for one in
+   // EncChildren, "entry" for one in Entries, and "" for one kept in Custom
+   // or RawChildren
+   layout []string
 }
 
 func DecodeStsdBox(data []byte) (*StsdBox, error) {
+   var d decoder
+   return d.stsd(data)
+}
+
+func (d *decoder) stsd(data []byte) (*StsdBox, error) {
    b := &StsdBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -217,37 +331,34 @@ func DecodeStsdBox(data []byte) (*StsdBox, error) {
    }
 
    if len(data) < 16 {
-      return nil, errors.New("stsd box too short")
+      return nil, sizeError("stsd box too short", 16, len(data))
    }
    copy(b.HeaderFields[:], data[8:16])
 
-   payload := data[16:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
-      switch string(header.Type[:]) {
-      case "encv", "enca":
-         enc, err := DecodeEncBox(content)
+   err = d.boxes(data[16:b.Header.end(data)], 16, func(header *BoxHeader, content []byte) error {
+      switch boxType := string(header.Type[:]); {
+      case boxType == "encv", boxType == "enca":
+         enc, err := d.enc(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.EncChildren = append(b.EncChildren, enc)
+         b.layout = append(b.layout, "enc")
+      case isVisualEntry(header.Type), isAudioEntry(header.Type):
+         entry, err := d.sampleEntry(content)
+         if err != nil {
+            return err
+         }
+         b.Entries = append(b.Entries, entry)
+         b.layout = append(b.layout, "entry")
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         b.layout = append(b.layout, "")
+         return keepChild("stsd", content, &b.Custom, &b.RawChildren)
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
@@ -255,17 +366,87 @@ func DecodeStsdBox(data []byte) (*StsdBox, error) {
 func (b *StsdBox) Encode() []byte {
    buffer := make([]byte, 16)
    copy(buffer[8:16], b.HeaderFields[:])
-   for _, child := range b.EncChildren {
-      buffer = append(buffer, child.Encode()...)
-   }
-   for _, child := range b.RawChildren {
-      buffer = append(buffer, child...)
+   for _, entry := range b.children() {
+      buffer = append(buffer, entry.encode()...)
    }
    b.Header.Size = uint32(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// stsdEntry is an entry of an stsd, with one of its fields set.
+type stsdEntry struct {
+   enc   *EncBox
+   entry *SampleEntryBox
+   other []byte // kept in Custom or RawChildren, encoded
+}
+
+func (e stsdEntry) encode() []byte {
+   switch {
+   case e.enc != nil:
+      return e.enc.Encode()
+   case e.entry != nil:
+      return e.entry.Encode()
+   }
+   return e.other
+}
+
+// children returns the entries of b in the order they are encoded: those
+// decoded in the order read, then any added since to EncChildren, Entries,
+// Custom and RawChildren.
+func (b *StsdBox) children() []stsdEntry {
+   var entries []stsdEntry
+   encs, plain := b.EncChildren, b.Entries
+   others := otherChildren(b.Custom, b.RawChildren)
+   for _, kind := range b.layout {
+      switch {
+      case kind == "enc" && len(encs) > 0:
+         entries = append(entries, stsdEntry{enc: encs[0]})
+         encs = encs[1:]
+      case kind == "entry" && len(plain) > 0:
+         entries = append(entries, stsdEntry{entry: plain[0]})
+         plain = plain[1:]
+      case kind == "" && len(others) > 0:
+         entries = append(entries, stsdEntry{other: others[0]})
+         others = others[1:]
+      }
+   }
+   for _, enc := range encs {
+      entries = append(entries, stsdEntry{enc: enc})
+   }
+   for _, entry := range plain {
+      entries = append(entries, stsdEntry{entry: entry})
+   }
+   for _, other := range others {
+      entries = append(entries, stsdEntry{other: other})
+   }
+   return entries
+}
+
+// add appends entry to b, after the entries it has.
+func (b *StsdBox) add(entry stsdEntry) {
+   entries := b.children()
+   b.layout = make([]string, 0, len(entries)+1)
+   for _, child := range append(entries, entry) {
+      switch {
+      case child.enc != nil:
+         b.layout = append(b.layout, "enc")
+      case child.entry != nil:
+         b.layout = append(b.layout, "entry")
+      default:
+         b.layout = append(b.layout, "")
+      }
+   }
+   switch {
+   case entry.enc != nil:
+      b.EncChildren = append(b.EncChildren, entry.enc)
+   case entry.entry != nil:
+      b.Entries = append(b.Entries, entry.entry)
+   default:
+      b.RawChildren = append(b.RawChildren, entry.other)
+   }
+}
+
 func (b *StsdBox) RemoveSinf() error {
    for _, child := range b.EncChildren {
       if child.Sinf == nil {
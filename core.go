@@ -1,10 +1,7 @@
 // core.go
 package sofia
 
-import (
-   "encoding/binary"
-   "errors"
-)
+import "encoding/binary"
 
 func FindMoov(boxes []Box) (*MoovBox, bool) {
    for _, box := range boxes {
@@ -17,76 +14,129 @@ func FindMoov(boxes []Box) (*MoovBox, bool) {
 
 // --- Box ---
 type Box struct {
-   Moov *MoovBox
-   Moof *MoofBox
-   Mdat *MdatBox
-   Sidx *SidxBox
-   Pssh *PsshBox
-   Raw  []byte
+   Moov   *MoovBox
+   Moof   *MoofBox
+   Mdat   *MdatBox
+   Sidx   *SidxBox
+   Pssh   *PsshBox
+   Custom *CustomBox
+   Raw    []byte
 }
 
 func DecodeBoxes(data []byte) ([]Box, error) {
-   var boxes []Box
-   offset := 0
-   for offset < len(data) {
-      header, err := DecodeBoxHeader(data[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(data) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(data) {
-         return nil, errors.New("invalid child box size")
-      }
+   var d decoder
+   return d.decodeBoxes(data)
+}
+
+// DecodeBoxesLenient decodes data like DecodeBoxes, but recovers from
+// malformed boxes instead of failing: boxes that cannot be decoded are
+// skipped, boxes that run past the end of their parent or of data are cut
+// short, and every problem is returned as a warning. A trailing mdat that
+// was cut short keeps the part of its payload that is present.
+func DecodeBoxesLenient(data []byte) ([]Box, []error) {
+   d := decoder{lenient: true}
+   boxes, err := d.decodeBoxes(data)
+   if err != nil {
+      d.warn(err)
+   }
+   return boxes, d.warnings
+}
 
-      boxData := data[offset : offset+boxSize]
+func (d *decoder) decodeBoxes(data []byte) ([]Box, error) {
+   var boxes []Box
+   err := d.boxes(data, 0, func(header *BoxHeader, boxData []byte) error {
       var currentBox Box
       switch string(header.Type[:]) {
       case "moov":
-         moov, err := DecodeMoovBox(boxData)
+         moov, err := d.moov(boxData)
          if err != nil {
-            return nil, err
+            return err
          }
          currentBox.Moov = moov
       case "moof":
-         moof, err := DecodeMoofBox(boxData)
+         moof, err := d.moof(boxData)
          if err != nil {
-            return nil, err
+            return err
          }
          currentBox.Moof = moof
       case "mdat":
          mdat, err := DecodeMdatBox(boxData)
          if err != nil {
-            return nil, err
+            return err
          }
          currentBox.Mdat = mdat
       case "sidx":
          sidx, err := DecodeSidxBox(boxData)
          if err != nil {
-            return nil, err
+            return err
          }
          currentBox.Sidx = sidx
       case "pssh":
          pssh, err := DecodePsshBox(boxData)
          if err != nil {
-            return nil, err
+            return err
          }
          currentBox.Pssh = pssh
       default:
-         currentBox.Raw = boxData
+         custom, err := decodeCustomBox("", boxData)
+         if err != nil {
+            return err
+         }
+         if custom != nil {
+            currentBox.Custom = custom
+         } else {
+            currentBox.Raw = boxData
+         }
       }
       boxes = append(boxes, currentBox)
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return boxes, nil
 }
 
+// size returns the number of bytes the box occupies in its input, rest
+// being the bytes from the start of the box to the end of the input, which
+// is where a box with a size of 0 ends.
+func (b *Box) size(rest int64) int64 {
+   var header *BoxHeader
+   switch {
+   case b.Moov != nil:
+      header = b.Moov.Header
+   case b.Moof != nil:
+      header = b.Moof.Header
+   case b.Mdat != nil:
+      if b.Mdat.Header.Size == 1 { // largesize
+         return 16 + int64(len(b.Mdat.Payload))
+      }
+      header = b.Mdat.Header
+   case b.Sidx != nil:
+      header = b.Sidx.Header
+   case b.Pssh != nil:
+      header = b.Pssh.Header
+   case b.Custom != nil:
+      header = b.Custom.Header
+   default:
+      return int64(len(b.Raw))
+   }
+   if header.Size == 0 {
+      return rest
+   }
+   return int64(header.Size)
+}
+
 func (b *Box) Encode() []byte {
    switch {
    case b.Moov != nil:
       return b.Moov.Encode()
+   case b.Sidx != nil:
+      return b.Sidx.Encode()
+   case b.Pssh != nil:
+      return b.Pssh.Encode()
+   case b.Custom != nil:
+      return b.Custom.Encode()
    default:
       return b.Raw
    }
@@ -100,7 +150,7 @@ type BoxHeader struct {
 
 func DecodeBoxHeader(data []byte) (*BoxHeader, error) {
    if len(data) < 8 {
-      return nil, errors.New("not enough data for box header")
+      return nil, sizeError("not enough data for box header", 8, len(data))
    }
    h := &BoxHeader{}
    p := parser{data: data}
@@ -109,6 +159,16 @@ func DecodeBoxHeader(data []byte) (*BoxHeader, error) {
    return h, nil
 }
 
+// end returns the end of the box within data. This is the end of data if
+// the box extends to the end of the file, has a largesize or has been cut
+// short.
+func (h *BoxHeader) end(data []byte) int {
+   if h.Size <= 1 || int(h.Size) > len(data) {
+      return len(data)
+   }
+   return int(h.Size)
+}
+
 func (h *BoxHeader) Put(buffer []byte) {
    w := writer{buf: buffer}
    w.PutUint32(h.Size)
@@ -128,7 +188,14 @@ func DecodeMdatBox(data []byte) (*MdatBox, error) {
    if err != nil {
       return nil, err
    }
-   b.Payload = data[8:b.Header.Size]
+   start := 8
+   if b.Header.Size == 1 { // largesize
+      start = 16
+   }
+   if len(data) < start {
+      return nil, sizeError("mdat box too short", start, len(data))
+   }
+   b.Payload = data[start:b.Header.end(data)]
    return b, nil
 }
 
@@ -152,7 +219,7 @@ func DecodeSidxBox(data []byte) (*SidxBox, error) {
    }
 
    if len(data) < 20 { // 8 byte header + 12 bytes of fields before version check
-      return nil, errors.New("sidx box too short")
+      return nil, sizeError("sidx box too short", 20, len(data))
    }
 
    p := parser{data: data, offset: 8}
@@ -164,26 +231,32 @@ func DecodeSidxBox(data []byte) (*SidxBox, error) {
 
    if b.Version == 0 {
       if len(data) < p.offset+8 {
-         return nil, errors.New("sidx v0 box too short")
+         return nil, sizeError("sidx v0 box too short", p.offset+8, len(data))
       }
       b.EarliestPresentationTime = uint64(p.Uint32())
       b.FirstOffset = uint64(p.Uint32())
    } else {
       if len(data) < p.offset+16 {
-         return nil, errors.New("sidx v1 box too short")
+         return nil, sizeError("sidx v1 box too short", p.offset+16, len(data))
       }
       b.EarliestPresentationTime = p.Uint64()
       b.FirstOffset = p.Uint64()
    }
 
    if len(data) < p.offset+4 {
-      return nil, errors.New("sidx box too short for reference_count")
+      return nil, sizeError(
+         "sidx box too short for reference_count",
+         p.offset+4, len(data),
+      )
    }
    _ = p.Uint16() // reserved
    referenceCount := p.Uint16()
 
-   if len(data)-p.offset < int(referenceCount)*12 {
-      return nil, errors.New("sidx box too short for declared references")
+   if len(data) < p.offset+int(referenceCount)*12 {
+      return nil, sizeError(
+         "sidx box too short for declared references",
+         p.offset+int(referenceCount)*12, len(data),
+      )
    }
 
    b.References = make([]SidxReference, referenceCount)
@@ -202,6 +275,43 @@ func DecodeSidxBox(data []byte) (*SidxBox, error) {
    return b, nil
 }
 
+func (b *SidxBox) Encode() []byte {
+   size := 32 + 12*len(b.References)
+   if b.Version == 1 {
+      size += 8
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.PutUint32(b.ReferenceID)
+   w.PutUint32(b.Timescale)
+   if b.Version == 1 {
+      w.PutUint64(b.EarliestPresentationTime)
+      w.PutUint64(b.FirstOffset)
+   } else {
+      w.PutUint32(uint32(b.EarliestPresentationTime))
+      w.PutUint32(uint32(b.FirstOffset))
+   }
+   w.offset += 2 // reserved
+   w.PutUint16(uint16(len(b.References)))
+   for _, ref := range b.References {
+      val1 := ref.ReferencedSize & 0x7FFFFFFF
+      if ref.ReferenceType {
+         val1 |= 1 << 31
+      }
+      w.PutUint32(val1)
+      w.PutUint32(ref.SubsegmentDuration)
+      val2 := uint32(ref.SAPType&0x07)<<28 | ref.SAPDeltaTime&0x0FFFFFFF
+      if ref.StartsWithSAP {
+         val2 |= 1 << 31
+      }
+      w.PutUint32(val2)
+   }
+   b.Header.Size = uint32(size)
+   b.Header.Put(buffer)
+   return buffer
+}
+
 func FindSidx(boxes []Box) (*SidxBox, bool) {
    for _, box := range boxes {
       if box.Sidx != nil {
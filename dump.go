@@ -0,0 +1,419 @@
+// dump.go
+package sofia
+
+import (
+   "encoding/binary"
+   "encoding/hex"
+   "encoding/json"
+   "fmt"
+   "io"
+   "slices"
+   "strings"
+)
+
+// DumpNode describes one box of a dump tree. Offset is the absolute byte
+// offset of the box within the data handed to Dump, and Size is the number
+// of bytes the box occupies.
+type DumpNode struct {
+   Offset   int64          `json:"offset"`
+   Size     int64          `json:"size"`
+   Type     string         `json:"type"`
+   Fields   map[string]any `json:"fields,omitempty"`
+   Children []*DumpNode    `json:"children,omitempty"`
+}
+
+// Dump decodes data as DecodeBoxesLenient does and returns every box in
+// file order, described by the fields of the value decoded from it. Boxes
+// that fail to decode are kept with an "Error" field and boxes that were cut
+// short with a "Warning" field, so a dump can be taken of a stream that does
+// not parse.
+func Dump(data []byte) []*DumpNode {
+   root := &DumpNode{}
+   d := decoder{lenient: true, dump: root}
+   boxes, _ := d.decodeBoxes(data)
+   values := dumpValues{}
+   for _, box := range boxes {
+      switch {
+      case box.Moov != nil:
+         values.add("moov", box.Moov)
+      case box.Moof != nil:
+         values.add("moof", box.Moof)
+      case box.Mdat != nil:
+         values.add("mdat", box.Mdat)
+      case box.Sidx != nil:
+         values.add("sidx", box.Sidx)
+      case box.Pssh != nil:
+         values.add("pssh", box.Pssh)
+      case box.Custom != nil:
+         values.custom([]*CustomBox{box.Custom})
+      }
+   }
+   root.describe(values, data)
+   return root.Children
+}
+
+// WriteDump writes nodes as an indented text tree, one box per line.
+func WriteDump(w io.Writer, nodes []*DumpNode) error {
+   return writeDump(w, nodes, 0)
+}
+
+// WriteDumpJSON writes nodes as indented JSON.
+func WriteDumpJSON(w io.Writer, nodes []*DumpNode) error {
+   data, err := json.MarshalIndent(nodes, "", "  ")
+   if err != nil {
+      return err
+   }
+   data = append(data, '\n')
+   _, err = w.Write(data)
+   return err
+}
+
+func writeDump(w io.Writer, nodes []*DumpNode, depth int) error {
+   for _, node := range nodes {
+      var line strings.Builder
+      line.WriteString(strings.Repeat("  ", depth))
+      fmt.Fprintf(&line, "%s offset=%d size=%d", node.Type, node.Offset, node.Size)
+      keys := make([]string, 0, len(node.Fields))
+      for key := range node.Fields {
+         keys = append(keys, key)
+      }
+      slices.Sort(keys)
+      for _, key := range keys {
+         fmt.Fprintf(&line, " %s=%v", key, node.Fields[key])
+      }
+      line.WriteByte('\n')
+      if _, err := io.WriteString(w, line.String()); err != nil {
+         return err
+      }
+      if err := writeDump(w, node.Children, depth+1); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+// dumpValues holds the values decoded from the children of a box, by box
+// type and in the order read.
+type dumpValues map[string][]any
+
+func (v dumpValues) add(boxType string, value any) {
+   v[boxType] = append(v[boxType], value)
+}
+
+func (v dumpValues) custom(boxes []*CustomBox) {
+   for _, box := range boxes {
+      v.add(string(box.Header.Type[:]), box)
+   }
+}
+
+// plainContainers are the boxes that only hold other boxes, but that
+// DecodeBoxes keeps as raw bytes.
+var plainContainers = []string{"dinf", "mvex", "mfra", "udta"}
+
+// describe matches the children of n to the values decoded from them, in
+// order within each box type, and sets their fields. A child that failed to
+// decode has no value, and a plain container kept as raw bytes is walked
+// for its children.
+func (n *DumpNode) describe(values dumpValues, data []byte) {
+   for _, child := range n.Children {
+      if _, failed := child.Fields["Error"]; failed {
+         continue
+      }
+      if queue := values[child.Type]; len(queue) > 0 {
+         values[child.Type] = queue[1:]
+         child.describe(child.fields(queue[0]), data)
+      } else if slices.Contains(plainContainers, child.Type) {
+         d := decoder{
+            path: []string{child.Type}, offset: child.Offset, lenient: true,
+            dump: child,
+         }
+         box := data[child.Offset : child.Offset+child.Size]
+         d.boxes(box[8:], 8, func(*BoxHeader, []byte) error {
+            return nil
+         })
+         child.describe(nil, data)
+      }
+   }
+}
+
+func (n *DumpNode) set(key string, value any) {
+   if n == nil {
+      return
+   }
+   if n.Fields == nil {
+      n.Fields = map[string]any{}
+   }
+   n.Fields[key] = value
+}
+
+// fields sets the fields of n from value, the box decoded from it, and
+// returns the values decoded from its children.
+func (n *DumpNode) fields(value any) dumpValues {
+   values := dumpValues{}
+   switch b := value.(type) {
+   case *MoovBox:
+      values.add("mvhd", b.Mvhd)
+      for _, trak := range b.Trak {
+         values.add("trak", trak)
+      }
+      for _, pssh := range b.Pssh {
+         values.add("pssh", pssh)
+      }
+      values.custom(b.Custom)
+   case *TrakBox:
+      values.add("tkhd", b.Tkhd)
+      values.add("edts", b.Edts)
+      values.add("mdia", b.Mdia)
+      values.custom(b.Custom)
+   case *EdtsBox:
+      values.add("elst", b.Elst)
+      values.custom(b.Custom)
+   case *MdiaBox:
+      values.add("mdhd", b.Mdhd)
+      values.add("elng", b.Elng)
+      values.add("hdlr", b.Hdlr)
+      values.add("minf", b.Minf)
+      values.custom(b.Custom)
+   case *MinfBox:
+      values.add("stbl", b.Stbl)
+      values.custom(b.Custom)
+   case *StblBox:
+      values.add("stsd", b.Stsd)
+      values.custom(b.Custom)
+   case *StsdBox:
+      n.set("EntryCount", binary.BigEndian.Uint32(b.HeaderFields[4:]))
+      for _, enc := range b.EncChildren {
+         values.add(string(enc.Header.Type[:]), enc)
+      }
+      for _, entry := range b.Entries {
+         values.add(string(entry.Header.Type[:]), entry)
+      }
+      values.custom(b.Custom)
+   case *EncBox:
+      n.sampleEntry(&b.SampleEntry, values)
+      values.add("sinf", b.Sinf)
+      values.custom(b.Custom)
+   case *SampleEntryBox:
+      n.sampleEntry(&b.SampleEntry, values)
+      values.custom(b.Custom)
+   case *SinfBox:
+      values.add("frma", b.Frma)
+      values.add("schm", b.Schm)
+      values.add("schi", b.Schi)
+      values.custom(b.Custom)
+   case *SchiBox:
+      values.add("tenc", b.Tenc)
+      values.custom(b.Custom)
+   case *MoofBox:
+      values.add("traf", b.Traf)
+      for _, pssh := range b.Pssh {
+         values.add("pssh", pssh)
+      }
+      values.custom(b.Custom)
+   case *TrafBox:
+      values.add("tfhd", b.Tfhd)
+      values.add("tfdt", b.Tfdt)
+      for _, trun := range b.Trun {
+         values.add("trun", trun)
+      }
+      values.add("senc", b.Senc)
+      values.add("tenc", b.Tenc)
+      values.custom(b.Custom)
+   case *AvcCBox:
+      n.set("Profile", b.Profile)
+      n.set("Level", b.Level)
+      n.set("LengthSize", b.LengthSize)
+      n.set("SPSCount", len(b.SPS))
+      n.set("PPSCount", len(b.PPS))
+   case *HvcCBox:
+      n.set("GeneralProfileIDC", b.GeneralProfileIDC)
+      n.set("GeneralTierFlag", b.GeneralTierFlag)
+      n.set("GeneralLevelIDC", b.GeneralLevelIDC)
+      n.set("LengthSize", b.LengthSize)
+   case *Av1CBox:
+      n.set("SeqProfile", b.SeqProfile)
+      n.set("SeqLevelIdx0", b.SeqLevelIdx0)
+      n.set("SeqTier0", b.SeqTier0)
+      n.set("BitDepth", b.BitDepth())
+   case *VpcCBox:
+      n.set("Profile", b.Profile)
+      n.set("Level", b.Level)
+      n.set("BitDepth", b.BitDepth)
+   case *DoviBox:
+      n.set("Profile", b.Profile)
+      n.set("Level", b.Level)
+      n.set("BLSignalCompatibilityID", b.BLSignalCompatibilityID)
+   case *EsdsBox:
+      n.set("ObjectTypeIndication", fmt.Sprintf("%02x", b.ObjectTypeIndication))
+      if b.ObjectTypeIndication == 0x40 {
+         n.set("AudioObjectType", b.AudioObjectType())
+      }
+      n.set("AvgBitrate", b.AvgBitrate)
+   case *DOpsBox:
+      n.set("OutputChannelCount", b.OutputChannelCount)
+      n.set("PreSkip", b.PreSkip)
+      n.set("InputSampleRate", b.InputSampleRate)
+   case *Dac3Box:
+      n.set("ChannelCount", b.ChannelCount())
+      n.set("BitRateCode", b.BitRateCode)
+   case *Dec3Box:
+      n.set("DataRate", b.DataRate)
+      n.set("ChannelCount", b.ChannelCount())
+   case *DfLaBox:
+      info, err := b.StreamInfo()
+      if err != nil {
+         n.set("Error", err.Error())
+         break
+      }
+      n.set("SampleRate", info.SampleRate)
+      n.set("ChannelCount", info.ChannelCount)
+      n.set("BitsPerSample", info.BitsPerSample)
+   case *MvhdBox:
+      n.set("Version", b.Version)
+      n.set("Timescale", b.Timescale)
+      n.set("Duration", b.Duration)
+   case *TkhdBox:
+      n.set("Version", b.Version)
+      n.set("Flags", fmt.Sprintf("%06x", b.Flags[:]))
+      n.set("TrackID", b.TrackID)
+      n.set("Duration", b.Duration)
+      if b.AlternateGroup != 0 {
+         n.set("AlternateGroup", b.AlternateGroup)
+      }
+      if b.Volume != 0 {
+         n.set("Volume", fmt.Sprintf("%.2f", float64(b.Volume)/256))
+      }
+      if b.Width != 0 || b.Height != 0 {
+         n.set("Width", b.Width>>16)
+         n.set("Height", b.Height>>16)
+      }
+   case *MdhdBox:
+      n.set("Version", b.Version)
+      n.set("Timescale", b.Timescale)
+      n.set("Duration", b.Duration)
+      if code := b.LanguageCode(); code != "" {
+         n.set("Language", code)
+      }
+   case *ElngBox:
+      n.set("ExtendedLanguage", b.ExtendedLanguage)
+   case *ElstBox:
+      n.set("Version", b.Version)
+      n.set("Entries", b.Entries)
+   case *HdlrBox:
+      n.set("HandlerType", string(b.HandlerType[:]))
+      n.set("Name", b.Name)
+   case *MdatBox:
+      n.set("PayloadSize", len(b.Payload))
+   case *SidxBox:
+      n.set("Version", b.Version)
+      n.set("ReferenceID", b.ReferenceID)
+      n.set("Timescale", b.Timescale)
+      n.set("EarliestPresentationTime", b.EarliestPresentationTime)
+      n.set("FirstOffset", b.FirstOffset)
+      n.set("References", b.References)
+   case *PsshBox:
+      n.set("Version", b.Version)
+      n.set("SystemID", FormatUUID(b.SystemID))
+      if len(b.KIDs) > 0 {
+         kids := make([]string, len(b.KIDs))
+         for i, kid := range b.KIDs {
+            kids[i] = hex.EncodeToString(kid[:])
+         }
+         n.set("KIDs", kids)
+      }
+      n.set("DataSize", len(b.Data))
+   case *FrmaBox:
+      n.set("DataFormat", string(b.DataFormat[:]))
+   case *SchmBox:
+      n.set("SchemeType", string(b.SchemeType[:]))
+      n.set("SchemeVersion", fmt.Sprintf("%08x", b.SchemeVersion))
+      if b.SchemeURI != "" {
+         n.set("SchemeURI", b.SchemeURI)
+      }
+   case *TencBox:
+      n.set("Version", b.Version)
+      if b.Version == 1 {
+         n.set("DefaultCryptByteBlock", b.DefaultCryptByteBlock)
+         n.set("DefaultSkipByteBlock", b.DefaultSkipByteBlock)
+      }
+      n.set("DefaultIsProtected", b.DefaultIsProtected)
+      n.set("DefaultPerSampleIVSize", b.DefaultPerSampleIVSize)
+      n.set("DefaultKID", hex.EncodeToString(b.DefaultKID[:]))
+      if len(b.DefaultConstantIV) > 0 {
+         n.set("DefaultConstantIV", hex.EncodeToString(b.DefaultConstantIV))
+      }
+   case *TfhdBox:
+      n.set("Flags", fmt.Sprintf("%06x", b.Flags))
+      n.set("TrackID", b.TrackID)
+      if b.Flags&0x000001 != 0 {
+         n.set("BaseDataOffset", b.BaseDataOffset)
+      }
+      if b.Flags&0x000002 != 0 {
+         n.set("SampleDescriptionIndex", b.SampleDescriptionIndex)
+      }
+      if b.Flags&0x000008 != 0 {
+         n.set("DefaultSampleDuration", b.DefaultSampleDuration)
+      }
+      if b.Flags&0x000010 != 0 {
+         n.set("DefaultSampleSize", b.DefaultSampleSize)
+      }
+      if b.Flags&0x000020 != 0 {
+         n.set("DefaultSampleFlags", fmt.Sprintf("%08x", b.DefaultSampleFlags))
+      }
+   case *TfdtBox:
+      n.set("Version", b.Version)
+      n.set("BaseMediaDecodeTime", b.BaseMediaDecodeTime)
+   case *TrunBox:
+      n.set("Flags", fmt.Sprintf("%06x", b.Flags))
+      n.set("SampleCount", b.SampleCount)
+      if b.Flags&0x000001 != 0 {
+         n.set("DataOffset", b.DataOffset)
+      }
+      if b.Flags&0x000004 != 0 {
+         n.set("FirstSampleFlags", fmt.Sprintf("%08x", b.FirstSampleFlags))
+      }
+   case *SencBox:
+      n.set("Flags", fmt.Sprintf("%06x", b.Flags))
+      n.set("SampleCount", len(b.Samples))
+   case *CustomBox:
+      n.set("Value", fmt.Sprintf("%+v", b.Value))
+   }
+   return values
+}
+
+// sampleEntry sets the fields of n from the fixed fields of entry, and adds
+// its codec configuration to values.
+func (n *DumpNode) sampleEntry(entry *SampleEntry, values dumpValues) {
+   if visual := entry.Visual; visual != nil {
+      n.set("Width", visual.Width)
+      n.set("Height", visual.Height)
+      if visual.CompressorName != "" {
+         n.set("CompressorName", visual.CompressorName)
+      }
+      n.set("Depth", visual.Depth)
+   }
+   if audio := entry.Audio; audio != nil {
+      n.set("ChannelCount", audio.ChannelCount)
+      n.set("SampleSize", audio.SampleSize)
+      n.set("SampleRate", audio.Hz())
+   }
+   values.add("avcC", entry.AvcC)
+   values.add("hvcC", entry.HvcC)
+   values.add("av1C", entry.Av1C)
+   values.add("vpcC", entry.VpcC)
+   if entry.Dovi != nil {
+      values.add(string(entry.Dovi.Header.Type[:]), entry.Dovi)
+   }
+   values.add("esds", entry.Esds)
+   values.add("dOps", entry.DOps)
+   values.add("dac3", entry.Dac3)
+   values.add("dec3", entry.Dec3)
+   values.add("dfLa", entry.DfLa)
+}
+
+// FormatUUID formats a UUID, such as a system ID or KID, in the usual
+// 8-4-4-4-12 form.
+func FormatUUID(id [16]byte) string {
+   s := hex.EncodeToString(id[:])
+   return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
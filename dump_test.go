@@ -0,0 +1,53 @@
+// dump_test.go
+package sofia
+
+import (
+   "bytes"
+   "flag"
+   "os"
+   "path/filepath"
+   "testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func TestDump(t *testing.T) {
+   fragment := testFragment(1, 0, []TrunSample{
+      testSample(10, 3000, true, 0), testSample(10, 3000, false, 0),
+   })
+   tests := []struct {
+      name string
+      data []byte
+   }{
+      {"encrypted", testTrackInit("vide", testEncv(1))},
+      {"fragment", append(testInit(), fragment...)},
+      {"truncated", append(testInit(), fragment[:len(fragment)-5]...)},
+      {"corrupt", append(testInit(), containerBox(
+         "moof", containerBox("traf", containerBox("tfhd", make([]byte, 2))),
+         make([]byte, 3),
+      )...)},
+      {"remux", testRemux(t, true, func(r *Remuxer) error {
+         return r.AddSegment(fragment)
+      })},
+   }
+   for _, test := range tests {
+      var b bytes.Buffer
+      if err := WriteDump(&b, Dump(test.data)); err != nil {
+         t.Fatal(err)
+      }
+      golden := filepath.Join("testdata", test.name+".golden")
+      if *update {
+         if err := os.WriteFile(golden, b.Bytes(), 0666); err != nil {
+            t.Fatal(err)
+         }
+         continue
+      }
+      want, err := os.ReadFile(golden)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if !bytes.Equal(b.Bytes(), want) {
+         t.Errorf("%s: got\n%s\nwant\n%s", test.name, b.Bytes(), want)
+      }
+   }
+}
@@ -3,7 +3,8 @@ package sofia
 
 import (
    "crypto/cipher"
-   "errors"
+   "fmt"
+   "math"
 )
 
 // --- Logic ---
@@ -56,7 +57,7 @@ func DecodePsshBox(data []byte) (*PsshBox, error) {
    }
 
    if len(data) < 28 { // 8 byte header + 4 byte version/flags + 16 byte systemID
-      return nil, errors.New("pssh too short")
+      return nil, sizeError("pssh too short", 28, len(data))
    }
 
    p := parser{data: data, offset: 8}
@@ -67,11 +68,14 @@ func DecodePsshBox(data []byte) (*PsshBox, error) {
 
    if b.Version > 0 {
       if len(data) < p.offset+4 {
-         return nil, errors.New("pssh too short for KID count")
+         return nil, sizeError("pssh too short for KID count", p.offset+4, len(data))
       }
       kidCount := p.Uint32()
-      if len(data) < p.offset+int(kidCount*16) {
-         return nil, errors.New("pssh too short for KIDs")
+      if need := uint64(kidCount) * 16; need > uint64(len(data)-p.offset) {
+         return nil, sizeError(
+            "pssh too short for KIDs",
+            int(min(uint64(p.offset)+need, math.MaxInt32)), len(data),
+         )
       }
       b.KIDs = make([][16]byte, kidCount)
       for i := 0; i < int(kidCount); i++ {
@@ -80,16 +84,87 @@ func DecodePsshBox(data []byte) (*PsshBox, error) {
    }
 
    if len(data) < p.offset+4 {
-      return nil, errors.New("pssh too short for data size")
+      return nil, sizeError("pssh too short for data size", p.offset+4, len(data))
    }
    dataSize := p.Uint32()
-   if len(data) < p.offset+int(dataSize) {
-      return nil, errors.New("pssh size mismatch")
+   if uint64(dataSize) > uint64(len(data)-p.offset) {
+      return nil, sizeError(
+         "pssh size mismatch",
+         int(min(uint64(p.offset)+uint64(dataSize), math.MaxInt32)), len(data),
+      )
    }
    b.Data = p.Bytes(int(dataSize))
    return b, nil
 }
 
+func (b *PsshBox) Encode() []byte {
+   size := 32 + len(b.Data)
+   if b.Version > 0 {
+      size += 4 + 16*len(b.KIDs)
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+   w.PutBytes(b.SystemID[:])
+   if b.Version > 0 {
+      w.PutUint32(uint32(len(b.KIDs)))
+      for _, kid := range b.KIDs {
+         w.PutBytes(kid[:])
+      }
+   }
+   w.PutUint32(uint32(len(b.Data)))
+   w.PutBytes(b.Data)
+   if b.Header == nil {
+      b.Header = &BoxHeader{Type: [4]byte{'p', 's', 's', 'h'}}
+   }
+   b.Header.Size = uint32(size)
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// KeyIDs returns the KIDs of the box, together with those in Data for the
+// systems whose data sofia can decode, without duplicates.
+func (b *PsshBox) KeyIDs() ([][16]byte, error) {
+   var kids [][16]byte
+   add := func(kid [16]byte) {
+      for _, known := range kids {
+         if known == kid {
+            return
+         }
+      }
+      kids = append(kids, kid)
+   }
+   for _, kid := range b.KIDs {
+      add(kid)
+   }
+   switch b.SystemID {
+   case WidevineSystemID:
+      data, err := DecodeWidevinePsshData(b.Data)
+      if err != nil {
+         return nil, fmt.Errorf("decoding Widevine pssh data: %w", err)
+      }
+      for _, kid := range data.KeyIDs {
+         if len(kid) == 16 {
+            add([16]byte(kid))
+         }
+      }
+   case PlayReadySystemID:
+      object, err := DecodePlayReadyObject(b.Data)
+      if err != nil {
+         return nil, fmt.Errorf("decoding PlayReady pssh data: %w", err)
+      }
+      header, err := object.Header()
+      if err != nil {
+         return nil, fmt.Errorf("decoding PlayReady pssh data: %w", err)
+      }
+      for _, kid := range header.KIDs {
+         add(kid.KID)
+      }
+   }
+   return kids, nil
+}
+
 type SencBox struct {
    Header  *BoxHeader
    Flags   uint32
@@ -105,7 +180,7 @@ func DecodeSencBox(data []byte) (*SencBox, error) {
    }
 
    if len(data) < 16 { // 8 byte header, 4 byte flags, 4 byte sample count
-      return nil, errors.New("senc too short")
+      return nil, sizeError("senc too short", 16, len(data))
    }
 
    p := parser{data: data, offset: 8}
@@ -117,19 +192,28 @@ func DecodeSencBox(data []byte) (*SencBox, error) {
    subsamplesPresent := b.Flags&0x000002 != 0
    for i := uint32(0); i < sampleCount; i++ {
       if len(data) < p.offset+ivSize {
-         return nil, errors.New("senc truncated while reading IV")
+         return nil, sizeError(
+            "senc truncated while reading IV",
+            p.offset+ivSize, len(data),
+         )
       }
       b.Samples[i].IV = p.Bytes(ivSize)
 
       if subsamplesPresent {
          if len(data) < p.offset+2 {
-            return nil, errors.New("senc truncated while reading subsample count")
+            return nil, sizeError(
+               "senc truncated while reading subsample count",
+               p.offset+2, len(data),
+            )
          }
          subsampleCount := p.Uint16()
          b.Samples[i].Subsamples = make([]Subsample, subsampleCount)
          for j := uint16(0); j < subsampleCount; j++ {
             if len(data) < p.offset+6 {
-               return nil, errors.New("senc truncated while reading subsample")
+               return nil, sizeError(
+                  "senc truncated while reading subsample",
+                  p.offset+6, len(data),
+               )
             }
             clear := p.Uint16()
             prot := p.Uint32()
@@ -159,6 +243,8 @@ type TencBox struct {
    Header                 *BoxHeader
    Version                byte
    Flags                  uint32
+   DefaultCryptByteBlock  byte // version 1, for pattern encryption such as cbcs
+   DefaultSkipByteBlock   byte // version 1
    DefaultIsProtected     byte
    DefaultPerSampleIVSize byte
    DefaultKID             [16]byte
@@ -176,35 +262,49 @@ func DecodeTencBox(data []byte) (*TencBox, error) {
 
    p := parser{data: data, offset: 8}
    if len(data) < p.offset+4 {
-      return nil, errors.New("tenc box too short for version/flags")
+      return nil, sizeError(
+         "tenc box too short for version/flags",
+         p.offset+4, len(data),
+      )
    }
    versionAndFlags := p.Uint32()
    b.Version = byte(versionAndFlags >> 24)
    b.Flags = versionAndFlags & 0x00FFFFFF
 
-   if b.Version == 0 {
-      // Based on the error, the reserved field for this file is 2 bytes.
-      // Payload: reserved(2) + isProtected(1) + perSampleIVSize(1) + KID(16) = 20 bytes.
-      const requiredV0PayloadSize = 20
-      if len(data) < p.offset+requiredV0PayloadSize {
-         return nil, errors.New("tenc v0 box too short for required fields")
+   if b.Version <= 1 {
+      // Payload: reserved(1) + pattern(1) + isProtected(1) + perSampleIVSize(1) + KID(16) = 20 bytes.
+      const requiredPayloadSize = 20
+      if len(data) < p.offset+requiredPayloadSize {
+         return nil, sizeError(
+            "tenc box too short for required fields",
+            p.offset+requiredPayloadSize, len(data),
+         )
       }
 
-      // Correctly skip the 2 reserved bytes.
-      _ = p.Bytes(2)
-
+      p.offset++          // reserved
+      pattern := p.Byte() // reserved in version 0
+      if b.Version == 1 {
+         b.DefaultCryptByteBlock = pattern >> 4
+         b.DefaultSkipByteBlock = pattern & 0x0F
+      }
       b.DefaultIsProtected = p.Byte()
       b.DefaultPerSampleIVSize = p.Byte()
       copy(b.DefaultKID[:], p.Bytes(16))
 
       if b.DefaultIsProtected == 1 && b.DefaultPerSampleIVSize == 0 {
-         if p.offset < int(b.Header.Size) {
+         if p.offset < b.Header.end(data) {
             if len(data) < p.offset+1 {
-               return nil, errors.New("tenc box truncated before constant IV size")
+               return nil, sizeError(
+                  "tenc box truncated before constant IV size",
+                  p.offset+1, len(data),
+               )
             }
             b.DefaultConstantIVSize = p.Byte()
             if len(data) < p.offset+int(b.DefaultConstantIVSize) {
-               return nil, errors.New("tenc box truncated, not enough data for constant IV")
+               return nil, sizeError(
+                  "tenc box truncated, not enough data for constant IV",
+                  p.offset+int(b.DefaultConstantIVSize), len(data),
+               )
             }
             b.DefaultConstantIV = p.Bytes(int(b.DefaultConstantIVSize))
          }
@@ -213,3 +313,30 @@ func DecodeTencBox(data []byte) (*TencBox, error) {
    // For other versions, we do nothing and leave the fields as their zero-value.
    return b, nil
 }
+
+func (b *TencBox) Encode() []byte {
+   size := 32
+   constantIV := b.DefaultIsProtected == 1 && b.DefaultPerSampleIVSize == 0
+   if constantIV {
+      size += 1 + len(b.DefaultConstantIV)
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags)
+   w.offset++ // reserved
+   if b.Version == 1 {
+      w.PutByte(b.DefaultCryptByteBlock<<4 | b.DefaultSkipByteBlock&0x0F)
+   } else {
+      w.offset++
+   }
+   w.PutByte(b.DefaultIsProtected)
+   w.PutByte(b.DefaultPerSampleIVSize)
+   w.PutBytes(b.DefaultKID[:])
+   if constantIV {
+      w.PutByte(byte(len(b.DefaultConstantIV)))
+      w.PutBytes(b.DefaultConstantIV)
+   }
+   b.Header.Size = uint32(size)
+   b.Header.Put(buffer)
+   return buffer
+}
@@ -0,0 +1,83 @@
+// encryption_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+func TestDecodePsshBoxCounts(t *testing.T) {
+   for _, count := range []uint32{0x10000000, 0xFFFFFFFF} {
+      // version 1, a KID count, and no room for any KID
+      data := containerBox(
+         "pssh", []byte{1, 0, 0, 0}, WidevineSystemID[:],
+         binary.BigEndian.AppendUint32(nil, count),
+      )
+      if _, err := DecodePsshBox(data); err == nil {
+         t.Errorf("KID count %#x: decoded", count)
+      }
+      data = containerBox(
+         "pssh", make([]byte, 4), WidevineSystemID[:],
+         binary.BigEndian.AppendUint32(nil, count),
+      )
+      if _, err := DecodePsshBox(data); err == nil {
+         t.Errorf("data size %#x: decoded", count)
+      }
+   }
+   boxes, warnings := DecodeBoxesLenient(containerBox(
+      "pssh", []byte{1, 0, 0, 0}, WidevineSystemID[:], []byte{0x10, 0, 0, 0},
+   ))
+   if len(boxes) != 0 || len(warnings) != 1 {
+      t.Errorf("lenient: got %d boxes, %d warnings", len(boxes), len(warnings))
+   }
+}
+
+func FuzzDecodePsshBox(f *testing.F) {
+   pssh := PsshBox{
+      Header: &BoxHeader{Type: [4]byte{'p', 's', 's', 'h'}}, Version: 1,
+      SystemID: WidevineSystemID, KIDs: [][16]byte{{1}}, Data: []byte{2, 3},
+   }
+   f.Add(pssh.Encode())
+   f.Fuzz(func(t *testing.T, data []byte) {
+      box, err := DecodePsshBox(data)
+      if err != nil {
+         return
+      }
+      if len(box.KIDs) > len(data)/16 || len(box.Data) > len(data) {
+         t.Fatalf("decoded %d KIDs and %d bytes of data from %d bytes", len(box.KIDs), len(box.Data), len(data))
+      }
+      // the size is written afresh
+      if encoded := box.Encode(); !bytes.Equal(encoded[4:], data[4:len(encoded)]) {
+         t.Fatalf("got %x, want %x", encoded, data)
+      }
+   })
+}
+
+func TestPsshBoxEncode(t *testing.T) {
+   // a box built in code has no header yet
+   pssh := &PsshBox{
+      Version:  1,
+      SystemID: WidevineSystemID,
+      KIDs:     [][16]byte{{1, 2, 3}},
+      Data:     []byte{4, 5},
+   }
+   data := pssh.Encode()
+   if string(data[4:8]) != "pssh" || binary.BigEndian.Uint32(data) != uint32(len(data)) {
+      t.Fatalf("got header %x", data[:8])
+   }
+   boxes, err := DecodeBoxes(append(data, containerBox("free")...))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if boxes[0].Pssh == nil {
+      t.Fatal("decoded no pssh")
+   }
+   var encoded []byte
+   for _, box := range boxes {
+      encoded = append(encoded, box.Encode()...)
+   }
+   if want := append(data, containerBox("free")...); !bytes.Equal(encoded, want) {
+      t.Errorf("got %x\nwant %x", encoded, want)
+   }
+}
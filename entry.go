@@ -0,0 +1,497 @@
+// entry.go
+package sofia
+
+import (
+   "bytes"
+   "errors"
+   "fmt"
+)
+
+// --- VISUAL SAMPLE ENTRY ---
+// VisualSampleEntry holds the fixed fields at the start of a video sample
+// entry such as avc1 or encv.
+type VisualSampleEntry struct {
+   DataReferenceIndex uint16
+   Width              uint16
+   Height             uint16
+   HorizResolution    uint32 // 16.16 fixed point, usually 72 dpi
+   VertResolution     uint32
+   FrameCount         uint16
+   CompressorName     string
+   Depth              uint16
+}
+
+const visualSampleEntrySize = 78
+
+func DecodeVisualSampleEntry(data []byte) (*VisualSampleEntry, error) {
+   if len(data) < visualSampleEntrySize {
+      return nil, sizeError(
+         "visual sample entry too short", visualSampleEntrySize, len(data),
+      )
+   }
+   e := &VisualSampleEntry{}
+   p := parser{data: data, offset: 6}
+   e.DataReferenceIndex = p.Uint16()
+   p.offset += 16 // pre_defined and reserved
+   e.Width = p.Uint16()
+   e.Height = p.Uint16()
+   e.HorizResolution = p.Uint32()
+   e.VertResolution = p.Uint32()
+   p.offset += 4 // reserved
+   e.FrameCount = p.Uint16()
+   name := p.Bytes(32)
+   nameSize := min(int(name[0]), 31)
+   e.CompressorName = string(name[1 : 1+nameSize])
+   e.Depth = p.Uint16()
+   return e, nil
+}
+
+func (e *VisualSampleEntry) Encode() []byte {
+   buffer := make([]byte, visualSampleEntrySize)
+   w := writer{buf: buffer, offset: 6}
+   w.PutUint16(e.DataReferenceIndex)
+   w.offset += 16
+   w.PutUint16(e.Width)
+   w.PutUint16(e.Height)
+   w.PutUint32(e.HorizResolution)
+   w.PutUint32(e.VertResolution)
+   w.offset += 4
+   w.PutUint16(e.FrameCount)
+   name := e.CompressorName
+   if len(name) > 31 {
+      name = name[:31]
+   }
+   w.PutByte(byte(len(name)))
+   copy(buffer[w.offset:], name)
+   w.offset += 31
+   w.PutUint16(e.Depth)
+   w.PutUint16(0xFFFF) // pre_defined
+   return buffer
+}
+
+// --- AUDIO SAMPLE ENTRY ---
+// AudioSampleEntry holds the fixed fields at the start of an audio sample
+// entry such as mp4a or enca.
+type AudioSampleEntry struct {
+   DataReferenceIndex uint16
+   ChannelCount       uint16
+   SampleSize         uint16
+   SampleRate         uint32 // 16.16 fixed point
+}
+
+const audioSampleEntrySize = 28
+
+func DecodeAudioSampleEntry(data []byte) (*AudioSampleEntry, error) {
+   if len(data) < audioSampleEntrySize {
+      return nil, sizeError(
+         "audio sample entry too short", audioSampleEntrySize, len(data),
+      )
+   }
+   e := &AudioSampleEntry{}
+   p := parser{data: data, offset: 6}
+   e.DataReferenceIndex = p.Uint16()
+   p.offset += 8 // reserved
+   e.ChannelCount = p.Uint16()
+   e.SampleSize = p.Uint16()
+   p.offset += 4 // pre_defined and reserved
+   e.SampleRate = p.Uint32()
+   return e, nil
+}
+
+func (e *AudioSampleEntry) Encode() []byte {
+   buffer := make([]byte, audioSampleEntrySize)
+   w := writer{buf: buffer, offset: 6}
+   w.PutUint16(e.DataReferenceIndex)
+   w.offset += 8
+   w.PutUint16(e.ChannelCount)
+   w.PutUint16(e.SampleSize)
+   w.offset += 4
+   w.PutUint32(e.SampleRate)
+   return buffer
+}
+
+// Hz returns the integer part of SampleRate.
+func (e *AudioSampleEntry) Hz() uint32 {
+   return e.SampleRate >> 16
+}
+
+// --- SAMPLE ENTRY ---
+// SampleEntry holds what clear and encrypted sample entries have in common:
+// the fixed fields, and the codec configuration box, if sofia models it.
+// A decoded entry keeps the bytes it was read from, and writes them back
+// unless its fields were changed, as well as the order of its children.
+type SampleEntry struct {
+   Visual  *VisualSampleEntry
+   Audio   *AudioSampleEntry
+   AvcC    *AvcCBox
+   HvcC    *HvcCBox
+   Av1C    *Av1CBox
+   VpcC    *VpcCBox
+   Dovi    *DoviBox
+   Esds    *EsdsBox
+   DOps    *DOpsBox
+   Dac3    *Dac3Box
+   Dec3    *Dec3Box
+   DfLa    *DfLaBox
+   fields  keptBytes
+   configs map[string]keptBytes
+   // the types of the children in the order decoded, with "" for a child
+   // kept in Custom or RawChildren
+   layout []string
+}
+
+// keptBytes is a part of a box as read, and as it encoded when it was
+// decoded.
+type keptBytes struct {
+   raw     []byte
+   encoded []byte
+}
+
+// or returns the bytes as read if the part is unchanged, that is if fresh,
+// its encoding now, equals its encoding when decoded, and fresh otherwise.
+func (k keptBytes) or(fresh []byte) []byte {
+   if k.raw != nil && bytes.Equal(fresh, k.encoded) {
+      return k.raw
+   }
+   return fresh
+}
+
+// configTypes are the codec configuration boxes, in the order they are
+// encoded when added to an entry.
+var configTypes = []string{
+   "avcC", "hvcC", "av1C", "vpcC", "dvcC", "dvvC", "dvwC", "esds", "dOps",
+   "dac3", "dec3", "dfLa",
+}
+
+// visualEntryTypes and audioEntryTypes are the clear sample entries that
+// StsdBox decodes.
+var (
+   visualEntryTypes = []string{
+      "avc1", "avc3", "hvc1", "hev1", "dvh1", "dvhe", "av01", "vp08", "vp09",
+      "mp4v",
+   }
+   audioEntryTypes = []string{"mp4a", "ac-3", "ec-3", "ac-4", "Opus", "fLaC"}
+)
+
+func isVisualEntry(boxType [4]byte) bool {
+   for _, entryType := range visualEntryTypes {
+      if string(boxType[:]) == entryType {
+         return true
+      }
+   }
+   return false
+}
+
+func isAudioEntry(boxType [4]byte) bool {
+   for _, entryType := range audioEntryTypes {
+      if string(boxType[:]) == entryType {
+         return true
+      }
+   }
+   return false
+}
+
+// decodeFields decodes the fixed fields, which are visual or audio
+// according to entrySize.
+func (e *SampleEntry) decodeFields(data []byte, entrySize int) error {
+   var err error
+   if entrySize == visualSampleEntrySize {
+      e.Visual, err = DecodeVisualSampleEntry(data)
+   } else {
+      e.Audio, err = DecodeAudioSampleEntry(data)
+   }
+   if err != nil {
+      return err
+   }
+   e.fields = keptBytes{data[:entrySize], e.encodeFields()}
+   return nil
+}
+
+func (e *SampleEntry) encodeFields() []byte {
+   if e.Visual != nil {
+      return e.fields.or(e.Visual.Encode())
+   }
+   return e.fields.or(e.Audio.Encode())
+}
+
+// decodeConfig decodes content if it is a codec configuration box,
+// reporting whether it was one.
+func (e *SampleEntry) decodeConfig(header *BoxHeader, content []byte) (bool, error) {
+   name := string(header.Type[:])
+   var err error
+   switch name {
+   case "avcC":
+      e.AvcC, err = DecodeAvcCBox(content)
+   case "hvcC":
+      e.HvcC, err = DecodeHvcCBox(content)
+   case "av1C":
+      e.Av1C, err = DecodeAv1CBox(content)
+   case "vpcC":
+      e.VpcC, err = DecodeVpcCBox(content)
+   case "dvcC", "dvvC", "dvwC":
+      e.Dovi, err = DecodeDoviBox(content)
+   case "esds":
+      e.Esds, err = DecodeEsdsBox(content)
+   case "dOps":
+      e.DOps, err = DecodeDOpsBox(content)
+   case "dac3":
+      e.Dac3, err = DecodeDac3Box(content)
+   case "dec3":
+      e.Dec3, err = DecodeDec3Box(content)
+   case "dfLa":
+      e.DfLa, err = DecodeDfLaBox(content)
+   default:
+      return false, nil
+   }
+   if err != nil {
+      return true, err
+   }
+   if e.configs == nil {
+      e.configs = map[string]keptBytes{}
+   }
+   e.configs[name] = keptBytes{content, e.encodeConfig(name)}
+   e.layout = append(e.layout, name)
+   return true, nil
+}
+
+// encodeConfig returns the configuration box of type name, or nil if the
+// entry has none.
+func (e *SampleEntry) encodeConfig(name string) []byte {
+   var fresh []byte
+   switch {
+   case name == "avcC" && e.AvcC != nil:
+      fresh = e.AvcC.Encode()
+   case name == "hvcC" && e.HvcC != nil:
+      fresh = e.HvcC.Encode()
+   case name == "av1C" && e.Av1C != nil:
+      fresh = e.Av1C.Encode()
+   case name == "vpcC" && e.VpcC != nil:
+      fresh = e.VpcC.Encode()
+   case e.Dovi != nil && name == string(e.Dovi.Header.Type[:]):
+      fresh = e.Dovi.Encode()
+   case name == "esds" && e.Esds != nil:
+      fresh = e.Esds.Encode()
+   case name == "dOps" && e.DOps != nil:
+      fresh = e.DOps.Encode()
+   case name == "dac3" && e.Dac3 != nil:
+      fresh = e.Dac3.Encode()
+   case name == "dec3" && e.Dec3 != nil:
+      fresh = e.Dec3.Encode()
+   case name == "dfLa" && e.DfLa != nil:
+      fresh = e.DfLa.Encode()
+   default:
+      return nil
+   }
+   return e.configs[name].or(fresh)
+}
+
+// encodeChildren appends the child boxes in the order they were decoded,
+// then any added since: codec configuration, custom, raw and sinf.
+func (e *SampleEntry) encodeChildren(
+   buffer []byte, custom []*CustomBox, raw [][]byte, sinf *SinfBox,
+) []byte {
+   others := otherChildren(custom, raw)
+   written := map[string]bool{}
+   for _, name := range e.layout {
+      switch {
+      case name == "sinf":
+         if sinf != nil {
+            buffer = append(buffer, sinf.Encode()...)
+         }
+      case name != "":
+         buffer = append(buffer, e.encodeConfig(name)...)
+      case len(others) > 0:
+         buffer = append(buffer, others[0]...)
+         others = others[1:]
+      }
+      written[name] = true
+   }
+   for _, name := range configTypes {
+      if !written[name] {
+         buffer = append(buffer, e.encodeConfig(name)...)
+      }
+   }
+   for _, child := range others {
+      buffer = append(buffer, child...)
+   }
+   if sinf != nil && !written["sinf"] {
+      buffer = append(buffer, sinf.Encode()...)
+   }
+   return buffer
+}
+
+// --- SAMPLE ENTRY BOX ---
+// SampleEntryBox is a clear sample entry such as avc1 or mp4a.
+type SampleEntryBox struct {
+   Header *BoxHeader
+   SampleEntry
+   Custom      []*CustomBox
+   RawChildren [][]byte
+}
+
+func DecodeSampleEntryBox(data []byte) (*SampleEntryBox, error) {
+   var d decoder
+   return d.sampleEntry(data)
+}
+
+func (d *decoder) sampleEntry(data []byte) (*SampleEntryBox, error) {
+   b := &SampleEntryBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+
+   var entrySize int
+   switch {
+   case isVisualEntry(b.Header.Type):
+      entrySize = visualSampleEntrySize
+   case isAudioEntry(b.Header.Type):
+      entrySize = audioSampleEntrySize
+   default:
+      return nil, fmt.Errorf("unknown sample entry type %q", b.Header.Type[:])
+   }
+   end := b.Header.end(data)
+   if end < 8+entrySize {
+      return nil, sizeError("sample entry too short", 8+entrySize, end)
+   }
+   err = b.decodeFields(data[8:], entrySize)
+   if err != nil {
+      return nil, err
+   }
+
+   childOffset := 8 + entrySize
+   err = d.boxes(data[childOffset:end], childOffset, func(header *BoxHeader, content []byte) error {
+      ok, err := b.decodeConfig(header, content)
+      if ok || err != nil {
+         return err
+      }
+      b.layout = append(b.layout, "")
+      return keepChild(string(b.Header.Type[:]), content, &b.Custom, &b.RawChildren)
+   })
+   if err != nil {
+      return nil, err
+   }
+   return b, nil
+}
+
+func (b *SampleEntryBox) Encode() []byte {
+   buffer := make([]byte, 8)
+   buffer = append(buffer, b.encodeFields()...)
+   buffer = b.encodeChildren(buffer, b.Custom, b.RawChildren, nil)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// Codec returns the RFC 6381 codecs parameter, such as "avc1.64001f".
+func (b *SampleEntryBox) Codec() (string, error) {
+   return b.codec(b.Header.Type)
+}
+
+// Codec returns the RFC 6381 codecs parameter of the original format named
+// by frma.
+func (b *EncBox) Codec() (string, error) {
+   if b.Sinf == nil || b.Sinf.Frma == nil {
+      return "", errors.New("encrypted sample entry has no frma")
+   }
+   return b.codec(b.Sinf.Frma.DataFormat)
+}
+
+// Codec returns the RFC 6381 codecs parameter of the first sample entry.
+// Entries sofia does not model, such as the wvtt and stpp subtitle entries,
+// are named by their type.
+func (b *StsdBox) Codec() (string, error) {
+   entries := b.children()
+   if len(entries) == 0 {
+      return "", errors.New("no sample entry in stsd")
+   }
+   switch first := entries[0]; {
+   case first.enc != nil:
+      return first.enc.Codec()
+   case first.entry != nil:
+      return first.entry.Codec()
+   case len(first.other) >= 8:
+      return textCodec([4]byte(first.other[4:8])), nil
+   }
+   return "", errors.New("no sample entry in stsd")
+}
+
+// textCodec returns the codecs parameter of a sample entry type that is
+// not otherwise modelled. stpp is assumed to carry IMSC1 text.
+func textCodec(format [4]byte) string {
+   if name := string(format[:]); name != "stpp" {
+      return name
+   }
+   return "stpp.ttml.im1t"
+}
+
+// codec follows RFC 6381 and, for the video formats, the annexes of
+// ISO/IEC 14496-15 and the AV1, VP9 and Dolby Vision bindings.
+func (e *SampleEntry) codec(format [4]byte) (string, error) {
+   name := string(format[:])
+   missing := func(config string) error {
+      return fmt.Errorf("%s sample entry has no %s", name, config)
+   }
+   switch name {
+   case "avc1", "avc3":
+      if e.AvcC == nil {
+         return "", missing("avcC")
+      }
+      return fmt.Sprintf(
+         "%s.%02x%02x%02x", name, e.AvcC.Profile, e.AvcC.ProfileCompatibility,
+         e.AvcC.Level,
+      ), nil
+   case "hvc1", "hev1":
+      if e.HvcC == nil {
+         return "", missing("hvcC")
+      }
+      return name + "." + e.HvcC.codec(), nil
+   case "av01":
+      if e.Av1C == nil {
+         return "", missing("av1C")
+      }
+      tier := "M"
+      if e.Av1C.SeqTier0 == 1 {
+         tier = "H"
+      }
+      return fmt.Sprintf(
+         "av01.%d.%02d%s.%02d", e.Av1C.SeqProfile, e.Av1C.SeqLevelIdx0, tier,
+         e.Av1C.BitDepth(),
+      ), nil
+   case "vp09":
+      if e.VpcC == nil {
+         return "", missing("vpcC")
+      }
+      return fmt.Sprintf(
+         "vp09.%02d.%02d.%02d", e.VpcC.Profile, e.VpcC.Level, e.VpcC.BitDepth,
+      ), nil
+   case "dvh1", "dvhe":
+      if e.Dovi == nil {
+         return "", missing("Dolby Vision configuration")
+      }
+      return fmt.Sprintf("%s.%02d.%02d", name, e.Dovi.Profile, e.Dovi.Level), nil
+   case "vp08":
+      return "vp8", nil
+   case "mp4a", "mp4v":
+      if e.Esds == nil {
+         return "", missing("esds")
+      }
+      codec := fmt.Sprintf("%s.%02x", name, e.Esds.ObjectTypeIndication)
+      if name == "mp4a" && e.Esds.ObjectTypeIndication == 0x40 {
+         objectType := e.Esds.AudioObjectType()
+         if objectType == 0 {
+            return "", errors.New("mp4a sample entry has no AudioSpecificConfig")
+         }
+         codec += fmt.Sprintf(".%d", objectType)
+      }
+      return codec, nil
+   case "ac-3", "ec-3", "ac-4":
+      return name, nil
+   case "Opus":
+      return "opus", nil
+   case "fLaC":
+      return "flac", nil
+   }
+   return "", fmt.Errorf("no codecs parameter for %q sample entry", name)
+}
@@ -0,0 +1,215 @@
+// entry_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+)
+
+// ffmpegEsds is an esds as written by ffmpeg: four byte descriptor sizes,
+// streamPriority, and an SLConfigDescriptor, 51 bytes in all.
+var ffmpegEsds = []byte{
+   0, 0, 0, 51, 'e', 's', 'd', 's', 0, 0, 0, 0,
+   0x03, 0x80, 0x80, 0x80, 0x22, 0x00, 0x01, 0x1F,
+   0x04, 0x80, 0x80, 0x80, 0x14, 0x40, 0x15, 0x00, 0x00, 0x00,
+   0x00, 0x01, 0xF4, 0x00, 0x00, 0x01, 0xF4, 0x00,
+   0x05, 0x80, 0x80, 0x80, 0x02, 0x11, 0x90,
+   0x06, 0x80, 0x80, 0x80, 0x01, 0x02,
+}
+
+func testVisualFields() []byte {
+   fields := make([]byte, visualSampleEntrySize)
+   binary.BigEndian.PutUint16(fields[6:], 1)
+   binary.BigEndian.PutUint16(fields[24:], 640)
+   binary.BigEndian.PutUint16(fields[26:], 360)
+   binary.BigEndian.PutUint32(fields[28:], 0x00480000)
+   binary.BigEndian.PutUint32(fields[32:], 0x00480000)
+   binary.BigEndian.PutUint16(fields[40:], 1)
+   fields[42] = 4
+   copy(fields[43:], "test\x00junk") // padding that is not zero
+   binary.BigEndian.PutUint16(fields[74:], 24)
+   // pre_defined left as 0 rather than -1
+   return fields
+}
+
+var testAvcC = []byte{
+   0, 0, 0, 25, 'a', 'v', 'c', 'C', 1, 0x64, 0, 0x1F, 0xFF, 0xE1,
+   0, 4, 0x67, 0x64, 0, 0x1F, 1, 0, 2, 0x68, 0xEE,
+}
+
+func TestSampleEntryRoundTrip(t *testing.T) {
+   colr := containerBox("colr", []byte("nclx"), []byte{0, 1, 0, 1, 0, 1, 0})
+   tests := map[string][]byte{
+      "mp4a": containerBox(
+         "mp4a",
+         []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 16, 0, 0, 0, 0, 0xBB, 0x80, 0, 0},
+         ffmpegEsds,
+      ),
+      "avc1": containerBox("avc1", testVisualFields(), colr, testAvcC),
+   }
+   for name, data := range tests {
+      entry, err := DecodeSampleEntryBox(data)
+      if err != nil {
+         t.Fatalf("%s: %v", name, err)
+      }
+      if got := entry.Encode(); !bytes.Equal(got, data) {
+         t.Errorf("%s: Encode changed the entry\ngot  %x\nwant %x", name, got, data)
+      }
+   }
+}
+
+func TestSampleEntryChanged(t *testing.T) {
+   entry, err := DecodeSampleEntryBox(containerBox("avc1", testVisualFields(), testAvcC))
+   if err != nil {
+      t.Fatal(err)
+   }
+   entry.Visual.Width = 1280
+   entry, err = DecodeSampleEntryBox(entry.Encode())
+   if err != nil {
+      t.Fatal(err)
+   }
+   if entry.Visual.Width != 1280 || entry.Visual.Height != 360 {
+      t.Errorf("got %dx%d, want 1280x360", entry.Visual.Width, entry.Visual.Height)
+   }
+}
+
+func TestRemoveSinfKeepsEntry(t *testing.T) {
+   sinf := containerBox(
+      "sinf",
+      containerBox("frma", []byte("mp4a")),
+      containerBox("schm", []byte{0, 0, 0, 0}, []byte("cenc"), []byte{0, 1, 0, 0}),
+   )
+   fields := []byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2, 0, 16, 0, 0, 0, 0, 0xBB, 0x80, 0, 0}
+   stsd := containerBox(
+      "stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, containerBox("enca", fields, ffmpegEsds, sinf),
+   )
+   box, err := DecodeStsdBox(stsd)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if err := box.RemoveSinf(); err != nil {
+      t.Fatal(err)
+   }
+   want := containerBox("stsd", []byte{0, 0, 0, 0, 0, 0, 0, 1}, containerBox("mp4a", fields, ffmpegEsds))
+   if got := box.Encode(); !bytes.Equal(got, want) {
+      t.Errorf("got  %x\nwant %x", got, want)
+   }
+}
+
+func TestStsdOrder(t *testing.T) {
+   avc1 := containerBox("avc1", testVisualFields(), testAvcC)
+   wvtt := containerBox("wvtt", make([]byte, 8))
+   for _, entries := range [][][]byte{
+      {avc1, testEncv(1)},
+      {testEncv(1), avc1},
+      {wvtt, testEncv(1), avc1},
+      {avc1, wvtt, testEncv(1), testEncv(2)},
+   } {
+      stsd := containerBox(
+         "stsd", binary.BigEndian.AppendUint32(make([]byte, 4), uint32(len(entries))),
+         bytes.Join(entries, nil),
+      )
+      box, err := DecodeStsdBox(stsd)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if got := box.Encode(); !bytes.Equal(got, stsd) {
+         t.Errorf("got  %x\nwant %x", got, stsd)
+      }
+      want := textCodec([4]byte(entries[0][4:8]))
+      if want != "wvtt" {
+         want = "avc1.64001f"
+      }
+      if codec, err := box.Codec(); codec != want {
+         t.Errorf("got codec %q, %v, want %q", codec, err, want)
+      }
+   }
+}
+
+func TestCodec(t *testing.T) {
+   aac := func(config ...byte) *EsdsBox {
+      return &EsdsBox{ObjectTypeIndication: 0x40, DecoderSpecificInfo: config}
+   }
+   tests := []struct {
+      format string
+      entry  SampleEntry
+      want   string
+   }{
+      {"avc1", SampleEntry{AvcC: &AvcCBox{Profile: 0x64, Level: 0x1F}}, "avc1.64001f"},
+      {"avc3", SampleEntry{AvcC: &AvcCBox{Profile: 0x42, ProfileCompatibility: 0xC0, Level: 0x1E}}, "avc3.42c01e"},
+      {"hvc1", SampleEntry{HvcC: &HvcCBox{
+         GeneralProfileIDC: 1, GeneralProfileCompatibilityFlags: 0x60000000,
+         GeneralLevelIDC: 93, GeneralConstraintIndicatorFlags: 0xB00000000000,
+      }}, "hvc1.1.6.L93.B0"},
+      {"hev1", SampleEntry{HvcC: &HvcCBox{
+         GeneralProfileSpace: 1, GeneralTierFlag: true, GeneralProfileIDC: 2,
+         GeneralProfileCompatibilityFlags: 0x20000000, GeneralLevelIDC: 120,
+         GeneralConstraintIndicatorFlags: 0x900008000000,
+      }}, "hev1.A2.4.H120.90.0.8"},
+      {"av01", SampleEntry{Av1C: &Av1CBox{SeqLevelIdx0: 8}}, "av01.0.08M.08"},
+      {"av01", SampleEntry{Av1C: &Av1CBox{
+         SeqProfile: 2, SeqLevelIdx0: 12, SeqTier0: 1, HighBitdepth: true,
+         TwelveBit: true,
+      }}, "av01.2.12H.12"},
+      {"vp09", SampleEntry{VpcC: &VpcCBox{Level: 31, BitDepth: 8}}, "vp09.00.31.08"},
+      {"vp09", SampleEntry{VpcC: &VpcCBox{Profile: 2, Level: 40, BitDepth: 10}}, "vp09.02.40.10"},
+      {"dvh1", SampleEntry{Dovi: &DoviBox{Profile: 8, Level: 6}}, "dvh1.08.06"},
+      {"dvhe", SampleEntry{Dovi: &DoviBox{Profile: 5, Level: 13}}, "dvhe.05.13"},
+      {"mp4a", SampleEntry{Esds: aac(0x12, 0x10)}, "mp4a.40.2"},
+      {"mp4a", SampleEntry{Esds: aac(0x2B, 0x92, 0x08, 0x00)}, "mp4a.40.5"},
+      {"mp4a", SampleEntry{Esds: aac(0xF8, 0x20)}, "mp4a.40.33"},
+      {"mp4a", SampleEntry{Esds: &EsdsBox{ObjectTypeIndication: 0x6B}}, "mp4a.6b"},
+      {"Opus", SampleEntry{}, "opus"},
+      {"ac-3", SampleEntry{}, "ac-3"},
+      {"ec-3", SampleEntry{}, "ec-3"},
+      {"ac-4", SampleEntry{}, "ac-4"},
+      {"fLaC", SampleEntry{}, "flac"},
+      // a configuration box is required
+      {"avc1", SampleEntry{}, ""},
+      {"hvc1", SampleEntry{}, ""},
+      {"dvh1", SampleEntry{HvcC: &HvcCBox{}}, ""},
+      {"mp4a", SampleEntry{Esds: aac()}, ""},
+   }
+   for _, test := range tests {
+      got, err := test.entry.codec([4]byte([]byte(test.format)))
+      if got != test.want || (err == nil) != (test.want != "") {
+         t.Errorf("%s: got %q, %v, want %q", test.format, got, err, test.want)
+      }
+   }
+}
+
+func TestDoviBox(t *testing.T) {
+   // profile 8.1, level 6, with an RPU and a base layer
+   dvvC := containerBox("dvvC", []byte{1, 0, 0x10, 0x35, 0x10}, make([]byte, 19))
+   box, err := DecodeDoviBox(dvvC)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if box.VersionMajor != 1 || box.Profile != 8 || box.Level != 6 ||
+      !box.RPUPresent || box.ELPresent || !box.BLPresent ||
+      box.BLSignalCompatibilityID != 1 {
+      t.Errorf("got %+v", box)
+   }
+   entry := containerBox(
+      "dvh1", testVisualFields(), containerBox("hvcC", make([]byte, 23)), dvvC,
+   )
+   decoded, err := DecodeSampleEntryBox(entry)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := decoded.Encode(); !bytes.Equal(got, entry) {
+      t.Errorf("got  %x\nwant %x", got, entry)
+   }
+   decoded.Dovi.Level = 9
+   if codec, err := decoded.Codec(); codec != "dvh1.08.09" {
+      t.Errorf("got codec %q, %v", codec, err)
+   }
+   changed, err := DecodeDoviBox(decoded.Dovi.Encode())
+   if err != nil {
+      t.Fatal(err)
+   }
+   if changed.Level != 9 || changed.Profile != 8 || changed.BLSignalCompatibilityID != 1 {
+      t.Errorf("got %+v after changing the level", changed)
+   }
+}
@@ -0,0 +1,191 @@
+// errors.go
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "math"
+   "strings"
+)
+
+// ErrTruncated is matched by errors.Is when a box runs past the end of the
+// input, as opposed to being internally inconsistent.
+var ErrTruncated = errors.New("box extends past end of data")
+
+var (
+   errInvalidSize = errors.New("invalid child box size")
+   errTrailing    = errors.New("trailing bytes too short for a box header")
+   errShortMdat   = errors.New("mdat payload too short for samples")
+)
+
+// BoxError reports a malformed box. Path is the chain of box types leading
+// to it, such as "moof/traf/trun", and Offset is its byte offset, both
+// relative to the data handed to the outermost decode call. Expected and
+// Actual are byte counts, set when the box is too short for what it
+// declares.
+type BoxError struct {
+   Path     string
+   Offset   int64
+   Expected int
+   Actual   int
+   Err      error
+}
+
+func (e *BoxError) Error() string {
+   var b strings.Builder
+   switch {
+   case e.Path != "":
+      fmt.Fprintf(&b, "%s at offset %d: ", e.Path, e.Offset)
+   case e.Offset != 0:
+      fmt.Fprintf(&b, "offset %d: ", e.Offset)
+   }
+   b.WriteString(e.Err.Error())
+   if e.Expected != 0 || e.Actual != 0 {
+      fmt.Fprintf(&b, " (need %d bytes, have %d)", e.Expected, e.Actual)
+   }
+   return b.String()
+}
+
+func (e *BoxError) Unwrap() error {
+   return e.Err
+}
+
+// sizeError reports a box that is shorter than its fields require. The
+// location is filled in by the decoder of the enclosing box.
+func sizeError(message string, expected, actual int) error {
+   return &BoxError{Expected: expected, Actual: actual, Err: errors.New(message)}
+}
+
+// --- DECODER ---
+
+// decoder tracks where the box being decoded sits in the input, so that
+// errors can carry its path and offset. When lenient, problems are
+// recorded in warnings and decoding carries on with what is left. When
+// dump is set, every box walked is added to it as a child node.
+type decoder struct {
+   path     []string
+   offset   int64
+   lenient  bool
+   warnings []error
+   dump     *DumpNode
+}
+
+// boxes walks the boxes packed into payload, which starts skip bytes into
+// the current box, handing each one to visit.
+func (d *decoder) boxes(
+   payload []byte, skip int, visit func(header *BoxHeader, content []byte) error,
+) error {
+   topLevel := len(d.path) == 0
+   parentOffset := d.offset
+   defer func() {
+      d.offset = parentOffset
+   }()
+   offset := 0
+   for offset < len(payload) {
+      d.offset = parentOffset + int64(skip+offset)
+      header, err := DecodeBoxHeader(payload[offset:])
+      if err != nil {
+         if d.lenient {
+            err = d.error(errTrailing, 8, len(payload)-offset)
+            d.warn(err)
+            if d.dump != nil {
+               d.dump.Children = append(d.dump.Children, &DumpNode{
+                  Offset: d.offset,
+                  Size:   int64(len(payload) - offset),
+                  Fields: map[string]any{"Error": err.Error()},
+               })
+            }
+         }
+         break
+      }
+      boxSize, headerSize := int(header.Size), 8
+      switch boxSize {
+      case 0:
+         boxSize = len(payload) - offset
+      case 1: // largesize, as written by Remuxer for mdat
+         headerSize = 16
+         if len(payload)-offset >= 16 {
+            boxSize = int(min(binary.BigEndian.Uint64(payload[offset+8:]), math.MaxInt))
+         }
+      }
+      d.path = append(d.path, string(header.Type[:]))
+      parent := d.dumpBox(header, min(max(boxSize, 8), len(payload)-offset))
+      switch {
+      case boxSize < headerSize:
+         err = d.error(errInvalidSize, headerSize, boxSize)
+      case boxSize > len(payload)-offset:
+         if topLevel {
+            err = d.error(ErrTruncated, boxSize, len(payload)-offset)
+         } else {
+            err = d.error(errInvalidSize, boxSize, len(payload)-offset)
+         }
+         if d.lenient {
+            d.warn(err)
+            d.dump.set("Warning", err.Error())
+            boxSize = len(payload) - offset
+            err = nil
+         }
+      }
+      if err == nil {
+         err = d.wrap(visit(header, payload[offset:offset+boxSize]))
+         if err != nil && d.lenient {
+            d.warn(err) // skip the box
+            d.dump.set("Error", err.Error())
+            err = nil
+         }
+      } else {
+         d.dump.set("Error", err.Error())
+      }
+      d.path = d.path[:len(d.path)-1]
+      d.dump = parent
+      if err != nil {
+         if d.lenient {
+            d.warn(err) // no way to find the next box
+            break
+         }
+         return err
+      }
+      offset += boxSize
+   }
+   return nil
+}
+
+// dumpBox adds a node for a box of size bytes at the current offset to
+// the dump, if there is one, and makes it the node that the children of
+// the box are added to. It returns the node to restore afterwards.
+func (d *decoder) dumpBox(header *BoxHeader, size int) *DumpNode {
+   parent := d.dump
+   if parent != nil {
+      d.dump = &DumpNode{
+         Offset: d.offset, Size: int64(size), Type: string(header.Type[:]),
+      }
+      parent.Children = append(parent.Children, d.dump)
+   }
+   return parent
+}
+
+func (d *decoder) warn(err error) {
+   d.warnings = append(d.warnings, err)
+}
+
+func (d *decoder) error(err error, expected, actual int) error {
+   return d.wrap(&BoxError{Expected: expected, Actual: actual, Err: err})
+}
+
+// wrap attaches the current location to err, unless a box further down
+// has done so already.
+func (d *decoder) wrap(err error) error {
+   if err == nil {
+      return nil
+   }
+   var boxErr *BoxError
+   if !errors.As(err, &boxErr) {
+      return &BoxError{Path: strings.Join(d.path, "/"), Offset: d.offset, Err: err}
+   }
+   if boxErr.Path == "" {
+      boxErr.Path = strings.Join(d.path, "/")
+      boxErr.Offset = d.offset
+   }
+   return err
+}
@@ -0,0 +1,92 @@
+// errors_test.go
+package sofia
+
+import (
+   "errors"
+   "testing"
+)
+
+func TestDecodeBoxesLenient(t *testing.T) {
+   fragment := testFragment(1, 0, []TrunSample{
+      testSample(10, 3000, true, 0), testSample(10, 3000, false, 0),
+   })
+   tests := []struct {
+      name      string
+      data      []byte
+      path      string
+      truncated bool
+      warnings  int
+   }{
+      // the mdat runs past the end, and keeps what is present
+      {"truncated", append(testInit(), fragment[:len(fragment)-5]...), "mdat", true, 1},
+      // the tfhd is skipped, then the bytes after the traf are too few
+      {"corrupt", append(testInit(), containerBox(
+         "moof", containerBox("traf", containerBox("tfhd", make([]byte, 2))),
+         make([]byte, 3),
+      )...), "moof/traf/tfhd", false, 2},
+      // a child runs past the end of its parent and is cut short
+      {"child", append(testInit(), containerBox(
+         "moof", containerBox("traf", []byte{0, 0, 0, 99, 'f', 'r', 'e', 'e'}),
+      )...), "moof/traf/free", false, 1},
+      {"pssh", append(testInit(), containerBox(
+         "pssh", []byte{1, 0, 0, 0}, WidevineSystemID[:], []byte{0x10, 0, 0, 0},
+      )...), "pssh", false, 1},
+   }
+   for _, test := range tests {
+      _, err := DecodeBoxes(test.data)
+      var boxErr *BoxError
+      if !errors.As(err, &boxErr) || boxErr.Path != test.path {
+         t.Errorf("%s: got error %v, want one at %s", test.name, err, test.path)
+      }
+      if errors.Is(err, ErrTruncated) != test.truncated {
+         t.Errorf("%s: got error %v, truncated %v", test.name, err, test.truncated)
+      }
+      boxes, warnings := DecodeBoxesLenient(test.data)
+      if len(warnings) != test.warnings {
+         t.Errorf("%s: got warnings %v, want %d", test.name, warnings, test.warnings)
+      }
+      if _, ok := FindMoov(boxes); !ok {
+         t.Errorf("%s: lost the moov", test.name)
+      }
+   }
+}
+
+func TestRemuxerLenient(t *testing.T) {
+   gop := []TrunSample{
+      testSample(10, 3000, true, 0), testSample(11, 3000, false, 0),
+      testSample(12, 3000, false, 0),
+   }
+   // the last fragment stops partway through its second sample
+   last := testFragment(2, 9000, gop)
+   segment := append(testFragment(1, 0, gop), last[:len(last)-12-5]...)
+   strict := Remuxer{Writer: &seekBuffer{}}
+   if err := strict.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   if err := strict.AddSegment(segment); err == nil {
+      t.Error("strict remux took a cut short mdat")
+   }
+
+   var output seekBuffer
+   r := Remuxer{Writer: &output, Lenient: true}
+   if err := r.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   if err := r.AddSegment(segment); err != nil {
+      t.Fatal(err)
+   }
+   if err := r.Finish(); err != nil {
+      t.Fatal(err)
+   }
+   // the mdat cut short, and too short for the samples of its trun
+   if len(r.Warnings) != 2 {
+      t.Errorf("got warnings %v, want 2", r.Warnings)
+   }
+   samples := testSamples(t, output.data)
+   if len(samples) != 4 {
+      t.Fatalf("got %d samples, want 4", len(samples))
+   }
+   if sample := samples[3]; sample.size != 10 || sample.offset != 0 {
+      t.Errorf("got last sample %+v, want the first of the cut short fragment", sample)
+   }
+}
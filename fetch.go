@@ -0,0 +1,268 @@
+// fetch.go
+package sofia
+
+import (
+   "context"
+   "errors"
+   "fmt"
+   "io"
+   "net/http"
+   "net/url"
+   "time"
+)
+
+// Fetcher downloads the segments of a DASH or HLS rendition and adds them
+// to a Remuxer in order.
+type Fetcher struct {
+   Transport http.RoundTripper // nil means http.DefaultTransport
+   // Retries is how many more times a request is made after a network
+   // error or a 5xx or 429 response, waiting RetryDelay times the attempt
+   // number in between.
+   Retries    int
+   RetryDelay time.Duration
+   // Prefetch is how many segments are downloaded ahead of the Remuxer.
+   // Less than 1 means 1.
+   Prefetch int
+}
+
+// MPDSegments fetches the MPD at mpdURL and returns the init segment and
+// media segments of the Representation with the given id, from the first
+// period that has it. A SegmentBase is resolved by fetching its sidx. The
+// media segments of a SegmentList with no Initialization, or the file of a
+// Representation with only a BaseURL, are self-initializing, and the init
+// segment is then the first of them.
+func (f *Fetcher) MPDSegments(ctx context.Context, mpdURL, id string) (Segment, []Segment, error) {
+   data, final, err := f.fetch(ctx, Segment{URL: mpdURL})
+   if err != nil {
+      return Segment{}, nil, err
+   }
+   rep, err := findRepresentation(data, final, id)
+   if err != nil {
+      return Segment{}, nil, err
+   }
+   if rep.base == nil {
+      return rep.segments()
+   }
+   // the subsegments are indexed by the sidx in indexRange
+   index, err := parseRange(rep.base.IndexRange)
+   if err != nil {
+      return Segment{}, nil, fmt.Errorf("SegmentBase indexRange: %w", err)
+   }
+   init := Segment{URL: rep.baseURL, Size: index.Start}
+   if rep.base.Initialization != nil && rep.base.Initialization.Range != "" {
+      init, err = parseRange(rep.base.Initialization.Range)
+      if err != nil {
+         return Segment{}, nil, fmt.Errorf("SegmentBase Initialization: %w", err)
+      }
+      init.URL = rep.baseURL
+   }
+   src := &httpReaderAt{ctx: ctx, fetcher: f, url: rep.baseURL}
+   sidx, err := ReadSidx(src, index.Start)
+   if err != nil {
+      return Segment{}, nil, err
+   }
+   ranges, err := sidx.Ranges(index.Start, src)
+   if err != nil {
+      return Segment{}, nil, err
+   }
+   return init, Segments(rep.baseURL, ranges), nil
+}
+
+// PlaylistSegments fetches the HLS fMP4 media playlist at playlistURL and
+// returns its init segment and media segments.
+func (f *Fetcher) PlaylistSegments(ctx context.Context, playlistURL string) (Segment, []Segment, error) {
+   data, final, err := f.fetch(ctx, Segment{URL: playlistURL})
+   if err != nil {
+      return Segment{}, nil, err
+   }
+   return parseMediaPlaylist(string(data), final)
+}
+
+// Remux initializes r with init, then adds the segments to it in order.
+// Up to Prefetch segments are downloaded concurrently. An init segment that
+// is the first media segment, as for a self-initializing Representation,
+// is downloaded once. The caller calls Finish; on error, Remux calls
+// Close.
+func (f *Fetcher) Remux(ctx context.Context, r *Remuxer, init Segment, segments []Segment) error {
+   err := f.remux(ctx, r, init, segments)
+   if err != nil {
+      r.Close()
+   }
+   return err
+}
+
+func (f *Fetcher) remux(ctx context.Context, r *Remuxer, init Segment, segments []Segment) error {
+   if init.URL == "" {
+      return errors.New("init segment has no URL")
+   }
+   data, _, err := f.fetch(ctx, init)
+   if err != nil {
+      return fmt.Errorf("fetching init segment: %w", err)
+   }
+   if err := r.Initialize(data); err != nil {
+      return err
+   }
+   var skip int
+   if len(segments) > 0 && selfInitializing(init, segments[0]) {
+      if err := r.AddSegment(data); err != nil {
+         return err
+      }
+      skip = 1
+   }
+   ctx, cancel := context.WithCancel(ctx)
+   defer cancel()
+   type result struct {
+      data []byte
+      err  error
+   }
+   // one buffered channel per segment keeps the order, and the semaphore
+   // is released as each one is handed to the Remuxer
+   segments = segments[skip:]
+   results := make([]chan result, len(segments))
+   for i := range results {
+      results[i] = make(chan result, 1)
+   }
+   semaphore := make(chan struct{}, max(f.Prefetch, 1))
+   go func() {
+      for i, segment := range segments {
+         select {
+         case semaphore <- struct{}{}:
+         case <-ctx.Done():
+            return
+         }
+         go func() {
+            data, _, err := f.fetch(ctx, segment)
+            results[i] <- result{data, err}
+         }()
+      }
+   }()
+   for i, segment := range segments {
+      var next result
+      select {
+      case next = <-results[i]:
+      case <-ctx.Done():
+         return ctx.Err()
+      }
+      <-semaphore
+      if next.err != nil {
+         return fmt.Errorf(
+            "fetching segment %d %s: %w", skip+i, segment.URL, next.err,
+         )
+      }
+      if err := r.AddSegment(next.data); err != nil {
+         return err
+      }
+   }
+   return nil
+}
+
+// selfInitializing reports whether init is the same bytes as segment.
+func selfInitializing(init, segment Segment) bool {
+   return init.URL == segment.URL && init.Start == segment.Start &&
+      init.Size == segment.Size
+}
+
+// fetch downloads a segment, which is the whole resource if Size is 0, and
+// returns it with the URL it was fetched from after redirects.
+func (f *Fetcher) fetch(ctx context.Context, segment Segment) ([]byte, *url.URL, error) {
+   var err error
+   for attempt := 0; attempt <= f.Retries; attempt++ {
+      if attempt > 0 {
+         select {
+         case <-time.After(f.RetryDelay * time.Duration(attempt)):
+         case <-ctx.Done():
+            return nil, nil, ctx.Err()
+         }
+      }
+      var data []byte
+      var final *url.URL
+      var retry bool
+      data, final, retry, err = f.fetchOnce(ctx, segment)
+      if err == nil || !retry {
+         return data, final, err
+      }
+   }
+   return nil, nil, err
+}
+
+func (f *Fetcher) fetchOnce(ctx context.Context, segment Segment) ([]byte, *url.URL, bool, error) {
+   req, err := http.NewRequestWithContext(ctx, "GET", segment.URL, nil)
+   if err != nil {
+      return nil, nil, false, err
+   }
+   if segment.Size > 0 {
+      req.Header.Set("Range", fmt.Sprintf(
+         "bytes=%d-%d", segment.Start, segment.Start+segment.Size-1,
+      ))
+   }
+   client := http.Client{Transport: f.Transport}
+   resp, err := client.Do(req)
+   if err != nil {
+      return nil, nil, ctx.Err() == nil, err
+   }
+   defer resp.Body.Close()
+   switch {
+   case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusPartialContent:
+   case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests:
+      return nil, nil, true, fmt.Errorf("GET %s: %s", segment.URL, resp.Status)
+   default:
+      return nil, nil, false, fmt.Errorf("GET %s: %s", segment.URL, resp.Status)
+   }
+   data, err := io.ReadAll(resp.Body)
+   if err != nil {
+      return nil, nil, true, err
+   }
+   if segment.Size > 0 && resp.StatusCode == http.StatusOK {
+      // the server ignored the Range header
+      if int64(len(data)) < segment.Start+segment.Size {
+         return nil, nil, false, fmt.Errorf(
+            "GET %s: %d bytes, range ends at %d", segment.URL, len(data),
+            segment.Start+segment.Size,
+         )
+      }
+      data = data[segment.Start : segment.Start+segment.Size]
+   }
+   if segment.Size > 0 && int64(len(data)) != segment.Size {
+      return nil, nil, true, fmt.Errorf(
+         "GET %s: %d bytes, expected %d", segment.URL, len(data), segment.Size,
+      )
+   }
+   return data, resp.Request.URL, false, nil
+}
+
+// httpReaderAt reads a remote file with range requests, for following
+// sidx references.
+type httpReaderAt struct {
+   ctx     context.Context
+   fetcher *Fetcher
+   url     string
+}
+
+func (h *httpReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+   if len(p) == 0 {
+      return 0, nil
+   }
+   data, _, err := h.fetcher.fetch(h.ctx, Segment{
+      URL: h.url, Start: offset, Size: int64(len(p)),
+   })
+   if err != nil {
+      return 0, err
+   }
+   n := copy(p, data)
+   if n < len(p) {
+      return n, io.ErrUnexpectedEOF
+   }
+   return n, nil
+}
+
+// parseRange parses a DASH byte range, "first-last".
+func parseRange(value string) (Segment, error) {
+   var first, last int64
+   if _, err := fmt.Sscanf(value, "%d-%d", &first, &last); err != nil {
+      return Segment{}, fmt.Errorf("invalid byte range %q", value)
+   }
+   if last < first {
+      return Segment{}, errors.New("byte range ends before it starts")
+   }
+   return Segment{Start: first, Size: last - first + 1}, nil
+}
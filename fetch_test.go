@@ -0,0 +1,173 @@
+// fetch_test.go
+package sofia
+
+import (
+   "bytes"
+   "context"
+   "fmt"
+   "net/http"
+   "net/http/httptest"
+   "strings"
+   "sync/atomic"
+   "testing"
+   "time"
+)
+
+// testSegments returns three media segments of two samples each.
+func testSegments() [][]byte {
+   var segments [][]byte
+   for i := range 3 {
+      segments = append(segments, testFragment(uint32(i+1), uint64(i)*6000, []TrunSample{
+         testSample(uint32(10+i), 3000, true, 0), testSample(4, 3000, false, 0),
+      }))
+   }
+   return segments
+}
+
+// testRemux remuxes to memory with add, which is given the initialized
+// Remuxer when initialize is set.
+func testRemux(t *testing.T, initialize bool, add func(*Remuxer) error) []byte {
+   t.Helper()
+   var b bytes.Buffer
+   r := Remuxer{Output: &b}
+   if initialize {
+      if err := r.Initialize(testInit()); err != nil {
+         t.Fatal(err)
+      }
+   }
+   if err := add(&r); err != nil {
+      t.Fatal(err)
+   }
+   if err := r.Finish(); err != nil {
+      t.Fatal(err)
+   }
+   return b.Bytes()
+}
+
+func TestFetcherRetry(t *testing.T) {
+   var requests atomic.Int32
+   server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+      if requests.Add(1) <= 2 {
+         http.Error(w, "busy", http.StatusServiceUnavailable)
+         return
+      }
+      w.Write([]byte("segment"))
+   }))
+   defer server.Close()
+
+   f := Fetcher{Retries: 1}
+   if _, _, err := f.fetch(context.Background(), Segment{URL: server.URL}); err == nil {
+      t.Fatal("fetch succeeded after 2 failures with 1 retry")
+   }
+   requests.Store(0)
+   f.Retries = 2
+   data, _, err := f.fetch(context.Background(), Segment{URL: server.URL})
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(data) != "segment" || requests.Load() != 3 {
+      t.Errorf("got %q after %d requests", data, requests.Load())
+   }
+}
+
+func TestFetcherIgnoredRange(t *testing.T) {
+   // the server answers 200 with the whole file to a range request
+   server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+      w.Write([]byte("0123456789"))
+   }))
+   defer server.Close()
+
+   var f Fetcher
+   data, _, err := f.fetch(context.Background(), Segment{URL: server.URL, Start: 3, Size: 4})
+   if err != nil {
+      t.Fatal(err)
+   }
+   if string(data) != "3456" {
+      t.Errorf("got %q, want %q", data, "3456")
+   }
+   _, _, err = f.fetch(context.Background(), Segment{URL: server.URL, Start: 8, Size: 4})
+   if err == nil {
+      t.Error("range past the end of the file succeeded")
+   }
+}
+
+func TestFetcherRemuxOrder(t *testing.T) {
+   segments := testSegments()
+   mux := http.NewServeMux()
+   mux.HandleFunc("/init.mp4", func(w http.ResponseWriter, req *http.Request) {
+      w.Write(testInit())
+   })
+   for i, segment := range segments {
+      mux.HandleFunc(fmt.Sprintf("/%d.m4s", i), func(w http.ResponseWriter, req *http.Request) {
+         // later segments arrive first
+         time.Sleep(time.Duration(len(segments)-i) * 20 * time.Millisecond)
+         w.Write(segment)
+      })
+   }
+   server := httptest.NewServer(mux)
+   defer server.Close()
+
+   var list []Segment
+   for i := range segments {
+      list = append(list, Segment{URL: fmt.Sprintf("%s/%d.m4s", server.URL, i)})
+   }
+   f := Fetcher{Prefetch: len(segments)}
+   got := testRemux(t, false, func(r *Remuxer) error {
+      return f.Remux(context.Background(), r, Segment{URL: server.URL + "/init.mp4"}, list)
+   })
+   want := testRemux(t, true, func(r *Remuxer) error {
+      for _, segment := range segments {
+         if err := r.AddSegment(segment); err != nil {
+            return err
+         }
+      }
+      return nil
+   })
+   if !bytes.Equal(got, want) {
+      t.Error("prefetched segments were remuxed out of order")
+   }
+}
+
+func TestFetcherSelfInitializing(t *testing.T) {
+   segments := testSegments()
+   file := append(testInit(), bytes.Join(segments, nil)...)
+   var requests atomic.Int32
+   mux := http.NewServeMux()
+   mux.HandleFunc("/video.mp4", func(w http.ResponseWriter, req *http.Request) {
+      requests.Add(1)
+      w.Write(file)
+   })
+   mux.HandleFunc("/manifest.mpd", func(w http.ResponseWriter, req *http.Request) {
+      fmt.Fprint(w, strings.TrimSpace(`
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static">
+ <Period>
+  <AdaptationSet>
+   <Representation id="1" bandwidth="1"><BaseURL>video.mp4</BaseURL></Representation>
+  </AdaptationSet>
+ </Period>
+</MPD>`))
+   })
+   server := httptest.NewServer(mux)
+   defer server.Close()
+
+   var f Fetcher
+   init, list, err := f.MPDSegments(context.Background(), server.URL+"/manifest.mpd", "1")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if init.URL != server.URL+"/video.mp4" {
+      t.Fatalf("init segment URL %q", init.URL)
+   }
+   got := testRemux(t, false, func(r *Remuxer) error {
+      return f.Remux(context.Background(), r, init, list)
+   })
+   want := testRemux(t, true, func(r *Remuxer) error {
+      return r.AddSegment(file)
+   })
+   if !bytes.Equal(got, want) {
+      t.Error("self-initializing Representation remuxed differently")
+   }
+   if requests.Load() != 1 {
+      t.Errorf("file fetched %d times", requests.Load())
+   }
+}
@@ -0,0 +1,113 @@
+// fixture_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+)
+
+// testTimescale is the media timescale of testInit.
+const testTimescale = 90000
+
+// testInit returns an init segment with one avc1 video track, with track ID
+// 1 and the media timescale testTimescale.
+func testInit() []byte {
+   return testTrackInit("vide", containerBox("avc1", testVisualFields(), testAvcC))
+}
+
+// testTrackInit returns an init segment with one track of the handler type,
+// described by the sample entries.
+func testTrackInit(handler string, entries ...[]byte) []byte {
+   be := binary.BigEndian
+   header := containerBox("nmhd", make([]byte, 4))
+   width, height := uint32(0), uint32(0)
+   if handler == "vide" {
+      header = containerBox("vmhd", []byte{0, 0, 0, 1}, make([]byte, 8))
+      width, height = 640, 360
+   }
+   stsd := containerBox(
+      "stsd", be.AppendUint32(make([]byte, 4), uint32(len(entries))),
+      bytes.Join(entries, nil),
+   )
+   stbl := containerBox(
+      "stbl", stsd,
+      containerBox("stts", make([]byte, 8)),
+      containerBox("stsc", make([]byte, 8)),
+      containerBox("stsz", make([]byte, 12)),
+      containerBox("stco", make([]byte, 8)),
+   )
+   minf := containerBox("minf", header, stbl)
+   mdhd := be.AppendUint32(make([]byte, 12), testTimescale)
+   mdhd = append(mdhd, 0, 0, 0, 0, 0x15, 0xC7, 0, 0) // duration, eng
+   hdlr := append(make([]byte, 8), handler...)
+   hdlr = append(hdlr, make([]byte, 13)...)
+   mdia := containerBox(
+      "mdia", containerBox("mdhd", mdhd), containerBox("hdlr", hdlr), minf,
+   )
+   tkhd := be.AppendUint32([]byte{0, 0, 0, 3}, 0)
+   tkhd = be.AppendUint32(tkhd, 0)
+   tkhd = be.AppendUint32(tkhd, 1) // track ID
+   tkhd = append(tkhd, make([]byte, 24)...)
+   for _, value := range []uint32{0x10000, 0, 0, 0, 0x10000, 0, 0, 0, 0x40000000} {
+      tkhd = be.AppendUint32(tkhd, value)
+   }
+   tkhd = be.AppendUint32(tkhd, width<<16)
+   tkhd = be.AppendUint32(tkhd, height<<16)
+   trak := containerBox("trak", containerBox("tkhd", tkhd), mdia)
+   mvhd := be.AppendUint32(make([]byte, 12), 1000)
+   mvhd = append(mvhd, 0, 0, 0, 0, 0, 1, 0, 0, 1, 0)
+   mvhd = append(mvhd, make([]byte, 70)...)
+   mvhd = be.AppendUint32(mvhd, 2)
+   trex := be.AppendUint32(make([]byte, 4), 1)
+   trex = be.AppendUint32(trex, 1)
+   trex = append(trex, make([]byte, 12)...)
+   mvex := containerBox("mvex", containerBox("trex", trex))
+   moov := containerBox("moov", containerBox("mvhd", mvhd), trak, mvex)
+   ftyp := containerBox("ftyp", []byte("iso6"), make([]byte, 4), []byte("iso6mp41"))
+   return append(ftyp, moov...)
+}
+
+// testSample returns a trun sample: sync samples depend on no others.
+func testSample(size, duration uint32, sync bool, offset int32) TrunSample {
+   flags := uint32(0x01010000)
+   if sync {
+      flags = 0x02000000
+   }
+   return TrunSample{
+      Size: size, Duration: duration, Flags: flags,
+      CompositionTimeOffset: offset,
+   }
+}
+
+// testFragment returns a moof and mdat of track 1 holding samples from
+// decodeTime, each filled with the byte that is its index.
+func testFragment(sequence uint32, decodeTime uint64, samples []TrunSample) []byte {
+   var payload []byte
+   for i, sample := range samples {
+      for range sample.Size {
+         payload = append(payload, byte(i))
+      }
+   }
+   tfhd := TfhdBox{Header: &BoxHeader{}, Flags: 0x020000, TrackID: 1}
+   tfdt := TfdtBox{Header: &BoxHeader{}, Version: 1, BaseMediaDecodeTime: decodeTime}
+   trun := TrunBox{Header: &BoxHeader{}, Flags: 0x000F01, Samples: samples}
+   mfhd := binary.BigEndian.AppendUint32(make([]byte, 4), sequence)
+   moof := func() []byte {
+      traf := containerBox("traf", tfhd.Encode(), tfdt.Encode(), trun.Encode())
+      return containerBox("moof", containerBox("mfhd", mfhd), traf)
+   }
+   trun.DataOffset = int32(len(moof()) + 8)
+   return append(moof(), containerBox("mdat", payload)...)
+}
+
+// testEncv returns an encv sample entry of avc1 samples, encrypted with
+// the cenc scheme under a key ID of 16 kid bytes.
+func testEncv(kid byte) []byte {
+   tenc := append([]byte{0, 0, 0, 0, 0, 0, 1, 8}, bytes.Repeat([]byte{kid}, 16)...)
+   sinf := containerBox(
+      "sinf", containerBox("frma", []byte("avc1")),
+      containerBox("schm", make([]byte, 4), []byte("cenc"), []byte{0, 1, 0, 0}),
+      containerBox("schi", containerBox("tenc", tenc)),
+   )
+   return containerBox("encv", testVisualFields(), testAvcC, sinf)
+}
@@ -1,17 +1,21 @@
 // fragment.go
 package sofia
 
-import "errors"
-
 // --- MOOF ---
 type MoofBox struct {
    Header      *BoxHeader
    Traf        *TrafBox
    Pssh        []*PsshBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeMoofBox(data []byte) (*MoofBox, error) {
+   var d decoder
+   return d.moof(data)
+}
+
+func (d *decoder) moof(data []byte) (*MoofBox, error) {
    b := &MoofBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -19,39 +23,29 @@ func DecodeMoofBox(data []byte) (*MoofBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "traf":
-         traf, err := DecodeTrafBox(content)
+         traf, err := d.traf(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Traf = traf
       case "pssh":
          pssh, err := DecodePsshBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Pssh = append(b.Pssh, pssh)
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("moof", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
@@ -77,7 +71,7 @@ func DecodeTfhdBox(data []byte) (*TfhdBox, error) {
    }
 
    if len(data) < 16 {
-      return nil, errors.New("tfhd too short")
+      return nil, sizeError("tfhd too short", 16, len(data))
    }
    p := parser{data: data, offset: 8}
    flags := p.Uint32()
@@ -86,48 +80,106 @@ func DecodeTfhdBox(data []byte) (*TfhdBox, error) {
 
    if b.Flags&0x000001 != 0 { // base-data-offset-present
       if len(data) < p.offset+8 {
-         return nil, errors.New("tfhd too short for BaseDataOffset")
+         return nil, sizeError(
+            "tfhd too short for BaseDataOffset",
+            p.offset+8, len(data),
+         )
       }
       b.BaseDataOffset = p.Uint64()
    }
    if b.Flags&0x000002 != 0 { // sample-description-index-present
       if len(data) < p.offset+4 {
-         return nil, errors.New("tfhd too short for SampleDescriptionIndex")
+         return nil, sizeError(
+            "tfhd too short for SampleDescriptionIndex",
+            p.offset+4, len(data),
+         )
       }
       b.SampleDescriptionIndex = p.Uint32()
    }
    if b.Flags&0x000008 != 0 { // default-sample-duration-present
       if len(data) < p.offset+4 {
-         return nil, errors.New("tfhd too short for DefaultSampleDuration")
+         return nil, sizeError(
+            "tfhd too short for DefaultSampleDuration",
+            p.offset+4, len(data),
+         )
       }
       b.DefaultSampleDuration = p.Uint32()
    }
    if b.Flags&0x000010 != 0 { // default-sample-size-present
       if len(data) < p.offset+4 {
-         return nil, errors.New("tfhd too short for DefaultSampleSize")
+         return nil, sizeError(
+            "tfhd too short for DefaultSampleSize",
+            p.offset+4, len(data),
+         )
       }
       b.DefaultSampleSize = p.Uint32()
    }
    if b.Flags&0x000020 != 0 { // default-sample-flags-present
       if len(data) < p.offset+4 {
-         return nil, errors.New("tfhd too short for DefaultSampleFlags")
+         return nil, sizeError(
+            "tfhd too short for DefaultSampleFlags",
+            p.offset+4, len(data),
+         )
       }
       b.DefaultSampleFlags = p.Uint32()
    }
    return b, nil
 }
 
+// Encode writes the optional fields that Flags marks as present.
+func (b *TfhdBox) Encode() []byte {
+   size := 16
+   for _, flag := range []uint32{0x000001, 0x000002, 0x000008, 0x000010, 0x000020} {
+      if b.Flags&flag != 0 {
+         size += 4
+      }
+   }
+   if b.Flags&0x000001 != 0 {
+      size += 4 // BaseDataOffset is 64 bits
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutUint32(b.Flags & 0x00FFFFFF)
+   w.PutUint32(b.TrackID)
+   if b.Flags&0x000001 != 0 {
+      w.PutUint64(b.BaseDataOffset)
+   }
+   if b.Flags&0x000002 != 0 {
+      w.PutUint32(b.SampleDescriptionIndex)
+   }
+   if b.Flags&0x000008 != 0 {
+      w.PutUint32(b.DefaultSampleDuration)
+   }
+   if b.Flags&0x000010 != 0 {
+      w.PutUint32(b.DefaultSampleSize)
+   }
+   if b.Flags&0x000020 != 0 {
+      w.PutUint32(b.DefaultSampleFlags)
+   }
+   b.Header.Size = uint32(size)
+   b.Header.Type = [4]byte{'t', 'f', 'h', 'd'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
 // --- TRAF ---
 type TrafBox struct {
    Header      *BoxHeader
    Tfhd        *TfhdBox
+   Tfdt        *TfdtBox
    Trun        []*TrunBox
    Senc        *SencBox
    Tenc        *TencBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeTrafBox(data []byte) (*TrafBox, error) {
+   var d decoder
+   return d.traf(data)
+}
+
+func (d *decoder) traf(data []byte) (*TrafBox, error) {
    b := &TrafBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -135,55 +187,153 @@ func DecodeTrafBox(data []byte) (*TrafBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "tfhd":
          tfhd, err := DecodeTfhdBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Tfhd = tfhd
+      case "tfdt":
+         tfdt, err := DecodeTfdtBox(content)
+         if err != nil {
+            return err
+         }
+         b.Tfdt = tfdt
       case "trun":
          trun, err := DecodeTrunBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Trun = append(b.Trun, trun)
       case "senc":
          senc, err := DecodeSencBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Senc = senc
       case "tenc":
          tenc, err := DecodeTencBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Tenc = tenc
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("traf", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
+      }
+      return nil
+   })
+   if err != nil {
+      return nil, err
+   }
+   return b, nil
+}
+
+// samples resolves the size, duration, sync flag and composition offset of
+// every sample of the runs, falling back on the tfhd defaults.
+func (b *TrafBox) samples() []RemuxSample {
+   tfhd := b.Tfhd
+   var samples []RemuxSample
+   for _, trun := range b.Trun {
+      for i, sample := range trun.Samples {
+         remuxSample := RemuxSample{
+            Duration:              tfhd.DefaultSampleDuration,
+            Size:                  tfhd.DefaultSampleSize,
+            IsSync:                true,
+            CompositionTimeOffset: 0,
+         }
+         currentFlags := tfhd.DefaultSampleFlags
+         // NOTE: The order of these two flag checks matters!
+         // Per ISO/IEC 14496-12, if both sample_flags_present (0x000400) and
+         // first_sample_flags_present (0x000004) are set, FirstSampleFlags
+         // must OVERRIDE sample.Flags for the first sample (i==0).
+         // Therefore, we must check sample_flags_present FIRST, then let
+         // first_sample_flags_present overwrite it for i==0.
+         // DO NOT swap these blocks, or FirstSampleFlags will be clobbered
+         // by sample.Flags and the keyframe (sync sample) detection will be
+         // corrupted for the first sample of each trun.
+         if (trun.Flags & 0x000400) != 0 {
+            currentFlags = sample.Flags
+         }
+         if i == 0 && (trun.Flags&0x000004) != 0 {
+            currentFlags = trun.FirstSampleFlags
+         }
+         if (trun.Flags & 0x000100) != 0 {
+            remuxSample.Duration = sample.Duration
+         }
+         if (trun.Flags & 0x000200) != 0 {
+            remuxSample.Size = sample.Size
+         }
+         if (trun.Flags & 0x000800) != 0 {
+            remuxSample.CompositionTimeOffset = sample.CompositionTimeOffset
+         }
+         if (currentFlags & 0x00010000) != 0 {
+            remuxSample.IsSync = false
+         } else {
+            remuxSample.IsSync = true
+         }
+         samples = append(samples, remuxSample)
       }
-      offset += boxSize
+   }
+   return samples
+}
+
+// --- TFDT ---
+type TfdtBox struct {
+   Header              *BoxHeader
+   Version             byte
+   Flags               uint32
+   BaseMediaDecodeTime uint64
+}
+
+func DecodeTfdtBox(data []byte) (*TfdtBox, error) {
+   b := &TfdtBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+
+   if len(data) < 16 {
+      return nil, sizeError("tfdt too short", 16, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Uint32()
+   b.Version = byte(versionAndFlags >> 24)
+   b.Flags = versionAndFlags & 0x00FFFFFF
+   if b.Version == 1 {
+      if len(data) < 20 {
+         return nil, sizeError("tfdt v1 too short", 20, len(data))
+      }
+      b.BaseMediaDecodeTime = p.Uint64()
+   } else {
+      b.BaseMediaDecodeTime = uint64(p.Uint32())
    }
    return b, nil
 }
 
+func (b *TfdtBox) Encode() []byte {
+   size := 16
+   if b.Version == 1 {
+      size = 20
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutUint32(uint32(b.Version)<<24 | b.Flags&0x00FFFFFF)
+   if b.Version == 1 {
+      w.PutUint64(b.BaseMediaDecodeTime)
+   } else {
+      w.PutUint32(uint32(b.BaseMediaDecodeTime))
+   }
+   b.Header.Size = uint32(size)
+   b.Header.Type = [4]byte{'t', 'f', 'd', 't'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
 type TrunBox struct {
    Header           *BoxHeader
    Flags            uint32
@@ -202,7 +352,7 @@ func DecodeTrunBox(data []byte) (*TrunBox, error) {
    }
 
    if len(data) < 16 {
-      return nil, errors.New("trun too short")
+      return nil, sizeError("trun too short", 16, len(data))
    }
 
    p := parser{data: data, offset: 8}
@@ -212,13 +362,19 @@ func DecodeTrunBox(data []byte) (*TrunBox, error) {
 
    if b.Flags&0x000001 != 0 {
       if len(data) < p.offset+4 {
-         return nil, errors.New("trun too short for data offset")
+         return nil, sizeError(
+            "trun too short for data offset",
+            p.offset+4, len(data),
+         )
       }
       b.DataOffset = p.Int32()
    }
    if b.Flags&0x000004 != 0 {
       if len(data) < p.offset+4 {
-         return nil, errors.New("trun too short for first sample flags")
+         return nil, sizeError(
+            "trun too short for first sample flags",
+            p.offset+4, len(data),
+         )
       }
       b.FirstSampleFlags = p.Uint32()
    }
@@ -236,8 +392,11 @@ func DecodeTrunBox(data []byte) (*TrunBox, error) {
    if b.Flags&0x000800 != 0 {
       sampleEntrySize += 4
    } // CTO
-   if len(data)-p.offset < int(b.SampleCount)*sampleEntrySize {
-      return nil, errors.New("trun box too short for declared samples")
+   if len(data) < p.offset+int(b.SampleCount)*sampleEntrySize {
+      return nil, sizeError(
+         "trun box too short for declared samples",
+         p.offset+int(b.SampleCount)*sampleEntrySize, len(data),
+      )
    }
 
    b.Samples = make([]TrunSample, b.SampleCount)
@@ -258,6 +417,60 @@ func DecodeTrunBox(data []byte) (*TrunBox, error) {
    return b, nil
 }
 
+// Encode writes the per-sample fields that Flags marks as present, with
+// version 1 if a composition offset is negative.
+func (b *TrunBox) Encode() []byte {
+   sampleSize := 0
+   for _, flag := range []uint32{0x000100, 0x000200, 0x000400, 0x000800} {
+      if b.Flags&flag != 0 {
+         sampleSize += 4
+      }
+   }
+   size := 16 + len(b.Samples)*sampleSize
+   if b.Flags&0x000001 != 0 {
+      size += 4
+   }
+   if b.Flags&0x000004 != 0 {
+      size += 4
+   }
+   var version uint32
+   for _, sample := range b.Samples {
+      if b.Flags&0x000800 != 0 && sample.CompositionTimeOffset < 0 {
+         version = 1
+         break
+      }
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutUint32(version<<24 | b.Flags&0x00FFFFFF)
+   w.PutUint32(uint32(len(b.Samples)))
+   if b.Flags&0x000001 != 0 {
+      w.PutUint32(uint32(b.DataOffset))
+   }
+   if b.Flags&0x000004 != 0 {
+      w.PutUint32(b.FirstSampleFlags)
+   }
+   for _, sample := range b.Samples {
+      if b.Flags&0x000100 != 0 {
+         w.PutUint32(sample.Duration)
+      }
+      if b.Flags&0x000200 != 0 {
+         w.PutUint32(sample.Size)
+      }
+      if b.Flags&0x000400 != 0 {
+         w.PutUint32(sample.Flags)
+      }
+      if b.Flags&0x000800 != 0 {
+         w.PutUint32(uint32(sample.CompositionTimeOffset))
+      }
+   }
+   b.SampleCount = uint32(len(b.Samples))
+   b.Header.Size = uint32(size)
+   b.Header.Type = [4]byte{'t', 'r', 'u', 'n'}
+   b.Header.Put(buffer)
+   return buffer
+}
+
 // --- TRUN ---
 type TrunSample struct {
    Size                  uint32
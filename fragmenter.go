@@ -0,0 +1,427 @@
+// fragmenter.go
+package sofia
+
+import (
+   "cmp"
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "io"
+   "math"
+   "math/bits"
+   "slices"
+   "time"
+)
+
+// WriteFragmented writes the progressive MP4 in data to w as a fragmented
+// MP4: ftyp and a moov with mvex, then a moof and mdat per fragment. Each
+// fragment holds the samples of one track, and starts at a sync sample
+// once the one before it is at least duration long, so a duration of zero
+// starts a fragment at every sync sample. Fragments of different tracks
+// are interleaved in time order. Encrypted tracks are not supported, as
+// their sample auxiliary information would be lost.
+func WriteFragmented(w io.Writer, data []byte, duration time.Duration) error {
+   ftyp, moovData, err := progressiveBoxes(data)
+   if err != nil {
+      return err
+   }
+   moov, err := DecodeMoovBox(moovData)
+   if err != nil {
+      return fmt.Errorf("decoding moov: %w", err)
+   }
+   var fragments []fragmentRun
+   for _, trak := range moov.Trak {
+      runs, err := trakFragments(trak, data, duration)
+      if err != nil {
+         return fmt.Errorf("track %d: %w", trakID(trak), err)
+      }
+      fragments = append(fragments, runs...)
+   }
+   slices.SortStableFunc(fragments, func(a, b fragmentRun) int {
+      return compareTime(a.time, a.timescale, b.time, b.timescale)
+   })
+
+   if _, err := w.Write(ftyp); err != nil {
+      return err
+   }
+   if _, err := w.Write(fragmentedMoov(moov)); err != nil {
+      return err
+   }
+   for i, fragment := range fragments {
+      moof, mdatHeader := fragment.encode(uint32(i + 1))
+      if _, err := w.Write(moof); err != nil {
+         return err
+      }
+      if _, err := w.Write(mdatHeader); err != nil {
+         return err
+      }
+      for _, sample := range fragment.samples {
+         if _, err := w.Write(data[sample.offset : sample.offset+uint64(sample.size)]); err != nil {
+            return err
+         }
+      }
+   }
+   return nil
+}
+
+// progressiveBoxes returns the ftyp, if any, and moov of data, reading
+// largesize boxes such as the mdat written by Remuxer.
+func progressiveBoxes(data []byte) ([]byte, []byte, error) {
+   var ftyp, moov []byte
+   offset := 0
+   for offset < len(data) {
+      header, err := DecodeBoxHeader(data[offset:])
+      if err != nil {
+         return nil, nil, err
+      }
+      boxSize := uint64(header.Size)
+      switch boxSize {
+      case 0:
+         boxSize = uint64(len(data) - offset)
+      case 1:
+         if len(data)-offset < 16 {
+            return nil, nil, sizeError("largesize box too short", 16, len(data)-offset)
+         }
+         boxSize = binary.BigEndian.Uint64(data[offset+8:])
+      }
+      if boxSize < 8 || boxSize > uint64(len(data)-offset) {
+         return nil, nil, sizeError(
+            fmt.Sprintf("invalid %s box size", header.Type[:]),
+            int(min(boxSize, math.MaxInt32)), len(data)-offset,
+         )
+      }
+      box := data[offset : offset+int(boxSize)]
+      switch string(header.Type[:]) {
+      case "ftyp":
+         ftyp = box
+      case "moov":
+         moov = box
+      case "moof":
+         return nil, nil, errors.New("input is already fragmented")
+      }
+      offset += int(boxSize)
+   }
+   if moov == nil {
+      return nil, nil, errors.New("no moov found")
+   }
+   return ftyp, moov, nil
+}
+
+// progressiveSample is a sample of a progressive file, located through
+// the sample tables.
+type progressiveSample struct {
+   offset      uint64
+   size        uint32
+   duration    uint32
+   cto         int32
+   sync        bool
+   description uint32
+}
+
+// fragmentRun is the samples of one track in one fragment.
+type fragmentRun struct {
+   trackID   uint32
+   timescale uint32
+   time      uint64 // decode time of the first sample
+   samples   []progressiveSample
+}
+
+// trakFragments splits the samples of trak into fragments.
+func trakFragments(trak *TrakBox, data []byte, duration time.Duration) ([]fragmentRun, error) {
+   mdia := trak.Mdia
+   if mdia == nil || mdia.Mdhd == nil {
+      return nil, errors.New("missing mdhd")
+   }
+   if mdia.Minf == nil || mdia.Minf.Stbl == nil || mdia.Minf.Stbl.Stsd == nil {
+      return nil, errors.New("missing stsd")
+   }
+   stbl := mdia.Minf.Stbl
+   if len(stbl.Stsd.EncChildren) > 0 {
+      return nil, errors.New("encrypted tracks cannot be fragmented")
+   }
+   samples, err := stblSamples(stbl, len(data))
+   if err != nil {
+      return nil, err
+   }
+   for _, sample := range samples {
+      if sample.offset+uint64(sample.size) > uint64(len(data)) {
+         return nil, sizeError(
+            "sample past end of data",
+            int(min(sample.offset+uint64(sample.size), math.MaxInt32)), len(data),
+         )
+      }
+   }
+   timescale := mdia.Mdhd.Timescale
+   target := ticks(duration, timescale)
+   var runs []fragmentRun
+   var decodeTime uint64
+   for _, sample := range samples {
+      if count := len(runs); count > 0 {
+         last := &runs[count-1]
+         sameDescription := sample.description == last.samples[0].description
+         if sameDescription && (!sample.sync || decodeTime-last.time < target) {
+            last.samples = append(last.samples, sample)
+            decodeTime += uint64(sample.duration)
+            continue
+         }
+      }
+      runs = append(runs, fragmentRun{
+         trackID:   trakID(trak),
+         timescale: timescale,
+         time:      decodeTime,
+         samples:   []progressiveSample{sample},
+      })
+      decodeTime += uint64(sample.duration)
+   }
+   return runs, nil
+}
+
+// stblSamples resolves every sample of stbl from stts, ctts, stss, stsz,
+// stsc and stco or co64. dataSize bounds the samples of a single size.
+func stblSamples(stbl *StblBox, dataSize int) ([]progressiveSample, error) {
+   var (
+      stts    *SttsBox
+      ctts    *CttsBox
+      stss    *StssBox
+      stsz    *StszBox
+      stsc    *StscBox
+      offsets []uint64
+   )
+   for _, child := range stbl.RawChildren {
+      if len(child) < 8 {
+         continue
+      }
+      var err error
+      switch string(child[4:8]) {
+      case "stts":
+         stts, err = DecodeSttsBox(child)
+      case "ctts":
+         ctts, err = DecodeCttsBox(child)
+      case "stss":
+         stss, err = DecodeStssBox(child)
+      case "stsz":
+         stsz, err = DecodeStszBox(child)
+      case "stz2":
+         err = errors.New("stz2 is not supported")
+      case "stsc":
+         stsc, err = DecodeStscBox(child)
+      case "stco":
+         var stco *StcoBox
+         stco, err = DecodeStcoBox(child)
+         if err == nil {
+            offsets = make([]uint64, len(stco.Offsets))
+            for i, offset := range stco.Offsets {
+               offsets[i] = uint64(offset)
+            }
+         }
+      case "co64":
+         var co64 *Co64Box
+         co64, err = DecodeCo64Box(child)
+         if err == nil {
+            offsets = co64.Offsets
+         }
+      }
+      if err != nil {
+         return nil, err
+      }
+   }
+   if stts == nil || stsz == nil || stsc == nil || offsets == nil {
+      return nil, errors.New("missing sample tables")
+   }
+   if uint64(stsz.SampleCount)*uint64(max(stsz.SampleSize, 1)) > uint64(dataSize) {
+      return nil, fmt.Errorf("stsz has %d samples, more than the data holds", stsz.SampleCount)
+   }
+
+   samples := make([]progressiveSample, stsz.SampleCount)
+   for i := range samples {
+      samples[i].size = stsz.SampleSize
+      if stsz.SampleSize == 0 {
+         samples[i].size = stsz.EntrySizes[i]
+      }
+      samples[i].sync = stss == nil
+   }
+   i := 0
+   for _, entry := range stts.Entries {
+      for range entry.SampleCount {
+         if i == len(samples) {
+            return nil, errors.New("stts has more samples than stsz")
+         }
+         samples[i].duration = entry.SampleDuration
+         i++
+      }
+   }
+   i = 0
+   if ctts != nil {
+      for _, entry := range ctts.Entries {
+         for range entry.SampleCount {
+            if i == len(samples) {
+               return nil, errors.New("ctts has more samples than stsz")
+            }
+            samples[i].cto = entry.SampleOffset
+            i++
+         }
+      }
+   }
+   if stss != nil {
+      for _, number := range stss.Indices {
+         if number == 0 || int(number) > len(samples) {
+            return nil, fmt.Errorf("stss sample %d out of range", number)
+         }
+         samples[number-1].sync = true
+      }
+   }
+   i = 0
+   for j, entry := range stsc.Entries {
+      last := uint32(len(offsets))
+      if j+1 < len(stsc.Entries) {
+         last = stsc.Entries[j+1].FirstChunk - 1
+      }
+      if entry.FirstChunk == 0 || last > uint32(len(offsets)) {
+         return nil, errors.New("stsc refers to a missing chunk")
+      }
+      for chunk := entry.FirstChunk; chunk <= last; chunk++ {
+         offset := offsets[chunk-1]
+         for range entry.SamplesPerChunk {
+            if i == len(samples) {
+               return nil, errors.New("stsc has more samples than stsz")
+            }
+            samples[i].offset = offset
+            samples[i].description = entry.SampleDescriptionIndex
+            offset += uint64(samples[i].size)
+            i++
+         }
+      }
+   }
+   if i < len(samples) {
+      return nil, errors.New("stsc has fewer samples than stsz")
+   }
+   return samples, nil
+}
+
+// fragmentedMoov turns the moov of a progressive file into that of an
+// init segment: the sample tables are emptied, the durations moved to
+// mehd, and mvex added with a trex for each track.
+func fragmentedMoov(moov *MoovBox) []byte {
+   moov.RemoveMvex()
+   var mvex []byte
+   if moov.Mvhd != nil {
+      mehd := make([]byte, 20)
+      binary.BigEndian.PutUint32(mehd, 20)
+      copy(mehd[4:], "mehd")
+      mehd[8] = 1 // version
+      binary.BigEndian.PutUint64(mehd[12:], moov.Mvhd.Duration)
+      mvex = append(mvex, mehd...)
+      moov.Mvhd.SetDuration(0)
+   }
+   for _, trak := range moov.Trak {
+      trex := make([]byte, 32)
+      binary.BigEndian.PutUint32(trex, 32)
+      copy(trex[4:], "trex")
+      binary.BigEndian.PutUint32(trex[12:], trakID(trak))
+      binary.BigEndian.PutUint32(trex[16:], 1) // sample description index
+      mvex = append(mvex, trex...)
+      if trak.Tkhd != nil {
+         trak.Tkhd.SetDuration(0)
+      }
+      trak.Mdia.Mdhd.SetDuration(0)
+      stbl := trak.Mdia.Minf.Stbl
+      var kept [][]byte
+      for _, child := range stbl.RawChildren {
+         switch string(child[4:8]) {
+         case "stts", "ctts", "stss", "stsz", "stz2", "stsc", "stco", "co64",
+            "sdtp", "sbgp", "subs", "saiz", "saio", "stps", "cslg":
+            continue
+         }
+         kept = append(kept, child)
+      }
+      stbl.RawChildren = append(
+         kept,
+         (&SttsBox{Header: &BoxHeader{}}).Encode(),
+         (&StscBox{Header: &BoxHeader{}}).Encode(),
+         (&StszBox{Header: &BoxHeader{}}).Encode(),
+         (&StcoBox{Header: &BoxHeader{}}).Encode(),
+      )
+   }
+   moov.RawChildren = append(moov.RawChildren, containerBox("mvex", mvex))
+   return moov.Encode()
+}
+
+// encode returns the moof of the fragment and the header of its mdat.
+func (f *fragmentRun) encode(sequence uint32) ([]byte, []byte) {
+   tfhd := TfhdBox{
+      Header: &BoxHeader{}, Flags: 0x020000, TrackID: f.trackID, // default-base-is-moof
+   }
+   if description := f.samples[0].description; description != 1 {
+      tfhd.Flags |= 0x000002
+      tfhd.SampleDescriptionIndex = description
+   }
+   tfdt := TfdtBox{Header: &BoxHeader{}, Version: 1, BaseMediaDecodeTime: f.time}
+   trun := TrunBox{Header: &BoxHeader{}, Flags: 0x000001 | 0x000100 | 0x000200 | 0x000400}
+   var payload uint64
+   for _, sample := range f.samples {
+      flags := uint32(0x02000000) // depends on no other sample
+      if !sample.sync {
+         flags = 0x01010000 // depends on others, and is not sync
+      }
+      if sample.cto != 0 {
+         trun.Flags |= 0x000800
+      }
+      trun.Samples = append(trun.Samples, TrunSample{
+         Size:                  sample.size,
+         Duration:              sample.duration,
+         Flags:                 flags,
+         CompositionTimeOffset: sample.cto,
+      })
+      payload += uint64(sample.size)
+   }
+   mdatHeader := make([]byte, 8)
+   if payload+8 > math.MaxUint32 {
+      mdatHeader = make([]byte, 16)
+      binary.BigEndian.PutUint32(mdatHeader, 1)
+      binary.BigEndian.PutUint64(mdatHeader[8:], payload+16)
+   } else {
+      binary.BigEndian.PutUint32(mdatHeader, uint32(payload+8))
+   }
+   copy(mdatHeader[4:], "mdat")
+
+   mfhd := make([]byte, 16)
+   binary.BigEndian.PutUint32(mfhd, 16)
+   copy(mfhd[4:], "mfhd")
+   binary.BigEndian.PutUint32(mfhd[12:], sequence)
+   moof := func() []byte {
+      traf := containerBox("traf", tfhd.Encode(), tfdt.Encode(), trun.Encode())
+      return containerBox("moof", mfhd, traf)
+   }
+   // the data offset is from the start of the moof to the first sample
+   trun.DataOffset = int32(len(moof()) + len(mdatHeader))
+   return moof(), mdatHeader
+}
+
+// containerBox returns a box of type name holding children.
+func containerBox(name string, children ...[]byte) []byte {
+   buffer := make([]byte, 8)
+   for _, child := range children {
+      buffer = append(buffer, child...)
+   }
+   header := BoxHeader{Size: uint32(len(buffer))}
+   copy(header.Type[:], name)
+   header.Put(buffer)
+   return buffer
+}
+
+func trakID(trak *TrakBox) uint32 {
+   if trak.Tkhd == nil {
+      return 0
+   }
+   return trak.Tkhd.TrackID
+}
+
+// compareTime compares times in different timescales.
+func compareTime(a uint64, aScale uint32, b uint64, bScale uint32) int {
+   ah, al := bits.Mul64(a, uint64(bScale))
+   bh, bl := bits.Mul64(b, uint64(aScale))
+   if c := cmp.Compare(ah, bh); c != 0 {
+      return c
+   }
+   return cmp.Compare(al, bl)
+}
@@ -0,0 +1,115 @@
+// fragmenter_test.go
+package sofia
+
+import (
+   "bytes"
+   "slices"
+   "strings"
+   "testing"
+   "time"
+)
+
+// testProgressive returns a progressive MP4 of two GOPs of four samples.
+func testProgressive(t *testing.T) []byte {
+   t.Helper()
+   gop := []TrunSample{
+      testSample(10, 3000, true, 3000), testSample(11, 3000, false, 6000),
+      testSample(12, 3000, false, 0), testSample(13, 3000, false, 3000),
+   }
+   return testRemux(t, true, func(r *Remuxer) error {
+      if err := r.AddSegment(testFragment(1, 0, gop)); err != nil {
+         return err
+      }
+      return r.AddSegment(testFragment(2, 12000, gop))
+   })
+}
+
+// testSamples returns the samples of the first track of a progressive MP4,
+// with their offsets replaced by their first byte.
+func testSamples(t *testing.T, data []byte) []progressiveSample {
+   t.Helper()
+   boxes, err := DecodeBoxes(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      t.Fatal("no moov")
+   }
+   samples, err := stblSamples(moov.Trak[0].Mdia.Minf.Stbl, len(data))
+   if err != nil {
+      t.Fatal(err)
+   }
+   for i, sample := range samples {
+      samples[i].offset = uint64(data[sample.offset])
+   }
+   return samples
+}
+
+func TestWriteFragmented(t *testing.T) {
+   progressive := testProgressive(t)
+   for _, test := range []struct {
+      duration  time.Duration
+      fragments int
+   }{
+      {0, 2},
+      {time.Second, 1},
+   } {
+      var fragmented bytes.Buffer
+      if err := WriteFragmented(&fragmented, progressive, test.duration); err != nil {
+         t.Fatal(err)
+      }
+      boxes, err := DecodeBoxes(fragmented.Bytes())
+      if err != nil {
+         t.Fatal(err)
+      }
+      var fragments int
+      for _, box := range boxes {
+         if box.Moof != nil {
+            fragments++
+         }
+      }
+      if fragments != test.fragments {
+         t.Errorf("duration %v: got %d fragments, want %d", test.duration, fragments, test.fragments)
+      }
+      // remuxing the fragments gives back the same file
+      remuxed := testRemux(t, false, func(r *Remuxer) error {
+         if err := r.Initialize(fragmented.Bytes()); err != nil {
+            return err
+         }
+         return r.AddSegment(fragmented.Bytes())
+      })
+      got, want := testSamples(t, remuxed), testSamples(t, progressive)
+      if !slices.Equal(got, want) {
+         t.Errorf("duration %v: got samples\n%v\nwant\n%v", test.duration, got, want)
+      }
+   }
+}
+
+func TestWriteFragmentedErrors(t *testing.T) {
+   fragment := testFragment(1, 0, []TrunSample{testSample(10, 3000, true, 0)})
+   boxes, err := DecodeBoxes(testProgressive(t))
+   if err != nil {
+      t.Fatal(err)
+   }
+   enc, err := DecodeEncBox(testEncv(1))
+   if err != nil {
+      t.Fatal(err)
+   }
+   stsd := boxes[1].Moov.Trak[0].Mdia.Minf.Stbl.Stsd
+   stsd.Entries, stsd.EncChildren = nil, []*EncBox{enc}
+   encrypted := append(boxes[0].Encode(), boxes[1].Moov.Encode()...)
+   for _, test := range []struct {
+      name, want string
+      data       []byte
+   }{
+      {"fragmented", "already fragmented", append(testInit(), fragment...)},
+      {"encrypted", "encrypted tracks", encrypted},
+      {"no moov", "no moov", containerBox("mdat", make([]byte, 4))},
+   } {
+      err := WriteFragmented(&bytes.Buffer{}, test.data, 0)
+      if err == nil || !strings.Contains(err.Error(), test.want) {
+         t.Errorf("%s: got error %v, want %q", test.name, err, test.want)
+      }
+   }
+}
@@ -0,0 +1,307 @@
+// hls.go
+package sofia
+
+import (
+   "bufio"
+   "encoding/base64"
+   "errors"
+   "fmt"
+   "io"
+   "math"
+   "net/url"
+   "slices"
+   "strconv"
+   "strings"
+)
+
+// WriteMediaPlaylist writes an HLS VOD media playlist for the Segments of
+// track. In single file addressing, the init segment and the segments are
+// byte ranges of URL; otherwise the init segment is Initialization and each
+// segment is its own URL. A cbcs protected track gets EXT-X-KEY tags for
+// KeyURI and the Widevine and PlayReady pssh boxes.
+func WriteMediaPlaylist(w io.Writer, track *Track) error {
+   info, err := track.info()
+   if err != nil {
+      return err
+   }
+   single := track.Initialization == ""
+   target := 1
+   for _, segment := range track.Segments {
+      target = max(target, int(math.Round(info.seconds(segment.Duration))))
+   }
+
+   b := bufio.NewWriter(w)
+   fmt.Fprintln(b, "#EXTM3U")
+   fmt.Fprintln(b, "#EXT-X-VERSION:7")
+   fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", target)
+   fmt.Fprintln(b, "#EXT-X-PLAYLIST-TYPE:VOD")
+   fmt.Fprintln(b, "#EXT-X-INDEPENDENT-SEGMENTS")
+   for _, key := range track.keys(info) {
+      fmt.Fprintf(b, "#EXT-X-KEY:%s\n", key)
+   }
+   if single {
+      size := track.InitRange[1] - track.InitRange[0] + 1
+      fmt.Fprintf(b,
+         "#EXT-X-MAP:URI=%q,BYTERANGE=\"%d@%d\"\n",
+         track.URL, size, track.InitRange[0],
+      )
+   } else {
+      fmt.Fprintf(b, "#EXT-X-MAP:URI=%q\n", track.Initialization)
+   }
+   for _, segment := range track.Segments {
+      fmt.Fprintf(b, "#EXTINF:%.3f,\n", info.seconds(segment.Duration))
+      if single {
+         fmt.Fprintf(b, "#EXT-X-BYTERANGE:%d@%d\n", segment.Size, segment.Start)
+         fmt.Fprintln(b, track.URL)
+      } else {
+         fmt.Fprintln(b, segment.URL)
+      }
+   }
+   fmt.Fprintln(b, "#EXT-X-ENDLIST")
+   return b.Flush()
+}
+
+// WriteMultivariantPlaylist writes an HLS multivariant playlist pointing
+// at the Playlist of each track. Audio and subtitle tracks become
+// renditions of the "audio" and "subs" groups, and each video track is a
+// variant stream using them. Without video, each audio track is a variant
+// stream. The keys of cbcs protected tracks are also given as
+// EXT-X-SESSION-KEY tags.
+func WriteMultivariantPlaylist(w io.Writer, tracks []Track) error {
+   infos := make([]*trackInfo, len(tracks))
+   var video, audio, subtitles []int
+   for i := range tracks {
+      info, err := tracks[i].info()
+      if err != nil {
+         return fmt.Errorf("track %d: %w", i, err)
+      }
+      infos[i] = info
+      switch info.handler {
+      case "vide":
+         video = append(video, i)
+      case "soun":
+         audio = append(audio, i)
+      case "text", "subt", "sbtl":
+         subtitles = append(subtitles, i)
+      }
+   }
+
+   b := bufio.NewWriter(w)
+   fmt.Fprintln(b, "#EXTM3U")
+   fmt.Fprintln(b, "#EXT-X-VERSION:7")
+   fmt.Fprintln(b, "#EXT-X-INDEPENDENT-SEGMENTS")
+   var sessionKeys []string
+   for i := range tracks {
+      for _, key := range tracks[i].keys(infos[i]) {
+         if !slices.Contains(sessionKeys, key) {
+            sessionKeys = append(sessionKeys, key)
+         }
+      }
+   }
+   for _, key := range sessionKeys {
+      fmt.Fprintf(b, "#EXT-X-SESSION-KEY:%s\n", key)
+   }
+
+   if len(video) == 0 {
+      for _, i := range audio {
+         fmt.Fprintf(b,
+            "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=%q\n",
+            infos[i].bandwidth, infos[i].codec,
+         )
+         fmt.Fprintln(b, tracks[i].Playlist)
+      }
+      return b.Flush()
+   }
+   for _, group := range [...]struct {
+      kind, id string
+      members  []int
+   }{
+      {"AUDIO", "audio", audio}, {"SUBTITLES", "subs", subtitles},
+   } {
+      for n, i := range group.members {
+         var language string
+         if infos[i].language != "" {
+            language = fmt.Sprintf("LANGUAGE=%q,", infos[i].language)
+         }
+         fmt.Fprintf(b,
+            "#EXT-X-MEDIA:TYPE=%s,GROUP-ID=%q,NAME=%q,%sDEFAULT=%s,AUTOSELECT=YES,URI=%q\n",
+            group.kind, group.id, tracks[i].name(i), language,
+            yesNo(n == 0), tracks[i].Playlist,
+         )
+      }
+   }
+   // a variant stream needs the bandwidth of its peak audio rendition
+   var audioBandwidth uint64
+   var audioCodecs []string
+   for _, i := range audio {
+      audioBandwidth = max(audioBandwidth, infos[i].bandwidth)
+      if !slices.Contains(audioCodecs, infos[i].codec) {
+         audioCodecs = append(audioCodecs, infos[i].codec)
+      }
+   }
+   for _, i := range video {
+      info := infos[i]
+      codecs := append([]string{info.codec}, audioCodecs...)
+      fmt.Fprintf(b,
+         "#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=%q",
+         info.bandwidth+audioBandwidth, strings.Join(codecs, ","),
+      )
+      if info.width > 0 {
+         fmt.Fprintf(b, ",RESOLUTION=%dx%d", info.width, info.height)
+      }
+      if len(audio) > 0 {
+         fmt.Fprint(b, `,AUDIO="audio"`)
+      }
+      if len(subtitles) > 0 {
+         fmt.Fprint(b, `,SUBTITLES="subs"`)
+      }
+      fmt.Fprintln(b)
+      fmt.Fprintln(b, tracks[i].Playlist)
+   }
+   return b.Flush()
+}
+
+// keys returns the attribute lists of the EXT-X-KEY tags of a cbcs
+// protected track.
+func (t *Track) keys(info *trackInfo) []string {
+   if info.scheme != "cbcs" {
+      return nil
+   }
+   keyID := fmt.Sprintf("KEYID=0x%X", info.kid)
+   var keys []string
+   if t.KeyURI != "" {
+      keys = append(keys, fmt.Sprintf(
+         `METHOD=SAMPLE-AES,URI=%q,KEYFORMAT="com.apple.streamingkeydelivery",KEYFORMATVERSIONS="1"`,
+         t.KeyURI,
+      ))
+   }
+   for _, pssh := range t.Moov.Pssh {
+      switch pssh.SystemID {
+      case WidevineSystemID:
+         keys = append(keys, fmt.Sprintf(
+            `METHOD=SAMPLE-AES,URI="data:text/plain;base64,%s",KEYFORMAT="urn:uuid:%s",KEYFORMATVERSIONS="1",%s`,
+            base64.StdEncoding.EncodeToString(pssh.Encode()),
+            FormatUUID(pssh.SystemID), keyID,
+         ))
+      case PlayReadySystemID:
+         keys = append(keys, fmt.Sprintf(
+            `METHOD=SAMPLE-AES,URI="data:text/plain;charset=UTF-16;base64,%s",KEYFORMAT="com.microsoft.playready",KEYFORMATVERSIONS="1",%s`,
+            base64.StdEncoding.EncodeToString(pssh.Data), keyID,
+         ))
+      }
+   }
+   return keys
+}
+
+func yesNo(value bool) string {
+   if value {
+      return "YES"
+   }
+   return "NO"
+}
+
+// parseMediaPlaylist returns the init segment and media segments of an HLS
+// fMP4 media playlist, with URIs resolved against location.
+func parseMediaPlaylist(text string, location *url.URL) (Segment, []Segment, error) {
+   if !strings.HasPrefix(text, "#EXTM3U") {
+      return Segment{}, nil, errors.New("not an HLS playlist")
+   }
+   var (
+      init      *Segment
+      segments  []Segment
+      duration  float64
+      byteRange string
+      time      float64
+   )
+   // the end of the last byte range of each URI, where a range without an
+   // offset starts
+   next := map[string]int64{}
+   resolve := func(uri, byteRange string) (Segment, error) {
+      location, err := location.Parse(uri)
+      if err != nil {
+         return Segment{}, fmt.Errorf("URI %q: %w", uri, err)
+      }
+      segment := Segment{URL: location.String()}
+      if byteRange != "" {
+         size, offset, found := strings.Cut(byteRange, "@")
+         segment.Size, err = strconv.ParseInt(size, 10, 64)
+         if err != nil {
+            return Segment{}, fmt.Errorf("invalid byte range %q", byteRange)
+         }
+         segment.Start = next[segment.URL]
+         if found {
+            segment.Start, err = strconv.ParseInt(offset, 10, 64)
+            if err != nil {
+               return Segment{}, fmt.Errorf("invalid byte range %q", byteRange)
+            }
+         }
+         next[segment.URL] = segment.Start + segment.Size
+      }
+      return segment, nil
+   }
+   for line := range strings.Lines(text) {
+      line = strings.TrimSpace(line)
+      tag, value, _ := strings.Cut(line, ":")
+      switch {
+      case line == "":
+      case tag == "#EXT-X-STREAM-INF":
+         return Segment{}, nil, errors.New("multivariant playlist, not a media playlist")
+      case tag == "#EXT-X-MAP":
+         attributes := parseAttributes(value)
+         segment, err := resolve(attributes["URI"], attributes["BYTERANGE"])
+         if err != nil {
+            return Segment{}, nil, err
+         }
+         if init != nil && *init != segment {
+            return Segment{}, nil, errors.New("more than one EXT-X-MAP")
+         }
+         init = &segment
+      case tag == "#EXTINF":
+         seconds, _, _ := strings.Cut(value, ",")
+         var err error
+         duration, err = strconv.ParseFloat(seconds, 64)
+         if err != nil {
+            return Segment{}, nil, fmt.Errorf("invalid EXTINF %q", value)
+         }
+      case tag == "#EXT-X-BYTERANGE":
+         byteRange = value
+      case strings.HasPrefix(line, "#"):
+      default:
+         segment, err := resolve(line, byteRange)
+         if err != nil {
+            return Segment{}, nil, err
+         }
+         // in milliseconds, as the playlist has no timescale
+         segment.Time = uint64(math.Round(time * 1000))
+         segment.Duration = uint64(math.Round(duration * 1000))
+         segments = append(segments, segment)
+         time += duration
+         byteRange = ""
+      }
+   }
+   if init == nil {
+      return Segment{}, nil, errors.New("playlist has no EXT-X-MAP")
+   }
+   return *init, segments, nil
+}
+
+// parseAttributes parses an attribute list such as `URI="a.mp4",X=1`.
+func parseAttributes(list string) map[string]string {
+   attributes := map[string]string{}
+   for list != "" {
+      name, rest, found := strings.Cut(list, "=")
+      if !found {
+         break
+      }
+      var value string
+      if strings.HasPrefix(rest, `"`) {
+         value, rest, _ = strings.Cut(rest[1:], `"`)
+         rest = strings.TrimPrefix(rest, ",")
+      } else {
+         value, rest, _ = strings.Cut(rest, ",")
+      }
+      attributes[strings.TrimSpace(name)] = value
+      list = rest
+   }
+   return attributes
+}
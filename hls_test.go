@@ -0,0 +1,27 @@
+// hls_test.go
+package sofia
+
+import (
+   "bytes"
+   "strings"
+   "testing"
+)
+
+func TestWriteMultivariantPlaylistSubtitles(t *testing.T) {
+   tracks := testSubtitleTracks(t)
+   // a track with no language
+   tracks[2].Moov.Trak[0].Mdia.Mdhd.Language = [2]byte{}
+   var b bytes.Buffer
+   if err := WriteMultivariantPlaylist(&b, tracks); err != nil {
+      t.Fatal(err)
+   }
+   for _, want := range []string{
+      `#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="wvtt",LANGUAGE="eng",DEFAULT=YES,AUTOSELECT=YES,URI="wvtt.m3u8"`,
+      `#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="stpp",DEFAULT=NO,AUTOSELECT=YES,URI="stpp.m3u8"`,
+      `SUBTITLES="subs"`,
+   } {
+      if !strings.Contains(b.String(), want) {
+         t.Errorf("playlist has no %s:\n%s", want, b.String())
+      }
+   }
+}
@@ -0,0 +1,267 @@
+// index.go
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+)
+
+// sampleIndex holds the sample tables of a remux as they grow. stts, ctts,
+// stss and stsc are kept run-length encoded as samples are added, and the
+// sample sizes as uvarints, so that a sample costs a few bytes instead of
+// a RemuxSample.
+type sampleIndex struct {
+   count        uint32
+   duration     uint64
+   stts         []SttsEntry
+   ctts         []CttsEntry
+   sync         []uint32 // sample numbers, once some sample is not sync
+   someNotSync  bool
+   stsc         []StscEntry
+   chunkOffsets []uint64
+   sizes        []byte // uvarints, once the sizes differ
+   firstSize    uint32
+   sizesDiffer  bool
+}
+
+func (x *sampleIndex) add(sample RemuxSample) {
+   x.count++
+   x.duration += uint64(sample.Duration)
+
+   if last := len(x.stts) - 1; last >= 0 && x.stts[last].SampleDuration == sample.Duration {
+      x.stts[last].SampleCount++
+   } else {
+      x.stts = append(x.stts, SttsEntry{1, sample.Duration})
+   }
+   if last := len(x.ctts) - 1; last >= 0 && x.ctts[last].SampleOffset == sample.CompositionTimeOffset {
+      x.ctts[last].SampleCount++
+   } else {
+      x.ctts = append(x.ctts, CttsEntry{1, sample.CompositionTimeOffset})
+   }
+
+   switch {
+   case !sample.IsSync && !x.someNotSync:
+      // every sample so far was sync
+      x.someNotSync = true
+      x.sync = make([]uint32, x.count-1)
+      for i := range x.sync {
+         x.sync[i] = uint32(i + 1)
+      }
+   case sample.IsSync && x.someNotSync:
+      x.sync = append(x.sync, x.count)
+   }
+
+   switch {
+   case x.count == 1:
+      x.firstSize = sample.Size
+   case !x.sizesDiffer && sample.Size != x.firstSize:
+      x.sizesDiffer = true
+      for range x.count - 1 {
+         x.sizes = binary.AppendUvarint(x.sizes, uint64(x.firstSize))
+      }
+   }
+   if x.sizesDiffer {
+      x.sizes = binary.AppendUvarint(x.sizes, uint64(sample.Size))
+   }
+}
+
+// minOffset returns the smallest composition offset, or 0 if there are
+// no samples.
+func (x *sampleIndex) minOffset() int64 {
+   if len(x.ctts) == 0 {
+      return 0
+   }
+   offset := x.ctts[0].SampleOffset
+   for _, entry := range x.ctts[1:] {
+      offset = min(offset, entry.SampleOffset)
+   }
+   return int64(offset)
+}
+
+// addChunk records a chunk of the last samples added.
+func (x *sampleIndex) addChunk(offset uint64, samples, description uint32) {
+   chunk := uint32(len(x.chunkOffsets)) + 1
+   x.chunkOffsets = append(x.chunkOffsets, offset)
+   if last := len(x.stsc) - 1; last >= 0 {
+      entry := x.stsc[last]
+      if entry.SamplesPerChunk == samples && entry.SampleDescriptionIndex == description {
+         return
+      }
+   }
+   x.stsc = append(x.stsc, StscEntry{chunk, samples, description})
+}
+
+func (x *sampleIndex) buildStts() []byte {
+   if x.count == 0 {
+      return nil
+   }
+   box := SttsBox{Header: &BoxHeader{}, Entries: x.stts}
+   return box.Encode()
+}
+
+func (x *sampleIndex) buildCtts() []byte {
+   if len(x.ctts) == 0 || len(x.ctts) == 1 && x.ctts[0].SampleOffset == 0 {
+      return nil // No ctts box needed if all offsets are 0
+   }
+   box := CttsBox{Header: &BoxHeader{}, Entries: x.ctts}
+   return box.Encode()
+}
+
+func (x *sampleIndex) buildStss() []byte {
+   if !x.someNotSync {
+      return nil
+   }
+   box := StssBox{Header: &BoxHeader{}, Indices: x.sync}
+   return box.Encode()
+}
+
+func (x *sampleIndex) buildStsc() []byte {
+   box := StscBox{Header: &BoxHeader{}, Entries: x.stsc}
+   return box.Encode()
+}
+
+// buildStsz uses a single sample size when there is one.
+func (x *sampleIndex) buildStsz() []byte {
+   box := StszBox{Header: &BoxHeader{}, SampleCount: x.count}
+   if !x.sizesDiffer {
+      box.SampleSize = x.firstSize
+      return box.Encode()
+   }
+   box.EntrySizes = make([]uint32, 0, x.count)
+   for sizes := x.sizes; len(sizes) > 0; {
+      size, n := binary.Uvarint(sizes)
+      box.EntrySizes = append(box.EntrySizes, uint32(size))
+      sizes = sizes[n:]
+   }
+   return box.Encode()
+}
+
+// append serializes the index as uvarints, for a checkpoint.
+func (x *sampleIndex) append(buffer []byte) []byte {
+   buffer = binary.AppendUvarint(buffer, uint64(x.count))
+   buffer = binary.AppendUvarint(buffer, x.duration)
+   buffer = binary.AppendUvarint(buffer, uint64(len(x.stts)))
+   for _, entry := range x.stts {
+      buffer = binary.AppendUvarint(buffer, uint64(entry.SampleCount))
+      buffer = binary.AppendUvarint(buffer, uint64(entry.SampleDuration))
+   }
+   buffer = binary.AppendUvarint(buffer, uint64(len(x.ctts)))
+   for _, entry := range x.ctts {
+      buffer = binary.AppendUvarint(buffer, uint64(entry.SampleCount))
+      buffer = binary.AppendVarint(buffer, int64(entry.SampleOffset))
+   }
+   buffer = appendBool(buffer, x.someNotSync)
+   buffer = binary.AppendUvarint(buffer, uint64(len(x.sync)))
+   for _, number := range x.sync {
+      buffer = binary.AppendUvarint(buffer, uint64(number))
+   }
+   buffer = binary.AppendUvarint(buffer, uint64(len(x.stsc)))
+   for _, entry := range x.stsc {
+      buffer = binary.AppendUvarint(buffer, uint64(entry.FirstChunk))
+      buffer = binary.AppendUvarint(buffer, uint64(entry.SamplesPerChunk))
+      buffer = binary.AppendUvarint(buffer, uint64(entry.SampleDescriptionIndex))
+   }
+   buffer = binary.AppendUvarint(buffer, uint64(len(x.chunkOffsets)))
+   for _, offset := range x.chunkOffsets {
+      buffer = binary.AppendUvarint(buffer, offset)
+   }
+   buffer = binary.AppendUvarint(buffer, uint64(x.firstSize))
+   buffer = appendBool(buffer, x.sizesDiffer)
+   buffer = binary.AppendUvarint(buffer, uint64(len(x.sizes)))
+   return append(buffer, x.sizes...)
+}
+
+// decode is the inverse of append.
+func (x *sampleIndex) decode(v *varintReader) error {
+   x.count = uint32(v.uvarint())
+   x.duration = v.uvarint()
+   x.stts = make([]SttsEntry, v.length(2))
+   for i := range x.stts {
+      x.stts[i] = SttsEntry{uint32(v.uvarint()), uint32(v.uvarint())}
+   }
+   x.ctts = make([]CttsEntry, v.length(2))
+   for i := range x.ctts {
+      x.ctts[i] = CttsEntry{uint32(v.uvarint()), int32(v.varint())}
+   }
+   x.someNotSync = v.uvarint() == 1
+   x.sync = make([]uint32, v.length(1))
+   for i := range x.sync {
+      x.sync[i] = uint32(v.uvarint())
+   }
+   x.stsc = make([]StscEntry, v.length(3))
+   for i := range x.stsc {
+      x.stsc[i] = StscEntry{
+         uint32(v.uvarint()), uint32(v.uvarint()), uint32(v.uvarint()),
+      }
+   }
+   x.chunkOffsets = make([]uint64, v.length(1))
+   for i := range x.chunkOffsets {
+      x.chunkOffsets[i] = v.uvarint()
+   }
+   x.firstSize = uint32(v.uvarint())
+   x.sizesDiffer = v.uvarint() == 1
+   x.sizes = v.bytes(v.length(1))
+   return v.err
+}
+
+func appendBool(buffer []byte, value bool) []byte {
+   if value {
+      return append(buffer, 1)
+   }
+   return append(buffer, 0)
+}
+
+// varintReader reads uvarints, varints and bytes, keeping the first error.
+type varintReader struct {
+   data []byte
+   err  error
+}
+
+var errVarintTruncated = errors.New("truncated varint data")
+
+func (v *varintReader) uvarint() uint64 {
+   if v.err != nil {
+      return 0
+   }
+   value, n := binary.Uvarint(v.data)
+   if n <= 0 {
+      v.err = errVarintTruncated
+      return 0
+   }
+   v.data = v.data[n:]
+   return value
+}
+
+func (v *varintReader) varint() int64 {
+   if v.err != nil {
+      return 0
+   }
+   value, n := binary.Varint(v.data)
+   if n <= 0 {
+      v.err = errVarintTruncated
+      return 0
+   }
+   v.data = v.data[n:]
+   return value
+}
+
+// length reads a count of items that take at least minSize bytes each,
+// checking that the data can hold them.
+func (v *varintReader) length(minSize int) int {
+   count := v.uvarint()
+   if count > uint64(len(v.data)/minSize) {
+      v.err = errVarintTruncated
+      return 0
+   }
+   return int(count)
+}
+
+func (v *varintReader) bytes(n int) []byte {
+   if v.err != nil || len(v.data) < n {
+      v.err = errVarintTruncated
+      return nil
+   }
+   data := v.data[:n]
+   v.data = v.data[n:]
+   return data
+}
@@ -0,0 +1,58 @@
+// index_test.go
+package sofia
+
+import (
+   "testing"
+   "unsafe"
+)
+
+// footprint is the memory held by the tables of x.
+func (x *sampleIndex) footprint() int {
+   return cap(x.stts)*int(unsafe.Sizeof(SttsEntry{})) +
+      cap(x.ctts)*int(unsafe.Sizeof(CttsEntry{})) +
+      cap(x.sync)*4 +
+      cap(x.stsc)*int(unsafe.Sizeof(StscEntry{})) +
+      cap(x.chunkOffsets)*8 +
+      cap(x.sizes)
+}
+
+// BenchmarkSampleIndex reports the memory the tables of an hour of content
+// take, in 2 second segments of one chunk each.
+func BenchmarkSampleIndex(b *testing.B) {
+   for _, track := range []struct {
+      name        string
+      rate        int // samples per second
+      gop         int // samples from one sync sample to the next
+      reordered   bool
+      averageSize uint32
+   }{
+      {"video", 30, 60, true, 20_000},
+      {"audio", 50, 1, false, 400},
+   } {
+      b.Run(track.name, func(b *testing.B) {
+         var x sampleIndex
+         for b.Loop() {
+            x = sampleIndex{}
+            var offset uint64
+            for segment := range 3600 / 2 {
+               samples := 2 * track.rate
+               for i := range samples {
+                  n := segment*samples + i
+                  sample := RemuxSample{
+                     Size:     track.averageSize + uint32(n*7919%1000),
+                     Duration: uint32(90000 / track.rate),
+                     IsSync:   n%track.gop == 0,
+                  }
+                  if track.reordered && n%2 == 1 {
+                     sample.CompositionTimeOffset = int32(sample.Duration)
+                  }
+                  x.add(sample)
+                  offset += uint64(sample.Size)
+               }
+               x.addChunk(offset, uint32(samples), 1)
+            }
+         }
+         b.ReportMetric(float64(x.footprint()), "bytes/hour")
+      })
+   }
+}
@@ -0,0 +1,195 @@
+// manifest.go
+package sofia
+
+import (
+   "errors"
+   "fmt"
+   "strconv"
+)
+
+// Track is one rendition of a track, as described in a DASH or HLS
+// manifest. Only the first trak of Moov is described. Media is addressed
+// either as a single file, through URL and the byte ranges of Segments, or
+// as a file per segment.
+type Track struct {
+   ID   string // defaults to the position of the track
+   Moov *MoovBox
+   // single file addressing
+   URL        string
+   InitRange  [2]int64 // first and last byte of ftyp and moov
+   IndexRange [2]int64 // first and last byte of the sidx, if any
+   // file per segment addressing
+   Initialization string // URL of the init segment
+   Media          string // DASH SegmentTemplate media URL, such as "$Time$.m4s"
+   Segments       []Segment
+   // HLS
+   Playlist string // URI of the media playlist
+   KeyURI   string // EXT-X-KEY URI for cbcs, such as skd:// for FairPlay
+   // Bandwidth is in bits per second. If zero, it is the peak bit rate of
+   // Segments.
+   Bandwidth uint64
+}
+
+// Segment is a media segment. Time and Duration are in the timescale of
+// the track.
+type Segment struct {
+   URL      string // for file per segment addressing in HLS
+   Start    int64  // byte offset in the file, for single file addressing
+   Size     int64
+   Time     uint64
+   Duration uint64
+}
+
+// DecodeSegment describes a media segment from its moof boxes: Time is the
+// tfdt of the first, and Duration is the sum of the sample durations.
+func DecodeSegment(data []byte) (Segment, error) {
+   segment := Segment{Size: int64(len(data))}
+   boxes, err := DecodeBoxes(data)
+   if err != nil {
+      return segment, err
+   }
+   first := true
+   for _, box := range boxes {
+      if box.Moof == nil || box.Moof.Traf == nil || box.Moof.Traf.Tfhd == nil {
+         continue
+      }
+      traf := box.Moof.Traf
+      if first {
+         if traf.Tfdt == nil {
+            return segment, errors.New("segment has no tfdt")
+         }
+         segment.Time = traf.Tfdt.BaseMediaDecodeTime
+         first = false
+      }
+      for _, sample := range traf.samples() {
+         segment.Duration += uint64(sample.Duration)
+      }
+   }
+   if first {
+      return segment, errors.New("segment has no moof")
+   }
+   return segment, nil
+}
+
+// Segments converts byte ranges from a sidx into segments of the file at
+// url.
+func Segments(url string, ranges []ByteRange) []Segment {
+   segments := make([]Segment, len(ranges))
+   for i, byteRange := range ranges {
+      segments[i] = Segment{
+         URL:      url,
+         Start:    byteRange.Start,
+         Size:     byteRange.Size,
+         Time:     byteRange.Time,
+         Duration: byteRange.Duration,
+      }
+   }
+   return segments
+}
+
+// trackInfo is what the manifests need to know about a Track.
+type trackInfo struct {
+   handler    string
+   language   string
+   timescale  uint32
+   duration   uint64
+   codec      string
+   width      uint32
+   height     uint32
+   sampleRate uint32
+   channels   uint16
+   bandwidth  uint64
+   scheme     string // cenc or cbcs, if protected
+   kid        [16]byte
+}
+
+func (t *Track) info() (*trackInfo, error) {
+   if t.Moov == nil || len(t.Moov.Trak) == 0 {
+      return nil, errors.New("track has no trak")
+   }
+   trak := t.Moov.Trak[0]
+   if trak.Mdia == nil || trak.Mdia.Mdhd == nil {
+      return nil, errors.New("track has no mdhd")
+   }
+   if trak.Mdia.Minf == nil || trak.Mdia.Minf.Stbl == nil || trak.Mdia.Minf.Stbl.Stsd == nil {
+      return nil, errors.New("track has no stsd")
+   }
+   stsd := trak.Mdia.Minf.Stbl.Stsd
+   info := &trackInfo{
+      handler:   trak.HandlerType(),
+      language:  trak.Mdia.Language(),
+      timescale: trak.Mdia.Mdhd.Timescale,
+      duration:  trak.Mdia.Mdhd.Duration,
+   }
+   var err error
+   info.codec, err = stsd.Codec()
+   if err != nil {
+      return nil, err
+   }
+
+   var entry *SampleEntry
+   switch first := stsd.children()[0]; {
+   case first.enc != nil:
+      entry = &first.enc.SampleEntry
+   case first.entry != nil:
+      entry = &first.entry.SampleEntry
+   }
+   if tkhd := trak.Tkhd; tkhd != nil && tkhd.Width != 0 {
+      info.width, info.height = tkhd.Width>>16, tkhd.Height>>16
+   } else if entry != nil && entry.Visual != nil {
+      info.width, info.height = uint32(entry.Visual.Width), uint32(entry.Visual.Height)
+   }
+   if entry != nil && entry.Audio != nil {
+      info.sampleRate = entry.Audio.Hz()
+      info.channels = entry.Audio.ChannelCount
+   }
+
+   if sinf, _, ok := stsd.Sinf(); ok {
+      info.scheme = "cenc"
+      if sinf.Schm != nil {
+         info.scheme = string(sinf.Schm.SchemeType[:])
+      }
+      if sinf.Schi != nil && sinf.Schi.Tenc != nil {
+         info.kid = sinf.Schi.Tenc.DefaultKID
+      }
+   }
+
+   if len(t.Segments) > 0 {
+      info.duration = 0
+      for _, segment := range t.Segments {
+         info.duration += segment.Duration
+      }
+   }
+   info.bandwidth = t.Bandwidth
+   if info.bandwidth == 0 {
+      for _, segment := range t.Segments {
+         if segment.Duration == 0 {
+            continue
+         }
+         bandwidth := uint64(segment.Size) * 8 * uint64(info.timescale) / segment.Duration
+         info.bandwidth = max(info.bandwidth, bandwidth)
+      }
+   }
+   return info, nil
+}
+
+// name is the ID of the track, which is at position i.
+func (t *Track) name(i int) string {
+   if t.ID != "" {
+      return t.ID
+   }
+   return strconv.Itoa(i)
+}
+
+// seconds converts a duration in the track timescale.
+func (i *trackInfo) seconds(duration uint64) float64 {
+   if i.timescale == 0 {
+      return 0
+   }
+   return float64(duration) / float64(i.timescale)
+}
+
+// byteRange formats a first and last byte as "first-last".
+func byteRange(r [2]int64) string {
+   return fmt.Sprintf("%d-%d", r[0], r[1])
+}
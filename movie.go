@@ -1,10 +1,7 @@
 // movie.go
 package sofia
 
-import (
-   "bytes"
-   "errors"
-)
+import "bytes"
 
 // --- MOOV ---
 type MoovBox struct {
@@ -12,10 +9,16 @@ type MoovBox struct {
    Mvhd        *MvhdBox
    Trak        []*TrakBox
    Pssh        []*PsshBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeMoovBox(data []byte) (*MoovBox, error) {
+   var d decoder
+   return d.moov(data)
+}
+
+func (d *decoder) moov(data []byte) (*MoovBox, error) {
    b := &MoovBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -23,45 +26,35 @@ func DecodeMoovBox(data []byte) (*MoovBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "mvhd":
          mvhd, err := DecodeMvhdBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Mvhd = mvhd
       case "trak":
-         trak, err := DecodeTrakBox(content)
+         trak, err := d.trak(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Trak = append(b.Trak, trak)
       case "pssh":
          pssh, err := DecodePsshBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Pssh = append(b.Pssh, pssh)
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("moov", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
@@ -74,10 +67,10 @@ func (b *MoovBox) Encode() []byte {
    for _, trak := range b.Trak {
       buffer = append(buffer, trak.Encode()...)
    }
-   // pssh is skipped on encode
-   for _, raw := range b.RawChildren {
-      buffer = append(buffer, raw...)
+   for _, pssh := range b.Pssh {
+      buffer = append(buffer, pssh.Encode()...)
    }
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
    b.Header.Size = uint32(len(buffer))
    b.Header.Put(buffer)
    return buffer
@@ -93,6 +86,14 @@ func (b *MoovBox) FindPssh(systemID []byte) (*PsshBox, bool) {
 }
 
 func (b *MoovBox) RemoveMvex() {
+   var keptCustom []*CustomBox
+   for _, custom := range b.Custom {
+      if custom.Type() == "mvex" {
+         continue
+      }
+      keptCustom = append(keptCustom, custom)
+   }
+   b.Custom = keptCustom
    var kept [][]byte
    for _, child := range b.RawChildren {
       if len(child) >= 8 && string(child[4:8]) == "mvex" {
@@ -107,6 +108,30 @@ func (b *MoovBox) RemovePssh() {
    b.Pssh = nil
 }
 
+// AddPssh appends pssh, keeping any others of the same system.
+func (b *MoovBox) AddPssh(pssh *PsshBox) {
+   b.Pssh = append(b.Pssh, pssh)
+}
+
+// SetPssh replaces the pssh boxes of the system of pssh with pssh, or
+// appends it if there are none.
+func (b *MoovBox) SetPssh(pssh *PsshBox) {
+   var kept []*PsshBox
+   replaced := false
+   for _, old := range b.Pssh {
+      if old.SystemID != pssh.SystemID {
+         kept = append(kept, old)
+      } else if !replaced {
+         kept = append(kept, pssh)
+         replaced = true
+      }
+   }
+   if !replaced {
+      kept = append(kept, pssh)
+   }
+   b.Pssh = kept
+}
+
 // --- MVHD ---
 type MvhdBox struct {
    Header           *BoxHeader
@@ -128,7 +153,7 @@ func DecodeMvhdBox(data []byte) (*MvhdBox, error) {
    }
 
    if len(data) < 12 {
-      return nil, errors.New("mvhd box too small")
+      return nil, sizeError("mvhd box too small", 12, len(data))
    }
 
    p := parser{data: data, offset: 8}
@@ -138,7 +163,7 @@ func DecodeMvhdBox(data []byte) (*MvhdBox, error) {
 
    if b.Version == 1 {
       if len(data) < 40 { // 8 header + 4 version/flags + 28 v1 body
-         return nil, errors.New("mvhd v1 too short")
+         return nil, sizeError("mvhd v1 too short", 40, len(data))
       }
       b.CreationTime = p.Uint64()
       b.ModificationTime = p.Uint64()
@@ -146,7 +171,7 @@ func DecodeMvhdBox(data []byte) (*MvhdBox, error) {
       b.Duration = p.Uint64()
    } else { // Version 0
       if len(data) < 28 { // 8 header + 4 version/flags + 16 v0 body
-         return nil, errors.New("mvhd v0 too short")
+         return nil, sizeError("mvhd v0 too short", 28, len(data))
       }
       b.CreationTime = uint64(p.Uint32())
       b.ModificationTime = uint64(p.Uint32())
@@ -154,7 +179,7 @@ func DecodeMvhdBox(data []byte) (*MvhdBox, error) {
       b.Duration = uint64(p.Uint32())
    }
 
-   b.RemainingData = data[p.offset:b.Header.Size]
+   b.RemainingData = data[p.offset:b.Header.end(data)]
    return b, nil
 }
 
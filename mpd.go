@@ -0,0 +1,539 @@
+// mpd.go
+package sofia
+
+import (
+   "cmp"
+   "encoding/base64"
+   "encoding/xml"
+   "errors"
+   "fmt"
+   "io"
+   "math"
+   "net/url"
+   "regexp"
+   "strconv"
+   "strings"
+)
+
+type mpd struct {
+   XMLName                   xml.Name        `xml:"MPD"`
+   Xmlns                     string          `xml:"xmlns,attr"`
+   XmlnsCenc                 string          `xml:"xmlns:cenc,attr"`
+   Profiles                  string          `xml:"profiles,attr"`
+   Type                      string          `xml:"type,attr"`
+   MediaPresentationDuration string          `xml:"mediaPresentationDuration,attr"`
+   MinBufferTime             string          `xml:"minBufferTime,attr"`
+   AdaptationSets            []adaptationSet `xml:"Period>AdaptationSet"`
+}
+
+type adaptationSet struct {
+   ContentType      string           `xml:"contentType,attr,omitempty"`
+   MimeType         string           `xml:"mimeType,attr"`
+   Lang             string           `xml:"lang,attr,omitempty"`
+   SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+   Representations  []representation `xml:"Representation"`
+}
+
+type representation struct {
+   ID                string              `xml:"id,attr"`
+   Bandwidth         uint64              `xml:"bandwidth,attr"`
+   Codecs            string              `xml:"codecs,attr"`
+   Width             uint32              `xml:"width,attr,omitempty"`
+   Height            uint32              `xml:"height,attr,omitempty"`
+   AudioSamplingRate uint32              `xml:"audioSamplingRate,attr,omitempty"`
+   ContentProtection []contentProtection `xml:"ContentProtection"`
+   BaseURL           string              `xml:"BaseURL,omitempty"`
+   SegmentBase       *segmentBase        `xml:"SegmentBase"`
+   SegmentTemplate   *segmentTemplate    `xml:"SegmentTemplate"`
+}
+
+type contentProtection struct {
+   SchemeIDURI string `xml:"schemeIdUri,attr"`
+   Value       string `xml:"value,attr,omitempty"`
+   DefaultKID  string `xml:"cenc:default_KID,attr,omitempty"`
+   Pssh        string `xml:"cenc:pssh,omitempty"`
+}
+
+type segmentBase struct {
+   Timescale      uint32 `xml:"timescale,attr"`
+   IndexRange     string `xml:"indexRange,attr,omitempty"`
+   Initialization struct {
+      Range string `xml:"range,attr"`
+   } `xml:"Initialization"`
+}
+
+type segmentTemplate struct {
+   Timescale      uint32            `xml:"timescale,attr"`
+   Initialization string            `xml:"initialization,attr"`
+   Media          string            `xml:"media,attr"`
+   StartNumber    int               `xml:"startNumber,attr"`
+   Timeline       []timelineSegment `xml:"SegmentTimeline>S"`
+}
+
+type timelineSegment struct {
+   T uint64 `xml:"t,attr,omitempty"`
+   D uint64 `xml:"d,attr"`
+   R int    `xml:"r,attr,omitempty"`
+}
+
+// WriteMPD writes a static DASH MPD describing tracks, in a single period.
+// Tracks with the same handler type and language share an AdaptationSet.
+// A track with Media is described with a SegmentTemplate and a
+// SegmentTimeline built from its Segments; any other is a single file at
+// URL, described with a SegmentBase.
+func WriteMPD(w io.Writer, tracks []Track) error {
+   m := mpd{
+      Xmlns:         "urn:mpeg:dash:schema:mpd:2011",
+      XmlnsCenc:     "urn:mpeg:cenc:2013",
+      Profiles:      "urn:mpeg:dash:profile:isoff-on-demand:2011",
+      Type:          "static",
+      MinBufferTime: "PT2S",
+   }
+   var duration float64
+   sets := map[string]int{} // handler type and language to AdaptationSet
+   for i := range tracks {
+      track := &tracks[i]
+      info, err := track.info()
+      if err != nil {
+         return fmt.Errorf("track %d: %w", i, err)
+      }
+      duration = max(duration, info.seconds(info.duration))
+
+      key := info.handler + "/" + info.language
+      set, ok := sets[key]
+      if !ok {
+         set = len(m.AdaptationSets)
+         sets[key] = set
+         m.AdaptationSets = append(m.AdaptationSets, newAdaptationSet(info))
+      }
+      rep := representation{
+         ID:                track.name(i),
+         Bandwidth:         info.bandwidth,
+         Codecs:            info.codec,
+         Width:             info.width,
+         Height:            info.height,
+         AudioSamplingRate: info.sampleRate,
+         ContentProtection: track.contentProtection(info),
+      }
+      if track.Media != "" {
+         m.Profiles = "urn:mpeg:dash:profile:isoff-live:2011"
+         rep.SegmentTemplate = track.segmentTemplate(info)
+      } else {
+         rep.BaseURL = track.URL
+         rep.SegmentBase = &segmentBase{Timescale: info.timescale}
+         rep.SegmentBase.Initialization.Range = byteRange(track.InitRange)
+         if track.IndexRange[1] > 0 {
+            rep.SegmentBase.IndexRange = byteRange(track.IndexRange)
+         }
+      }
+      m.AdaptationSets[set].Representations = append(
+         m.AdaptationSets[set].Representations, rep,
+      )
+   }
+   m.MediaPresentationDuration = fmt.Sprintf("PT%.3fS", duration)
+
+   if _, err := io.WriteString(w, xml.Header); err != nil {
+      return err
+   }
+   encoder := xml.NewEncoder(w)
+   encoder.Indent("", " ")
+   if err := encoder.Encode(m); err != nil {
+      return err
+   }
+   _, err := io.WriteString(w, "\n")
+   return err
+}
+
+func newAdaptationSet(info *trackInfo) adaptationSet {
+   set := adaptationSet{SegmentAlignment: true}
+   switch info.handler {
+   case "vide":
+      set.ContentType, set.MimeType = "video", "video/mp4"
+   case "soun":
+      set.ContentType, set.MimeType = "audio", "audio/mp4"
+   case "text", "subt", "sbtl":
+      set.ContentType, set.MimeType = "text", "application/mp4"
+   default:
+      set.MimeType = "application/mp4"
+   }
+   if info.language != "und" {
+      set.Lang = info.language
+   }
+   return set
+}
+
+// contentProtection signals the protection scheme with the default KID of
+// tenc, followed by an element for each pssh of the track.
+func (t *Track) contentProtection(info *trackInfo) []contentProtection {
+   if info.scheme == "" {
+      return nil
+   }
+   elements := []contentProtection{{
+      SchemeIDURI: "urn:mpeg:dash:mp4protection:2011",
+      Value:       info.scheme,
+      DefaultKID:  FormatUUID(info.kid),
+   }}
+   for _, pssh := range t.Moov.Pssh {
+      elements = append(elements, contentProtection{
+         SchemeIDURI: "urn:uuid:" + FormatUUID(pssh.SystemID),
+         Pssh:        base64.StdEncoding.EncodeToString(pssh.Encode()),
+      })
+   }
+   return elements
+}
+
+// segmentTemplate runs together consecutive segments of equal duration.
+func (t *Track) segmentTemplate(info *trackInfo) *segmentTemplate {
+   template := &segmentTemplate{
+      Timescale:      info.timescale,
+      Initialization: t.Initialization,
+      Media:          t.Media,
+      StartNumber:    1,
+   }
+   var next uint64
+   for i, segment := range t.Segments {
+      last := len(template.Timeline) - 1
+      if i > 0 && segment.Time == next && template.Timeline[last].D == segment.Duration {
+         template.Timeline[last].R++
+      } else {
+         template.Timeline = append(template.Timeline, timelineSegment{
+            T: segment.Time, D: segment.Duration,
+         })
+      }
+      next = segment.Time + segment.Duration
+   }
+   return template
+}
+
+// the parts of an MPD needed to locate the segments of a Representation
+type mpdDocument struct {
+   BaseURL                   string `xml:"BaseURL"`
+   MediaPresentationDuration string `xml:"mediaPresentationDuration,attr"`
+   Periods                   []struct {
+      BaseURL        string `xml:"BaseURL"`
+      Duration       string `xml:"duration,attr"`
+      AdaptationSets []struct {
+         BaseURL string `xml:"BaseURL"`
+         mpdSegmentInfo
+         Representations []struct {
+            ID        string `xml:"id,attr"`
+            Bandwidth uint64 `xml:"bandwidth,attr"`
+            BaseURL   string `xml:"BaseURL"`
+            mpdSegmentInfo
+         } `xml:"Representation"`
+      } `xml:"AdaptationSet"`
+   } `xml:"Period"`
+}
+
+type mpdSegmentInfo struct {
+   SegmentBase     *mpdSegmentBase     `xml:"SegmentBase"`
+   SegmentList     *mpdSegmentList     `xml:"SegmentList"`
+   SegmentTemplate *mpdSegmentTemplate `xml:"SegmentTemplate"`
+}
+
+type mpdURL struct {
+   SourceURL string `xml:"sourceURL,attr"`
+   Range     string `xml:"range,attr"`
+}
+
+type mpdSegmentBase struct {
+   IndexRange     string  `xml:"indexRange,attr"`
+   Initialization *mpdURL `xml:"Initialization"`
+}
+
+type mpdSegmentList struct {
+   Timescale      uint32          `xml:"timescale,attr"`
+   Duration       uint64          `xml:"duration,attr"`
+   Initialization *mpdURL         `xml:"Initialization"`
+   SegmentURLs    []mpdSegmentURL `xml:"SegmentURL"`
+}
+
+type mpdSegmentURL struct {
+   Media      string `xml:"media,attr"`
+   MediaRange string `xml:"mediaRange,attr"`
+}
+
+type mpdSegmentTemplate struct {
+   Timescale      uint32  `xml:"timescale,attr"`
+   Duration       uint64  `xml:"duration,attr"`
+   StartNumber    *uint64 `xml:"startNumber,attr"`
+   Initialization string  `xml:"initialization,attr"`
+   Media          string  `xml:"media,attr"`
+   Timeline       []struct {
+      T *uint64 `xml:"t,attr"`
+      D uint64  `xml:"d,attr"`
+      R int64   `xml:"r,attr"`
+   } `xml:"SegmentTimeline>S"`
+}
+
+// representation of an MPD, with its BaseURL resolved and the segment
+// information it inherits
+type mpdRepresentation struct {
+   id        string
+   bandwidth uint64
+   baseURL   string
+   duration  float64 // of the period, in seconds
+   base      *mpdSegmentBase
+   list      *mpdSegmentList
+   template  *mpdSegmentTemplate
+}
+
+func findRepresentation(data []byte, location *url.URL, id string) (*mpdRepresentation, error) {
+   var document mpdDocument
+   if err := xml.Unmarshal(data, &document); err != nil {
+      return nil, fmt.Errorf("parsing MPD: %w", err)
+   }
+   for _, period := range document.Periods {
+      for _, set := range period.AdaptationSets {
+         for _, rep := range set.Representations {
+            if rep.ID != id {
+               continue
+            }
+            found := &mpdRepresentation{id: rep.ID, bandwidth: rep.Bandwidth}
+            base := location
+            for _, ref := range []string{
+               document.BaseURL, period.BaseURL, set.BaseURL, rep.BaseURL,
+            } {
+               ref = strings.TrimSpace(ref)
+               if ref == "" {
+                  continue
+               }
+               next, err := base.Parse(ref)
+               if err != nil {
+                  return nil, fmt.Errorf("BaseURL %q: %w", ref, err)
+               }
+               base = next
+            }
+            found.baseURL = base.String()
+            duration := period.Duration
+            if duration == "" {
+               duration = document.MediaPresentationDuration
+            }
+            if duration != "" {
+               var err error
+               found.duration, err = parseDuration(duration)
+               if err != nil {
+                  return nil, err
+               }
+            }
+            found.base = cmp.Or(rep.SegmentBase, set.SegmentBase)
+            found.list = cmp.Or(rep.SegmentList, set.SegmentList)
+            found.template = mergeTemplate(set.SegmentTemplate, rep.SegmentTemplate)
+            if found.template == nil && found.list == nil && found.base == nil {
+               // a single segment at BaseURL
+               found.list = &mpdSegmentList{SegmentURLs: []mpdSegmentURL{{}}}
+            }
+            return found, nil
+         }
+      }
+   }
+   return nil, fmt.Errorf("MPD has no Representation %q", id)
+}
+
+// mergeTemplate gives the attributes of child precedence over those of
+// parent.
+func mergeTemplate(parent, child *mpdSegmentTemplate) *mpdSegmentTemplate {
+   if parent == nil || child == nil {
+      return cmp.Or(child, parent)
+   }
+   merged := *parent
+   merged.Timescale = cmp.Or(child.Timescale, parent.Timescale)
+   merged.Duration = cmp.Or(child.Duration, parent.Duration)
+   merged.StartNumber = cmp.Or(child.StartNumber, parent.StartNumber)
+   merged.Initialization = cmp.Or(child.Initialization, parent.Initialization)
+   merged.Media = cmp.Or(child.Media, parent.Media)
+   if child.Timeline != nil {
+      merged.Timeline = child.Timeline
+   }
+   return &merged
+}
+
+// segments returns the init segment and media segments of a SegmentList
+// or SegmentTemplate.
+func (m *mpdRepresentation) segments() (Segment, []Segment, error) {
+   if m.template != nil {
+      return m.templateSegments()
+   }
+   list := m.list
+   var err error
+   segments := make([]Segment, len(list.SegmentURLs))
+   for i, segmentURL := range list.SegmentURLs {
+      segments[i], err = m.segment(segmentURL.Media, segmentURL.MediaRange)
+      if err != nil {
+         return Segment{}, nil, err
+      }
+      segments[i].Time = uint64(i) * list.Duration
+      segments[i].Duration = list.Duration
+   }
+   if list.Initialization == nil {
+      // the media segments are self-initializing, as is the resource of a
+      // Representation with only a BaseURL
+      if len(segments) == 0 {
+         return Segment{}, nil, errors.New("SegmentList has neither Initialization nor SegmentURL")
+      }
+      init := segments[0]
+      init.Time, init.Duration = 0, 0
+      return init, segments, nil
+   }
+   init, err := m.segment(list.Initialization.SourceURL, list.Initialization.Range)
+   if err != nil {
+      return Segment{}, nil, err
+   }
+   return init, segments, nil
+}
+
+func (m *mpdRepresentation) templateSegments() (Segment, []Segment, error) {
+   template := m.template
+   timescale := uint64(cmp.Or(template.Timescale, 1))
+   number := uint64(1)
+   if template.StartNumber != nil {
+      number = *template.StartNumber
+   }
+   init, err := m.segment(m.expand(template.Initialization, 0, 0), "")
+   if err != nil {
+      return Segment{}, nil, err
+   }
+   end := uint64(math.Ceil(m.duration * float64(timescale)))
+
+   var segments []Segment
+   add := func(time, duration uint64) error {
+      segment, err := m.segment(m.expand(template.Media, number, time), "")
+      if err != nil {
+         return err
+      }
+      segment.Time, segment.Duration = time, duration
+      segments = append(segments, segment)
+      number++
+      return nil
+   }
+   switch {
+   case template.Timeline != nil:
+      var time uint64
+      for i, s := range template.Timeline {
+         if s.T != nil {
+            time = *s.T
+         }
+         if s.D == 0 {
+            return Segment{}, nil, errors.New("SegmentTimeline S without d")
+         }
+         repeat := s.R
+         if repeat < 0 {
+            // repeat up to the next S, or the end of the period
+            until := end
+            if i+1 < len(template.Timeline) && template.Timeline[i+1].T != nil {
+               until = *template.Timeline[i+1].T
+            }
+            if until <= time {
+               return Segment{}, nil, errors.New("SegmentTimeline repeats without end")
+            }
+            repeat = int64((until-time+s.D-1)/s.D) - 1
+         }
+         for range repeat + 1 {
+            if err := add(time, s.D); err != nil {
+               return Segment{}, nil, err
+            }
+            time += s.D
+         }
+      }
+   case template.Duration > 0:
+      if end == 0 {
+         return Segment{}, nil, errors.New("SegmentTemplate needs a period duration")
+      }
+      for time := uint64(0); time < end; time += template.Duration {
+         if err := add(time, min(template.Duration, end-time)); err != nil {
+            return Segment{}, nil, err
+         }
+      }
+   default:
+      return Segment{}, nil, errors.New("SegmentTemplate has neither duration nor SegmentTimeline")
+   }
+   return init, segments, nil
+}
+
+// segment resolves a URL, against BaseURL, and a byte range.
+func (m *mpdRepresentation) segment(ref, byteRange string) (Segment, error) {
+   var segment Segment
+   if byteRange != "" {
+      var err error
+      segment, err = parseRange(byteRange)
+      if err != nil {
+         return Segment{}, err
+      }
+   }
+   base, err := url.Parse(m.baseURL)
+   if err != nil {
+      return Segment{}, err
+   }
+   location, err := base.Parse(ref)
+   if err != nil {
+      return Segment{}, err
+   }
+   segment.URL = location.String()
+   return segment, nil
+}
+
+var templateIdentifier = regexp.MustCompile(
+   `\$(RepresentationID|Number|Time|Bandwidth)(%0(\d+)d)?\$|\$\$`,
+)
+
+// expand substitutes the identifiers of a SegmentTemplate URL.
+func (m *mpdRepresentation) expand(template string, number, time uint64) string {
+   return templateIdentifier.ReplaceAllStringFunc(template, func(match string) string {
+      groups := templateIdentifier.FindStringSubmatch(match)
+      var value uint64
+      switch groups[1] {
+      case "":
+         return "$"
+      case "RepresentationID":
+         return m.id
+      case "Number":
+         value = number
+      case "Time":
+         value = time
+      case "Bandwidth":
+         value = m.bandwidth
+      }
+      width, _ := strconv.Atoi(groups[3])
+      return fmt.Sprintf("%0*d", width, value)
+   })
+}
+
+// parseDuration parses an xs:duration without years or months, such as
+// "PT1H2M3.5S", into seconds.
+func parseDuration(value string) (float64, error) {
+   rest, ok := strings.CutPrefix(value, "P")
+   if !ok {
+      return 0, fmt.Errorf("invalid duration %q", value)
+   }
+   var seconds float64
+   inTime := false
+   for rest != "" {
+      if rest[0] == 'T' {
+         inTime = true
+         rest = rest[1:]
+         continue
+      }
+      end := strings.IndexAny(rest, "DHMS")
+      if end < 1 {
+         return 0, fmt.Errorf("invalid duration %q", value)
+      }
+      number, err := strconv.ParseFloat(rest[:end], 64)
+      if err != nil {
+         return 0, fmt.Errorf("invalid duration %q", value)
+      }
+      switch {
+      case rest[end] == 'D' && !inTime:
+         seconds += number * 24 * 60 * 60
+      case rest[end] == 'H' && inTime:
+         seconds += number * 60 * 60
+      case rest[end] == 'M' && inTime:
+         seconds += number * 60
+      case rest[end] == 'S' && inTime:
+         seconds += number
+      default:
+         return 0, fmt.Errorf("unsupported duration %q", value)
+      }
+      rest = rest[end+1:]
+   }
+   return seconds, nil
+}
@@ -0,0 +1,57 @@
+// mpd_test.go
+package sofia
+
+import (
+   "bytes"
+   "strings"
+   "testing"
+)
+
+// testMoov decodes the moov of an init segment.
+func testMoov(t *testing.T, initSegment []byte) *MoovBox {
+   t.Helper()
+   boxes, err := DecodeBoxes(initSegment)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      t.Fatal("no moov found")
+   }
+   return moov
+}
+
+// testSubtitleTracks returns a video track and subtitle tracks in English,
+// one WebVTT and one TTML.
+func testSubtitleTracks(t *testing.T) []Track {
+   tracks := []Track{{ID: "video", Moov: testMoov(t, testInit())}}
+   for _, format := range []string{"wvtt", "stpp"} {
+      entry := containerBox(format, []byte{0, 0, 0, 0, 0, 0, 0, 1})
+      moov := testMoov(t, testTrackInit("subt", entry))
+      if err := moov.Trak[0].Mdia.SetLanguage("eng"); err != nil {
+         t.Fatal(err)
+      }
+      tracks = append(tracks, Track{ID: format, Moov: moov})
+   }
+   for i := range tracks {
+      tracks[i].URL = tracks[i].ID + ".mp4"
+      tracks[i].Playlist = tracks[i].ID + ".m3u8"
+   }
+   return tracks
+}
+
+func TestWriteMPDSubtitles(t *testing.T) {
+   var b bytes.Buffer
+   if err := WriteMPD(&b, testSubtitleTracks(t)); err != nil {
+      t.Fatal(err)
+   }
+   for _, want := range []string{
+      `contentType="text" mimeType="application/mp4" lang="eng"`,
+      `id="wvtt" bandwidth="0" codecs="wvtt"`,
+      `id="stpp" bandwidth="0" codecs="stpp.ttml.im1t"`,
+   } {
+      if !strings.Contains(b.String(), want) {
+         t.Errorf("MPD has no %s:\n%s", want, b.String())
+      }
+   }
+}
@@ -0,0 +1,329 @@
+// playready.go
+package sofia
+
+import (
+   "crypto/aes"
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/xml"
+   "errors"
+   "fmt"
+   "io"
+   "strings"
+   "unicode/utf16"
+)
+
+var PlayReadySystemID = [16]byte{
+   0x9a, 0x04, 0xf0, 0x79, 0x98, 0x40, 0x42, 0x86,
+   0xab, 0x92, 0xe6, 0x5b, 0xe0, 0x88, 0x5f, 0x95,
+}
+
+// PlayReady Object record types
+const (
+   PlayReadyHeaderRecord       = 1
+   PlayReadyLicenseStoreRecord = 3
+)
+
+// --- PLAYREADY OBJECT ---
+// PlayReadyObject is the Data of a PlayReady pssh box. All of its integers
+// are little endian.
+type PlayReadyObject struct {
+   Records []PlayReadyRecord
+}
+
+type PlayReadyRecord struct {
+   Type  uint16
+   Value []byte
+}
+
+func DecodePlayReadyObject(data []byte) (*PlayReadyObject, error) {
+   if len(data) < 6 {
+      return nil, sizeError("PlayReady object too short", 6, len(data))
+   }
+   size := int(binary.LittleEndian.Uint32(data))
+   if size < 6 || size > len(data) {
+      return nil, sizeError("PlayReady object size mismatch", size, len(data))
+   }
+   count := int(binary.LittleEndian.Uint16(data[4:]))
+   data = data[6:size]
+   o := &PlayReadyObject{}
+   for i := 0; i < count; i++ {
+      if len(data) < 4 {
+         return nil, sizeError("PlayReady record header too short", 4, len(data))
+      }
+      record := PlayReadyRecord{Type: binary.LittleEndian.Uint16(data)}
+      length := int(binary.LittleEndian.Uint16(data[2:]))
+      if len(data) < 4+length {
+         return nil, sizeError("PlayReady record too short", 4+length, len(data))
+      }
+      record.Value = data[4 : 4+length]
+      o.Records = append(o.Records, record)
+      data = data[4+length:]
+   }
+   return o, nil
+}
+
+func (o *PlayReadyObject) Encode() []byte {
+   buffer := make([]byte, 6)
+   for _, record := range o.Records {
+      buffer = binary.LittleEndian.AppendUint16(buffer, record.Type)
+      buffer = binary.LittleEndian.AppendUint16(buffer, uint16(len(record.Value)))
+      buffer = append(buffer, record.Value...)
+   }
+   binary.LittleEndian.PutUint32(buffer, uint32(len(buffer)))
+   binary.LittleEndian.PutUint16(buffer[4:], uint16(len(o.Records)))
+   return buffer
+}
+
+// Header decodes the first rights management header record.
+func (o *PlayReadyObject) Header() (*PlayReadyHeader, error) {
+   for _, record := range o.Records {
+      if record.Type == PlayReadyHeaderRecord {
+         return DecodePlayReadyHeader(record.Value)
+      }
+   }
+   return nil, errors.New("PlayReady object has no rights management header")
+}
+
+// --- WRMHEADER ---
+// PlayReadyHeader is a WRMHEADER, versions 4.0 to 4.3.
+type PlayReadyHeader struct {
+   Version          string // such as "4.0.0.0"
+   KIDs             []PlayReadyKID
+   LAURL            string
+   LUIURL           string
+   DSID             string
+   CustomAttributes string // inner XML
+}
+
+type PlayReadyKID struct {
+   KID      [16]byte // CENC byte order, as in tenc and pssh
+   AlgID    string   // AESCTR, AESCBC, COCKTAIL, or empty from version 4.3
+   Checksum []byte
+}
+
+type wrmHeader struct {
+   Version string `xml:"version,attr"`
+   Data    struct {
+      ProtectInfo struct {
+         KeyLen string   `xml:"KEYLEN"`
+         AlgID  string   `xml:"ALGID"`
+         KID    []wrmKID `xml:"KID"`      // 4.1
+         KIDs   []wrmKID `xml:"KIDS>KID"` // 4.2 and later
+      } `xml:"PROTECTINFO"`
+      KID              string `xml:"KID"` // 4.0
+      Checksum         string `xml:"CHECKSUM"`
+      LAURL            string `xml:"LA_URL"`
+      LUIURL           string `xml:"LUI_URL"`
+      DSID             string `xml:"DS_ID"`
+      CustomAttributes struct {
+         InnerXML string `xml:",innerxml"`
+      } `xml:"CUSTOMATTRIBUTES"`
+   } `xml:"DATA"`
+}
+
+type wrmKID struct {
+   AlgID    string `xml:"ALGID,attr"`
+   Checksum string `xml:"CHECKSUM,attr"`
+   Value    string `xml:"VALUE,attr"`
+}
+
+// DecodePlayReadyHeader decodes the UTF-16LE WRMHEADER of a rights
+// management header record.
+func DecodePlayReadyHeader(data []byte) (*PlayReadyHeader, error) {
+   if len(data)%2 != 0 {
+      return nil, errors.New("WRMHEADER is not UTF-16")
+   }
+   units := make([]uint16, len(data)/2)
+   for i := range units {
+      units[i] = binary.LittleEndian.Uint16(data[2*i:])
+   }
+   text := strings.TrimPrefix(string(utf16.Decode(units)), "\ufeff")
+
+   var raw wrmHeader
+   decoder := xml.NewDecoder(strings.NewReader(text))
+   // the text is already decoded, whatever the declaration says
+   decoder.CharsetReader = func(_ string, input io.Reader) (io.Reader, error) {
+      return input, nil
+   }
+   if err := decoder.Decode(&raw); err != nil {
+      return nil, fmt.Errorf("parsing WRMHEADER: %w", err)
+   }
+   h := &PlayReadyHeader{
+      Version:          raw.Version,
+      LAURL:            strings.TrimSpace(raw.Data.LAURL),
+      LUIURL:           strings.TrimSpace(raw.Data.LUIURL),
+      DSID:             strings.TrimSpace(raw.Data.DSID),
+      CustomAttributes: raw.Data.CustomAttributes.InnerXML,
+   }
+   kids := append(raw.Data.ProtectInfo.KID, raw.Data.ProtectInfo.KIDs...)
+   if raw.Data.KID != "" {
+      kids = append(kids, wrmKID{
+         AlgID:    raw.Data.ProtectInfo.AlgID,
+         Checksum: raw.Data.Checksum,
+         Value:    raw.Data.KID,
+      })
+   }
+   for _, kid := range kids {
+      var decoded PlayReadyKID
+      value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(kid.Value))
+      if err != nil || len(value) != 16 {
+         return nil, fmt.Errorf("invalid WRMHEADER KID %q", kid.Value)
+      }
+      decoded.KID = guidSwap([16]byte(value))
+      decoded.AlgID = kid.AlgID
+      if kid.Checksum != "" {
+         decoded.Checksum, err = base64.StdEncoding.DecodeString(
+            strings.TrimSpace(kid.Checksum),
+         )
+         if err != nil {
+            return nil, fmt.Errorf("invalid WRMHEADER checksum %q", kid.Checksum)
+         }
+      }
+      h.KIDs = append(h.KIDs, decoded)
+   }
+   return h, nil
+}
+
+// Encode returns the UTF-16LE WRMHEADER. An empty Version picks the lowest
+// version that can express the KIDs: 4.0 for a single AESCTR KID, 4.3 if
+// some KID is AESCBC or has no AlgID, and 4.2 otherwise. Versions 4.0 and
+// 4.1 hold a single KID, so with several KIDs they are picked the same way.
+func (h *PlayReadyHeader) Encode() []byte {
+   version := h.Version
+   if version == "" || len(h.KIDs) > 1 && singleKID(version) {
+      version = h.minimumVersion()
+   }
+   var text strings.Builder
+   text.WriteString(`<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="`)
+   text.WriteString(version)
+   text.WriteString(`"><DATA>`)
+   if strings.HasPrefix(version, "4.0") {
+      kid := PlayReadyKID{AlgID: "AESCTR"}
+      if len(h.KIDs) > 0 {
+         kid = h.KIDs[0]
+      }
+      text.WriteString("<PROTECTINFO><KEYLEN>16</KEYLEN><ALGID>")
+      xmlText(&text, kid.AlgID)
+      text.WriteString("</ALGID></PROTECTINFO><KID>")
+      text.WriteString(kid.value())
+      text.WriteString("</KID>")
+      if kid.Checksum != nil {
+         text.WriteString("<CHECKSUM>")
+         text.WriteString(base64.StdEncoding.EncodeToString(kid.Checksum))
+         text.WriteString("</CHECKSUM>")
+      }
+   } else {
+      text.WriteString("<PROTECTINFO>")
+      if !strings.HasPrefix(version, "4.1") {
+         text.WriteString("<KIDS>")
+      }
+      for _, kid := range h.KIDs {
+         text.WriteString("<KID")
+         if kid.AlgID != "" {
+            text.WriteString(` ALGID="`)
+            xmlText(&text, kid.AlgID)
+            text.WriteString(`"`)
+         }
+         if kid.Checksum != nil {
+            text.WriteString(` CHECKSUM="`)
+            text.WriteString(base64.StdEncoding.EncodeToString(kid.Checksum))
+            text.WriteString(`"`)
+         }
+         text.WriteString(` VALUE="`)
+         text.WriteString(kid.value())
+         text.WriteString(`"></KID>`)
+      }
+      if !strings.HasPrefix(version, "4.1") {
+         text.WriteString("</KIDS>")
+      }
+      text.WriteString("</PROTECTINFO>")
+   }
+   for _, element := range [...]struct{ name, value string }{
+      {"LA_URL", h.LAURL}, {"LUI_URL", h.LUIURL}, {"DS_ID", h.DSID},
+   } {
+      if element.value != "" {
+         text.WriteString("<" + element.name + ">")
+         xmlText(&text, element.value)
+         text.WriteString("</" + element.name + ">")
+      }
+   }
+   if h.CustomAttributes != "" {
+      text.WriteString("<CUSTOMATTRIBUTES>")
+      text.WriteString(h.CustomAttributes)
+      text.WriteString("</CUSTOMATTRIBUTES>")
+   }
+   text.WriteString("</DATA></WRMHEADER>")
+
+   units := utf16.Encode([]rune(text.String()))
+   buffer := make([]byte, 0, 2*len(units))
+   for _, unit := range units {
+      buffer = binary.LittleEndian.AppendUint16(buffer, unit)
+   }
+   return buffer
+}
+
+func (h *PlayReadyHeader) minimumVersion() string {
+   if len(h.KIDs) == 1 && h.KIDs[0].AlgID == "AESCTR" {
+      return "4.0.0.0"
+   }
+   for _, kid := range h.KIDs {
+      if kid.AlgID == "" || kid.AlgID == "AESCBC" {
+         return "4.3.0.0"
+      }
+   }
+   return "4.2.0.0"
+}
+
+func singleKID(version string) bool {
+   return strings.HasPrefix(version, "4.0") || strings.HasPrefix(version, "4.1")
+}
+
+// Pssh returns a version 1 pssh box listing the KIDs, whose data is a
+// PlayReady object holding the header.
+func (h *PlayReadyHeader) Pssh() *PsshBox {
+   object := PlayReadyObject{
+      Records: []PlayReadyRecord{{Type: PlayReadyHeaderRecord, Value: h.Encode()}},
+   }
+   b := &PsshBox{
+      Header:   &BoxHeader{Type: [4]byte{'p', 's', 's', 'h'}},
+      Version:  1,
+      SystemID: PlayReadySystemID,
+      Data:     object.Encode(),
+   }
+   for _, kid := range h.KIDs {
+      b.KIDs = append(b.KIDs, kid.KID)
+   }
+   return b
+}
+
+// value is the base64 KID in GUID byte order.
+func (k *PlayReadyKID) value() string {
+   guid := guidSwap(k.KID)
+   return base64.StdEncoding.EncodeToString(guid[:])
+}
+
+// PlayReadyChecksum computes the AESCTR checksum of kid, which is in CENC
+// byte order, from the content key.
+func PlayReadyChecksum(kid [16]byte, key []byte) ([]byte, error) {
+   block, err := aes.NewCipher(key)
+   if err != nil {
+      return nil, err
+   }
+   guid := guidSwap(kid)
+   block.Encrypt(guid[:], guid[:])
+   return guid[:8], nil
+}
+
+// guidSwap converts between the GUID byte order of PlayReady, whose first
+// three fields are little endian, and the big endian order of CENC.
+func guidSwap(id [16]byte) [16]byte {
+   id[0], id[1], id[2], id[3] = id[3], id[2], id[1], id[0]
+   id[4], id[5] = id[5], id[4]
+   id[6], id[7] = id[7], id[6]
+   return id
+}
+
+func xmlText(text *strings.Builder, value string) {
+   xml.EscapeText(text, []byte(value))
+}
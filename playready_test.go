@@ -0,0 +1,228 @@
+// playready_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "encoding/hex"
+   "strings"
+   "testing"
+   "unicode/utf16"
+)
+
+// 00112233-4455-6677-8899-aabbccddeeff in CENC byte order
+var testPlayReadyKID = [16]byte{
+   0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77,
+   0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+}
+
+// testUTF16 encodes text as UTF-16LE with a byte order mark.
+func testUTF16(text string) []byte {
+   var data []byte
+   for _, unit := range utf16.Encode([]rune("\ufeff" + text)) {
+      data = binary.LittleEndian.AppendUint16(data, unit)
+   }
+   return data
+}
+
+func TestGuidSwap(t *testing.T) {
+   want := [16]byte{
+      0x33, 0x22, 0x11, 0x00, 0x55, 0x44, 0x77, 0x66,
+      0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff,
+   }
+   if got := guidSwap(testPlayReadyKID); got != want {
+      t.Errorf("got %x, want %x", got, want)
+   }
+   if got := guidSwap(want); got != testPlayReadyKID {
+      t.Errorf("swapping back got %x", got)
+   }
+}
+
+func TestPlayReadyChecksum(t *testing.T) {
+   key, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+   if err != nil {
+      t.Fatal(err)
+   }
+   checksum, err := PlayReadyChecksum(testPlayReadyKID, key)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := hex.EncodeToString(checksum); got != "2a93af5d12d45dfb" {
+      t.Errorf("got %s, want 2a93af5d12d45dfb", got)
+   }
+   if _, err := PlayReadyChecksum(testPlayReadyKID, key[:15]); err == nil {
+      t.Error("computed a checksum with a 15 byte key")
+   }
+}
+
+func TestDecodePlayReadyHeader(t *testing.T) {
+   // the KID is base64 in GUID byte order
+   data := testUTF16(`<WRMHEADER xmlns="http://schemas.microsoft.com/DRM/2007/03/PlayReadyHeader" version="4.0.0.0">` +
+      `<DATA><PROTECTINFO><KEYLEN>16</KEYLEN><ALGID>AESCTR</ALGID></PROTECTINFO>` +
+      `<KID>MyIRAFVEd2aImaq7zN3u/w==</KID><CHECKSUM>KpOvXRLUXfs=</CHECKSUM>` +
+      `<LA_URL>https://example.com/rightsmanager.asmx?a=1&amp;b=2</LA_URL>` +
+      `<CUSTOMATTRIBUTES><IIS_DRM_VERSION>8.0</IIS_DRM_VERSION></CUSTOMATTRIBUTES>` +
+      `</DATA></WRMHEADER>`)
+   h, err := DecodePlayReadyHeader(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if h.Version != "4.0.0.0" {
+      t.Errorf("version %q", h.Version)
+   }
+   if len(h.KIDs) != 1 {
+      t.Fatalf("got %d KIDs, want 1", len(h.KIDs))
+   }
+   kid := h.KIDs[0]
+   if kid.KID != testPlayReadyKID {
+      t.Errorf("KID %x, want %x", kid.KID, testPlayReadyKID)
+   }
+   if kid.AlgID != "AESCTR" {
+      t.Errorf("AlgID %q", kid.AlgID)
+   }
+   if hex.EncodeToString(kid.Checksum) != "2a93af5d12d45dfb" {
+      t.Errorf("checksum %x", kid.Checksum)
+   }
+   if h.LAURL != "https://example.com/rightsmanager.asmx?a=1&b=2" {
+      t.Errorf("LA_URL %q", h.LAURL)
+   }
+   if h.CustomAttributes != "<IIS_DRM_VERSION>8.0</IIS_DRM_VERSION>" {
+      t.Errorf("custom attributes %q", h.CustomAttributes)
+   }
+}
+
+func TestPlayReadyHeaderRoundTrip(t *testing.T) {
+   second := guidSwap(testPlayReadyKID)
+   for _, test := range []struct {
+      name    string
+      header  PlayReadyHeader
+      version string
+   }{
+      {
+         name: "single AESCTR",
+         header: PlayReadyHeader{
+            KIDs: []PlayReadyKID{{
+               KID: testPlayReadyKID, AlgID: "AESCTR", Checksum: []byte{1, 2, 3, 4, 5, 6, 7, 8},
+            }},
+            LAURL: "https://example.com/?a=1&b=2",
+         },
+         version: "4.0.0.0",
+      },
+      {
+         name: "version 4.1",
+         header: PlayReadyHeader{
+            Version: "4.1.0.0",
+            KIDs:    []PlayReadyKID{{KID: testPlayReadyKID, AlgID: "AESCTR"}},
+            DSID:    "service",
+         },
+         version: "4.1.0.0",
+      },
+      {
+         name: "several AESCTR",
+         header: PlayReadyHeader{
+            KIDs: []PlayReadyKID{
+               {KID: testPlayReadyKID, AlgID: "AESCTR"}, {KID: second, AlgID: "AESCTR"},
+            },
+            LUIURL: "https://example.com/ui",
+         },
+         version: "4.2.0.0",
+      },
+      {
+         name: "AESCBC",
+         header: PlayReadyHeader{
+            KIDs:             []PlayReadyKID{{KID: testPlayReadyKID, AlgID: "AESCBC"}},
+            CustomAttributes: "<a>1</a>",
+         },
+         version: "4.3.0.0",
+      },
+      {
+         // versions 4.0 and 4.1 hold a single KID
+         name: "several KIDs as 4.0",
+         header: PlayReadyHeader{
+            Version: "4.0.0.0",
+            KIDs: []PlayReadyKID{
+               {KID: testPlayReadyKID, AlgID: "AESCTR"}, {KID: second},
+            },
+         },
+         version: "4.3.0.0",
+      },
+   } {
+      t.Run(test.name, func(t *testing.T) {
+         decoded, err := DecodePlayReadyHeader(test.header.Encode())
+         if err != nil {
+            t.Fatal(err)
+         }
+         if decoded.Version != test.version {
+            t.Errorf("version %q, want %q", decoded.Version, test.version)
+         }
+         decoded.Version = test.header.Version
+         if !bytes.Equal(decoded.Encode(), test.header.Encode()) {
+            t.Errorf("got %+v\nwant %+v", decoded, test.header)
+         }
+         if len(decoded.KIDs) != len(test.header.KIDs) {
+            t.Errorf("got %d KIDs, want %d", len(decoded.KIDs), len(test.header.KIDs))
+         }
+      })
+   }
+}
+
+func TestPlayReadyPssh(t *testing.T) {
+   header := PlayReadyHeader{
+      KIDs: []PlayReadyKID{{KID: testPlayReadyKID, AlgID: "AESCTR"}},
+   }
+   pssh := header.Pssh()
+   box, err := DecodePsshBox(pssh.Encode())
+   if err != nil {
+      t.Fatal(err)
+   }
+   if box.SystemID != PlayReadySystemID {
+      t.Errorf("system ID %x", box.SystemID)
+   }
+   if len(box.KIDs) != 1 || box.KIDs[0] != testPlayReadyKID {
+      t.Errorf("pssh KIDs %x", box.KIDs)
+   }
+   object, err := DecodePlayReadyObject(box.Data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !bytes.Equal(object.Encode(), box.Data) {
+      t.Errorf("object got %x\nwant %x", object.Encode(), box.Data)
+   }
+   decoded, err := object.Header()
+   if err != nil {
+      t.Fatal(err)
+   }
+   if decoded.KIDs[0].KID != testPlayReadyKID {
+      t.Errorf("header KID %x", decoded.KIDs[0].KID)
+   }
+}
+
+func TestDecodePlayReadyObject(t *testing.T) {
+   // a license store record, then a header record
+   data := []byte{22, 0, 0, 0, 2, 0, 3, 0, 2, 0, 0xaa, 0xbb, 1, 0, 6, 0}
+   data = append(data, testUTF16("<ab")[2:]...)
+   o, err := DecodePlayReadyObject(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(o.Records) != 2 {
+      t.Fatalf("got %d records, want 2", len(o.Records))
+   }
+   if o.Records[0].Type != PlayReadyLicenseStoreRecord {
+      t.Errorf("first record type %d", o.Records[0].Type)
+   }
+   if !bytes.Equal(o.Encode(), data) {
+      t.Errorf("got %x\nwant %x", o.Encode(), data)
+   }
+   for _, size := range []int{5, 23} {
+      cut := append([]byte{}, data...)
+      binary.LittleEndian.PutUint32(cut, uint32(size))
+      if _, err := DecodePlayReadyObject(cut); err == nil {
+         t.Errorf("size %d: decoded", size)
+      }
+   }
+   if _, err := DecodePlayReadyObject(data[:20]); err == nil ||
+      !strings.Contains(err.Error(), "size mismatch") {
+      t.Errorf("cut short: %v", err)
+   }
+}
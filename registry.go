@@ -0,0 +1,195 @@
+// registry.go
+package sofia
+
+import (
+   "cmp"
+   "errors"
+   "fmt"
+   "slices"
+   "sync"
+)
+
+// BoxCodec is a decoder/encoder pair for a box type that sofia does not
+// model itself. Decode receives the complete box, header included. Encode
+// returns the complete box; if it is nil the box is written back unchanged.
+type BoxCodec struct {
+   Decode func(data []byte) (any, error)
+   Encode func(value any) []byte
+}
+
+type boxKey struct {
+   Parent [4]byte
+   Type   [4]byte
+}
+
+var boxRegistry = struct {
+   sync.RWMutex
+   codecs map[boxKey]BoxCodec
+}{codecs: map[boxKey]BoxCodec{}}
+
+// RegisterBox registers codec for boxType. With an empty parent the codec
+// applies wherever the box appears, including the top level handed to
+// DecodeBoxes; otherwise it applies only to children of parent, and takes
+// precedence over an unscoped registration. Box types that sofia decodes
+// itself are not affected.
+func RegisterBox(parent, boxType string, codec BoxCodec) error {
+   if codec.Decode == nil {
+      return errors.New("box codec has no decoder")
+   }
+   var key boxKey
+   if len(boxType) != 4 {
+      return fmt.Errorf("invalid box type %q", boxType)
+   }
+   copy(key.Type[:], boxType)
+   if parent != "" {
+      if len(parent) != 4 {
+         return fmt.Errorf("invalid parent box type %q", parent)
+      }
+      copy(key.Parent[:], parent)
+   }
+   boxRegistry.Lock()
+   defer boxRegistry.Unlock()
+   boxRegistry.codecs[key] = codec
+   return nil
+}
+
+// UnregisterBox removes a codec added with RegisterBox.
+func UnregisterBox(parent, boxType string) {
+   var key boxKey
+   copy(key.Type[:], boxType)
+   copy(key.Parent[:], parent)
+   boxRegistry.Lock()
+   defer boxRegistry.Unlock()
+   delete(boxRegistry.codecs, key)
+}
+
+func lookupBox(parent string, boxType [4]byte) (BoxCodec, bool) {
+   boxRegistry.RLock()
+   defer boxRegistry.RUnlock()
+   key := boxKey{Type: boxType}
+   if parent != "" {
+      copy(key.Parent[:], parent)
+      if codec, ok := boxRegistry.codecs[key]; ok {
+         return codec, true
+      }
+      key.Parent = [4]byte{}
+   }
+   codec, ok := boxRegistry.codecs[key]
+   return codec, ok
+}
+
+// --- Custom ---
+// CustomBox holds a box decoded through a codec added with RegisterBox.
+type CustomBox struct {
+   Header *BoxHeader
+   Value  any
+   Raw    []byte
+   encode func(value any) []byte
+   // among the children its parent does not model, from 1, or 0 if it was
+   // not decoded
+   position int
+}
+
+// decodeCustomBox returns nil if no codec is registered for the box.
+func decodeCustomBox(parent string, data []byte) (*CustomBox, error) {
+   header, err := DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   codec, ok := lookupBox(parent, header.Type)
+   if !ok {
+      return nil, nil
+   }
+   value, err := codec.Decode(data)
+   if err != nil {
+      return nil, fmt.Errorf("decoding %s box: %w", header.Type[:], err)
+   }
+   return &CustomBox{
+      Header: header, Value: value, Raw: data, encode: codec.Encode,
+   }, nil
+}
+
+func (b *CustomBox) Encode() []byte {
+   if b.encode == nil {
+      return b.Raw
+   }
+   return b.encode(b.Value)
+}
+
+func (b *CustomBox) Type() string {
+   return string(b.Header.Type[:])
+}
+
+// keepChild keeps a child box that its parent does not model: in custom if
+// a codec is registered for it, and in raw otherwise.
+func keepChild(parent string, content []byte, custom *[]*CustomBox, raw *[][]byte) error {
+   box, err := decodeCustomBox(parent, content)
+   if err != nil {
+      return err
+   }
+   if box == nil {
+      *raw = append(*raw, content)
+      return nil
+   }
+   box.position = len(*custom) + len(*raw) + 1
+   *custom = append(*custom, box)
+   return nil
+}
+
+// otherChildren returns the custom and raw children of a box, encoded, in
+// the order they were read, followed by any added since.
+func otherChildren(custom []*CustomBox, raw [][]byte) [][]byte {
+   positions := make([]int, len(custom))
+   for i, box := range custom {
+      positions[i] = box.position
+   }
+   var children [][]byte
+   for _, i := range childOrder(positions, len(raw)) {
+      if i < len(custom) {
+         children = append(children, custom[i].Encode())
+      } else {
+         children = append(children, raw[i-len(custom)])
+      }
+   }
+   return children
+}
+
+// appendChildren appends the custom and raw children of a box in the order
+// they were read.
+func appendChildren(buffer []byte, custom []*CustomBox, raw [][]byte) []byte {
+   for _, child := range otherChildren(custom, raw) {
+      buffer = append(buffer, child...)
+   }
+   return buffer
+}
+
+// childOrder returns the order to write the children of a box in, as
+// indexes into the children that know their position, followed by
+// rawCount raw children. A child goes back where it was read, with the raw
+// children filling the gaps in order, and one with a position of 0 goes
+// last.
+func childOrder(positions []int, rawCount int) []int {
+   var placed, added []int
+   for i, position := range positions {
+      if position > 0 {
+         placed = append(placed, i)
+      } else {
+         added = append(added, i)
+      }
+   }
+   slices.SortStableFunc(placed, func(a, b int) int {
+      return cmp.Compare(positions[a], positions[b])
+   })
+   order := make([]int, 0, len(positions)+rawCount)
+   var raw int
+   for len(placed) > 0 || raw < rawCount {
+      if len(placed) > 0 && (positions[placed[0]] <= len(order)+1 || raw == rawCount) {
+         order = append(order, placed[0])
+         placed = placed[1:]
+      } else {
+         order = append(order, len(positions)+raw)
+         raw++
+      }
+   }
+   return append(order, added...)
+}
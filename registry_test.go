@@ -0,0 +1,115 @@
+// registry_test.go
+package sofia
+
+import (
+   "bytes"
+   "testing"
+)
+
+// testUdtaCodec decodes a udta box to its payload as a string.
+var testUdtaCodec = BoxCodec{
+   Decode: func(data []byte) (any, error) {
+      return string(data[8:]), nil
+   },
+   Encode: func(value any) []byte {
+      return containerBox("udta", []byte(value.(string)))
+   },
+}
+
+func TestRegisterBox(t *testing.T) {
+   moov := containerBox(
+      "moov",
+      containerBox("free", []byte("before")),
+      containerBox("udta", []byte("title")),
+      containerBox("skip", []byte("after")),
+   )
+   for _, parent := range []string{"moov", ""} {
+      if err := RegisterBox(parent, "udta", testUdtaCodec); err != nil {
+         t.Fatal(err)
+      }
+      box, err := DecodeMoovBox(moov)
+      UnregisterBox(parent, "udta")
+      if err != nil {
+         t.Fatal(err)
+      }
+      if len(box.Custom) != 1 || box.Custom[0].Value != "title" {
+         t.Fatalf("parent %q: got Custom %v", parent, box.Custom)
+      }
+      if got := box.Encode(); !bytes.Equal(got, moov) {
+         t.Errorf("parent %q: encoded children out of order:\n%q\nwant\n%q", parent, got, moov)
+      }
+      box.Custom[0].Value = "other"
+      want := containerBox(
+         "moov",
+         containerBox("free", []byte("before")),
+         containerBox("udta", []byte("other")),
+         containerBox("skip", []byte("after")),
+      )
+      if got := box.Encode(); !bytes.Equal(got, want) {
+         t.Errorf("parent %q: got %q, want %q", parent, got, want)
+      }
+   }
+
+   box, err := DecodeMoovBox(moov)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(box.Custom) != 0 || len(box.RawChildren) != 3 {
+      t.Errorf("after UnregisterBox: %d custom, %d raw", len(box.Custom), len(box.RawChildren))
+   }
+   if got := box.Encode(); !bytes.Equal(got, moov) {
+      t.Errorf("after UnregisterBox: got %q", got)
+   }
+}
+
+func TestRegisterBoxScope(t *testing.T) {
+   if err := RegisterBox("trak", "udta", testUdtaCodec); err != nil {
+      t.Fatal(err)
+   }
+   defer UnregisterBox("trak", "udta")
+   udta := containerBox("udta", []byte("title"))
+   boxes, err := DecodeBoxes(append(udta, containerBox("moov", udta)...))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if boxes[0].Custom != nil || len(boxes[1].Moov.Custom) != 0 {
+      t.Error("a codec scoped to trak decoded udta elsewhere")
+   }
+   if err := RegisterBox("", "udta", BoxCodec{
+      Decode: func(data []byte) (any, error) { return nil, nil },
+   }); err != nil {
+      t.Fatal(err)
+   }
+   defer UnregisterBox("", "udta")
+   boxes, err = DecodeBoxes(udta)
+   if err != nil {
+      t.Fatal(err)
+   }
+   // without an encoder the box is written back as read
+   if boxes[0].Custom == nil || !bytes.Equal(boxes[0].Encode(), udta) {
+      t.Errorf("top level udta: got %+v", boxes[0])
+   }
+   trak, err := DecodeTrakBox(containerBox("trak", udta))
+   if err != nil {
+      t.Fatal(err)
+   }
+   // the scoped codec takes precedence
+   if len(trak.Custom) != 1 || trak.Custom[0].Value != "title" {
+      t.Errorf("trak udta: got %+v", trak.Custom)
+   }
+}
+
+func TestRegisterBoxInvalid(t *testing.T) {
+   for _, test := range []struct {
+      parent, boxType string
+      codec           BoxCodec
+   }{
+      {"", "udta", BoxCodec{}},
+      {"", "udt", testUdtaCodec},
+      {"mo", "udta", testUdtaCodec},
+   } {
+      if err := RegisterBox(test.parent, test.boxType, test.codec); err == nil {
+         t.Errorf("registered %q in %q", test.boxType, test.parent)
+      }
+   }
+}
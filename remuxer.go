@@ -6,6 +6,8 @@ import (
    "errors"
    "fmt"
    "io"
+   "os"
+   "time"
 )
 
 type RemuxSample struct {
@@ -16,14 +18,45 @@ type RemuxSample struct {
 }
 
 type Remuxer struct {
-   Writer              io.WriteSeeker
-   Moov                *MoovBox
-   samples             []RemuxSample
-   chunkOffsets        []uint64
-   segmentSampleCounts []uint32
-   mdatStartOffset     int64
-   segmentCount        int
-   OnSample            func(data []byte, sample *SencSample)
+   Writer          io.WriteSeeker
+   Moov            *MoovBox
+   index           sampleIndex
+   mdatStartOffset int64
+   segmentCount    int
+   OnSample        func(data []byte, sample *SencSample)
+   // Transform, if set, is called after OnSample with each sample, and
+   // returns the data written in its place, which may differ in length,
+   // such as with SEI NAL units or ADTS headers stripped. The tables record
+   // the new sizes.
+   Transform func(data []byte, sample RemuxSample) []byte
+   // Start and End, if set, trim the output to that range of the decode
+   // timeline given by tfdt and the sample durations. Output begins at the
+   // last sync sample at or before Start, with an edit list so that
+   // playback begins at Start. An End of zero means the end of the input.
+   Start, End  time.Duration
+   decodeTime  uint64 // of the next sample
+   trimStarted bool
+   trimOrigin  uint64 // decode time of the first sample written
+   held        []RemuxSample
+   heldData    []byte
+   // Lenient makes AddSegment salvage what it can of malformed segments,
+   // such as the complete samples of a cut short mdat, recording each
+   // problem in Warnings instead of failing.
+   Lenient  bool
+   Warnings []error
+   // Output, if set, makes the Remuxer work without seeking it: samples
+   // are spooled to Spool, or to a temporary file if Spool is nil, and
+   // Finish writes ftyp, moov and mdat to Output in a single pass. Writer
+   // is then unused.
+   Output      io.Writer
+   Spool       io.ReadWriteSeeker
+   spoolFile   *os.File
+   ftyp        []byte
+   initSegment []byte
+   inits       [][]byte // added by AddInit
+   description uint32   // stsd entry of the samples, from 1
+   rebase      bool     // until the first tfdt after AddInit
+   tfdtOffset  int64    // added to tfdt for a continuous timeline
 }
 
 func (r *Remuxer) AddSegment(segmentData []byte) error {
@@ -31,25 +64,55 @@ func (r *Remuxer) AddSegment(segmentData []byte) error {
       return errors.New("must call Initialize")
    }
    r.segmentCount++
-   boxes, err := DecodeBoxes(segmentData)
+   d := decoder{lenient: r.Lenient}
+   boxes, err := d.decodeBoxes(segmentData)
    if err != nil {
       return fmt.Errorf("parsing segment %d: %w", r.segmentCount, err)
    }
    var pendingMoof *MoofBox
+   var offset int64
    for i, box := range boxes {
+      boxOffset := offset
+      offset += box.size(int64(len(segmentData)) - offset)
       if box.Moof != nil {
          pendingMoof = box.Moof
          continue
       }
       if box.Mdat != nil {
          if pendingMoof != nil {
-            if err := r.processFragment(pendingMoof, box.Mdat); err != nil {
-               return fmt.Errorf("processing fragment at box index %d: %w", i, err)
+            d.path, d.offset = []string{"mdat"}, boxOffset
+            if err := r.processFragment(pendingMoof, box.Mdat, &d); err != nil {
+               return fmt.Errorf(
+                  "segment %d: processing fragment at box index %d: %w",
+                  r.segmentCount, i, err,
+               )
             }
             pendingMoof = nil
          }
       }
    }
+   for _, warning := range d.warnings {
+      r.Warnings = append(
+         r.Warnings, fmt.Errorf("segment %d: %w", r.segmentCount, warning),
+      )
+   }
+   return nil
+}
+
+// AddByteRanges reads each range from src and adds it as a segment.
+func (r *Remuxer) AddByteRanges(src io.ReaderAt, ranges []ByteRange) error {
+   for _, byteRange := range ranges {
+      data := make([]byte, byteRange.Size)
+      if err := readAt(src, data, byteRange.Start); err != nil {
+         return fmt.Errorf(
+            "reading range %d-%d: %w", byteRange.Start,
+            byteRange.Start+byteRange.Size-1, err,
+         )
+      }
+      if err := r.AddSegment(data); err != nil {
+         return err
+      }
+   }
    return nil
 }
 
@@ -57,89 +120,203 @@ func (r *Remuxer) Finish() error {
    if r.Moov == nil {
       return errors.New("not initialized")
    }
+   if r.Output != nil {
+      return r.finishOutput()
+   }
    mdatEndOffset, err := r.Writer.Seek(0, io.SeekCurrent)
    if err != nil {
       return fmt.Errorf("seeking to get mdat end offset: %w", err)
    }
    finalMdatSize := uint64(mdatEndOffset - r.mdatStartOffset)
-   var totalDuration uint64
-   for _, sample := range r.samples {
-      totalDuration += uint64(sample.Duration)
-   }
-   stts := buildStts(r.samples)
-   stsz := buildStsz(r.samples)
-   stsc := buildStsc(r.segmentSampleCounts)
-   offsetBox := buildChunkOffsetBox(r.chunkOffsets)
-   stss := buildStss(r.samples)
-   ctts := buildCtts(r.samples)
+   stbl, err := r.prepareMoov()
+   if err != nil {
+      return err
+   }
+   moovBytes := r.encodeMoov(stbl, r.index.chunkOffsets)
+   if _, err := r.Writer.Write(moovBytes); err != nil {
+      return err
+   }
+   if _, err := r.Writer.Seek(r.mdatStartOffset+8, io.SeekStart); err != nil {
+      return fmt.Errorf("seeking to patch mdat size: %w", err)
+   }
+   var sizeBuf [8]byte
+   binary.BigEndian.PutUint64(sizeBuf[:], finalMdatSize)
+   if _, err := r.Writer.Write(sizeBuf[:]); err != nil {
+      return err
+   }
+   if _, err := r.Writer.Seek(0, io.SeekEnd); err != nil {
+      return fmt.Errorf("seeking to end of file: %w", err)
+   }
+   return nil
+}
+
+// Close removes the temporary file samples are spooled to when Output is
+// set and Spool is nil. Finish does so itself; Close is for a remux that is
+// abandoned, such as after an error, and may be deferred.
+func (r *Remuxer) Close() error {
+   if r.spoolFile == nil {
+      return nil
+   }
+   file := r.spoolFile
+   r.spoolFile = nil
+   file.Close()
+   return os.Remove(file.Name())
+}
 
+// finishOutput writes ftyp, moov and mdat to Output, copying the mdat
+// payload from the spool.
+func (r *Remuxer) finishOutput() error {
+   defer r.Close()
+   spoolEnd, err := r.Spool.Seek(0, io.SeekCurrent)
+   if err != nil {
+      return fmt.Errorf("seeking to get spool end offset: %w", err)
+   }
+   payloadSize := spoolEnd - r.mdatStartOffset
+   stbl, err := r.prepareMoov()
+   if err != nil {
+      return err
+   }
+   // the chunk offsets depend on the size of moov, which can grow from
+   // stco to co64 as they do
+   offsets := make([]uint64, len(r.index.chunkOffsets))
+   var moovBytes []byte
+   for moovSize := 0; ; moovSize = len(moovBytes) {
+      mdatPayloadStart := int64(len(r.ftyp) + moovSize + 16)
+      for i, offset := range r.index.chunkOffsets {
+         offsets[i] = offset - uint64(r.mdatStartOffset) + uint64(mdatPayloadStart)
+      }
+      moovBytes = r.encodeMoov(stbl, offsets)
+      if len(moovBytes) == moovSize {
+         break
+      }
+   }
+   if _, err := r.Output.Write(r.ftyp); err != nil {
+      return err
+   }
+   if _, err := r.Output.Write(moovBytes); err != nil {
+      return err
+   }
+   mdatHeader := make([]byte, 16)
+   binary.BigEndian.PutUint32(mdatHeader[0:4], 1)
+   copy(mdatHeader[4:8], []byte("mdat"))
+   binary.BigEndian.PutUint64(mdatHeader[8:], uint64(16+payloadSize))
+   if _, err := r.Output.Write(mdatHeader); err != nil {
+      return err
+   }
+   if _, err := r.Spool.Seek(r.mdatStartOffset, io.SeekStart); err != nil {
+      return fmt.Errorf("seeking to start of spool: %w", err)
+   }
+   if _, err := io.CopyN(r.Output, r.Spool, payloadSize); err != nil {
+      return fmt.Errorf("copying spooled samples: %w", err)
+   }
+   return nil
+}
+
+// prepareMoov sets the durations of moov for the samples added, and
+// removes the boxes that only apply to fragmented or protected files.
+func (r *Remuxer) prepareMoov() (*StblBox, error) {
+   totalDuration := r.index.duration
    if len(r.Moov.Trak) == 0 {
-      return errors.New("cannot finish remux: no trak in moov")
+      return nil, errors.New("cannot finish remux: no trak in moov")
    }
    trak := r.Moov.Trak[0]
    if trak.Mdia == nil {
-      return errors.New("missing mdia")
+      return nil, errors.New("missing mdia")
    }
    mdia := trak.Mdia
    if mdia.Minf == nil {
-      return errors.New("missing minf")
+      return nil, errors.New("missing minf")
    }
    minf := mdia.Minf
    if minf.Stbl == nil {
-      return errors.New("missing stbl")
+      return nil, errors.New("missing stbl")
    }
    stbl := minf.Stbl
    mdhd := mdia.Mdhd
    if mdhd == nil {
-      return errors.New("missing mdhd")
+      return nil, errors.New("missing mdhd")
    }
    mdhd.SetDuration(totalDuration)
+   r.Moov.RemoveMvex()
+   r.Moov.RemovePssh()
+   trak.RemoveEdts()
+   if r.trimStarted {
+      edts, err := r.trimEdts()
+      if err != nil {
+         return nil, err
+      }
+      trak.Edts = edts
+      totalDuration = edts.Elst.Entries[0].SegmentDuration
+   }
+   if tkhd := trak.Tkhd; tkhd != nil {
+      tkhd.SetDuration(totalDuration) // mvhd takes the mdhd timescale below
+   }
    if mvhd := r.Moov.Mvhd; mvhd != nil {
       mvhd.Timescale = mdhd.Timescale
       mvhd.SetDuration(totalDuration)
    }
-   r.Moov.RemoveMvex()
-   trak.RemoveEdts()
-   stbl.RawChildren = nil // Clear existing table boxes
    if stbl.Stsd == nil {
-      return errors.New("missing stsd")
+      return nil, errors.New("missing stsd")
    }
    stbl.Stsd.RemoveSinf()
-   stbl.RawChildren = append(stbl.RawChildren, stts)
-   if ctts != nil {
+   return stbl, nil
+}
+
+// encodeMoov encodes moov with the sample tables of stbl replaced by those
+// of the samples added, in chunks at offsets.
+func (r *Remuxer) encodeMoov(stbl *StblBox, offsets []uint64) []byte {
+   stbl.Custom = nil
+   stbl.RawChildren = nil // Clear existing table boxes
+   stbl.RawChildren = append(stbl.RawChildren, r.index.buildStts())
+   if ctts := r.index.buildCtts(); ctts != nil {
       stbl.RawChildren = append(stbl.RawChildren, ctts)
    }
-   stbl.RawChildren = append(stbl.RawChildren, stsz)
-   stbl.RawChildren = append(stbl.RawChildren, stsc)
-   stbl.RawChildren = append(stbl.RawChildren, offsetBox)
-   if stss != nil {
+   stbl.RawChildren = append(stbl.RawChildren, r.index.buildStsz())
+   stbl.RawChildren = append(stbl.RawChildren, r.index.buildStsc())
+   stbl.RawChildren = append(stbl.RawChildren, buildChunkOffsetBox(offsets))
+   if stss := r.index.buildStss(); stss != nil {
       stbl.RawChildren = append(stbl.RawChildren, stss)
    }
-   moovBytes := r.Moov.Encode()
-   if _, err := r.Writer.Write(moovBytes); err != nil {
-      return err
-   }
-   if _, err := r.Writer.Seek(r.mdatStartOffset+8, io.SeekStart); err != nil {
-      return fmt.Errorf("seeking to patch mdat size: %w", err)
-   }
-   var sizeBuf [8]byte
-   binary.BigEndian.PutUint64(sizeBuf[:], finalMdatSize)
-   if _, err := r.Writer.Write(sizeBuf[:]); err != nil {
-      return err
-   }
-   if _, err := r.Writer.Seek(0, io.SeekEnd); err != nil {
-      return fmt.Errorf("seeking to end of file: %w", err)
-   }
-   return nil
+   return r.Moov.Encode()
 }
 
 func (r *Remuxer) Initialize(initSegment []byte) error {
    if r.Moov != nil {
       return errors.New("already initialized")
    }
-   if r.Writer == nil {
+   if r.Writer == nil && r.Output == nil {
       return errors.New("writer is nil")
    }
+   if err := r.decodeInit(initSegment); err != nil {
+      return err
+   }
+   var err error
+   if r.Output != nil && r.Spool == nil {
+      r.spoolFile, err = os.CreateTemp("", "sofia-*")
+      if err != nil {
+         r.Moov = nil
+         return fmt.Errorf("creating spool file: %w", err)
+      }
+      r.Spool = r.spoolFile
+   }
+   r.mdatStartOffset, err = r.writer().Seek(0, io.SeekCurrent)
+   if err != nil {
+      r.Close()
+      return fmt.Errorf("seeking to get current position: %w", err)
+   }
+   if r.Output != nil {
+      return nil // the mdat header is written by Finish
+   }
+   mdatHeader := make([]byte, 16)
+   binary.BigEndian.PutUint32(mdatHeader[0:4], 1)
+   copy(mdatHeader[4:8], []byte("mdat"))
+   _, err = r.Writer.Write(mdatHeader)
+   return err
+}
+
+// decodeInit sets Moov from the init segment, keeping the segment for
+// Checkpoint and its ftyp for Output.
+func (r *Remuxer) decodeInit(initSegment []byte) error {
    boxes, err := DecodeBoxes(initSegment)
    if err != nil {
       return fmt.Errorf("parsing init segment: %w", err)
@@ -148,105 +325,114 @@ func (r *Remuxer) Initialize(initSegment []byte) error {
    if !ok {
       return errors.New("no moov found")
    }
-   r.Moov = moovPtr
-   if len(r.Moov.Trak) == 0 {
+   if len(moovPtr.Trak) == 0 {
       return errors.New("no trak found")
    }
-   r.mdatStartOffset, err = r.Writer.Seek(0, io.SeekCurrent)
-   if err != nil {
-      return fmt.Errorf("seeking to get current position: %w", err)
+   for _, box := range boxes {
+      if boxType(box) == "ftyp" {
+         r.ftyp = box.Encode()
+      }
    }
-   mdatHeader := make([]byte, 16)
-   binary.BigEndian.PutUint32(mdatHeader[0:4], 1)
-   copy(mdatHeader[4:8], []byte("mdat"))
-   _, err = r.Writer.Write(mdatHeader)
-   return err
+   r.Moov = moovPtr
+   r.initSegment = initSegment
+   r.description = 1
+   return nil
 }
 
-func (r *Remuxer) processFragment(moof *MoofBox, mdat *MdatBox) error {
+// writer is where the sample payloads go.
+func (r *Remuxer) writer() io.WriteSeeker {
+   if r.Output != nil {
+      return r.Spool
+   }
+   return r.Writer
+}
+
+// processFragment copies the samples of mdat to the output. d holds the
+// location of mdat, for reporting a payload that is too short.
+func (r *Remuxer) processFragment(moof *MoofBox, mdat *MdatBox, d *decoder) error {
    traf := moof.Traf
    if traf == nil {
       return nil
    }
-   tfhd := traf.Tfhd
-   if tfhd == nil {
+   if traf.Tfhd == nil {
       return nil
    }
    senc := traf.Senc
-   sencIndex := 0
+   trimming := r.Start > 0 || r.End > 0
+   decodeTime := r.decodeTime
+   if traf.Tfdt != nil {
+      tfdt := int64(traf.Tfdt.BaseMediaDecodeTime)
+      if r.rebase {
+         // the source carries on from the last one
+         r.tfdtOffset = int64(r.decodeTime) - tfdt
+         r.rebase = false
+      }
+      decodeTime = uint64(tfdt + r.tfdtOffset)
+   }
    var newSamples []RemuxSample
-   defDur := tfhd.DefaultSampleDuration
-   defSize := tfhd.DefaultSampleSize
-   defFlags := tfhd.DefaultSampleFlags
    mdatOffset := 0
-   for _, trun := range traf.Trun {
-      for i, sample := range trun.Samples {
-         remuxSample := RemuxSample{
-            Duration:              defDur,
-            Size:                  defSize,
-            IsSync:                true,
-            CompositionTimeOffset: 0,
-         }
-         currentFlags := defFlags
-         // NOTE: The order of these two flag checks matters!
-         // Per ISO/IEC 14496-12, if both sample_flags_present (0x000400) and
-         // first_sample_flags_present (0x000004) are set, FirstSampleFlags
-         // must OVERRIDE sample.Flags for the first sample (i==0).
-         // Therefore, we must check sample_flags_present FIRST, then let
-         // first_sample_flags_present overwrite it for i==0.
-         // DO NOT swap these blocks, or FirstSampleFlags will be clobbered
-         // by sample.Flags and the keyframe (sync sample) detection will be
-         // corrupted for the first sample of each trun.
-         if (trun.Flags & 0x000400) != 0 {
-            currentFlags = sample.Flags
-         }
-         if i == 0 && (trun.Flags&0x000004) != 0 {
-            currentFlags = trun.FirstSampleFlags
-         }
-         if (trun.Flags & 0x000100) != 0 {
-            remuxSample.Duration = sample.Duration
-         }
-         if (trun.Flags & 0x000200) != 0 {
-            remuxSample.Size = sample.Size
-         }
-         if (trun.Flags & 0x000800) != 0 {
-            remuxSample.CompositionTimeOffset = sample.CompositionTimeOffset
-         }
-         if (currentFlags & 0x00010000) != 0 {
-            remuxSample.IsSync = false
-         } else {
-            remuxSample.IsSync = true
-         }
-         originalSize := int(remuxSample.Size)
-         if mdatOffset+originalSize > len(mdat.Payload) {
-            return errors.New("mdat payload too short for samples")
+   payload := mdat.Payload
+   var copied []byte // the payload, if samples are transformed or trimmed
+   for i, remuxSample := range traf.samples() {
+      originalSize := int(remuxSample.Size)
+      if mdatOffset+originalSize > len(mdat.Payload) {
+         err := d.error(errShortMdat, mdatOffset+originalSize, len(mdat.Payload))
+         if !d.lenient {
+            return err
          }
-         sampleData := mdat.Payload[mdatOffset : mdatOffset+originalSize]
-         var encInfo *SencSample
-         if senc != nil && sencIndex < len(senc.Samples) {
-            encInfo = &senc.Samples[sencIndex]
-            sencIndex++
+         d.warn(err)
+         payload = mdat.Payload[:mdatOffset]
+         break
+      }
+      sampleData := mdat.Payload[mdatOffset : mdatOffset+originalSize]
+      mdatOffset += originalSize
+      sampleTime := decodeTime
+      decodeTime += uint64(remuxSample.Duration)
+      var encInfo *SencSample
+      if senc != nil && i < len(senc.Samples) {
+         encInfo = &senc.Samples[i]
+      }
+      if r.OnSample != nil {
+         r.OnSample(sampleData, encInfo)
+      }
+      if r.Transform != nil {
+         sampleData = r.Transform(sampleData, remuxSample)
+         remuxSample.Size = uint32(len(sampleData))
+      }
+      if trimming {
+         held, heldData, keep, err := r.trim(sampleTime, remuxSample, sampleData)
+         if err != nil {
+            return err
          }
-         if r.OnSample != nil {
-            r.OnSample(sampleData, encInfo)
+         if !keep {
+            continue
          }
-         newSamples = append(newSamples, remuxSample)
-         mdatOffset += originalSize
+         newSamples = append(newSamples, held...)
+         copied = append(copied, heldData...)
       }
+      if r.Transform != nil || trimming {
+         copied = append(copied, sampleData...)
+      }
+      newSamples = append(newSamples, remuxSample)
    }
+   r.decodeTime = decodeTime
 
    if len(newSamples) == 0 {
       return nil
    }
-   currentPos, err := r.Writer.Seek(0, io.SeekCurrent)
+   if r.Transform != nil || trimming {
+      payload = copied
+   }
+   currentPos, err := r.writer().Seek(0, io.SeekCurrent)
    if err != nil {
       return fmt.Errorf("seeking to get chunk offset: %w", err)
    }
-   r.chunkOffsets = append(r.chunkOffsets, uint64(currentPos))
-   if _, err := r.Writer.Write(mdat.Payload); err != nil {
+   if _, err := r.writer().Write(payload); err != nil {
       return err
    }
-   r.samples = append(r.samples, newSamples...)
-   r.segmentSampleCounts = append(r.segmentSampleCounts, uint32(len(newSamples)))
+   for _, sample := range newSamples {
+      r.index.add(sample)
+   }
+   r.index.addChunk(uint64(currentPos), uint32(len(newSamples)), r.description)
    return nil
 }
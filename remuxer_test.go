@@ -0,0 +1,66 @@
+// remuxer_test.go
+package sofia
+
+import (
+   "bytes"
+   "errors"
+   "io/fs"
+   "os"
+   "testing"
+)
+
+func TestRemuxerClose(t *testing.T) {
+   var b bytes.Buffer
+   r := Remuxer{Output: &b}
+   if err := r.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   spool := r.spoolFile.Name()
+   segment := testFragment(1, 0, []TrunSample{testSample(10, 3000, true, 0)})
+   if err := r.AddSegment(segment[:len(segment)-1]); err == nil {
+      t.Fatal("added a malformed segment")
+   }
+   if err := r.Close(); err != nil {
+      t.Fatal(err)
+   }
+   if _, err := os.Stat(spool); !errors.Is(err, fs.ErrNotExist) {
+      t.Errorf("spool file %s left behind: %v", spool, err)
+   }
+   if err := r.Close(); err != nil {
+      t.Errorf("second Close: %v", err)
+   }
+}
+
+func TestRemuxerTransform(t *testing.T) {
+   // each sample loses a byte and starts with its number instead
+   var count byte
+   data := testRemux(t, true, func(r *Remuxer) error {
+      r.Transform = func(data []byte, _ RemuxSample) []byte {
+         count++
+         return append([]byte{count}, data[2:]...)
+      }
+      for _, segment := range testSegments() {
+         if err := r.AddSegment(segment); err != nil {
+            return err
+         }
+      }
+      return nil
+   })
+   samples := testSamples(t, data)
+   if len(samples) != 6 {
+      t.Fatalf("got %d samples, want 6", len(samples))
+   }
+   for i, sample := range samples {
+      // the segments hold samples of 10+i and 4 bytes
+      want := uint32(3)
+      if i%2 == 0 {
+         want = uint32(9 + i/2)
+      }
+      if sample.size != want {
+         t.Errorf("sample %d: size %d, want %d", i, sample.size, want)
+      }
+      if sample.offset != uint64(i+1) {
+         t.Errorf("sample %d: starts with %d, want %d", i, sample.offset, i+1)
+      }
+   }
+}
@@ -0,0 +1,269 @@
+// sidx.go
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "io"
+)
+
+// ByteRange is a media subsegment located through a sidx.
+type ByteRange struct {
+   Start         int64 // file offset of the first byte
+   Size          int64
+   Time          uint64 // earliest presentation time, in Timescale
+   Duration      uint64 // in Timescale
+   Timescale     uint32
+   StartsWithSAP bool
+}
+
+// Ranges returns the media subsegments indexed by the sidx, which starts
+// at file offset offset. References to further sidx boxes are followed by
+// reading them from src, which may be nil if there are none.
+func (b *SidxBox) Ranges(offset int64, src io.ReaderAt) ([]ByteRange, error) {
+   var ranges []ByteRange
+   // the references start at the first byte after the sidx, plus FirstOffset
+   start := offset + int64(b.Header.Size) + int64(b.FirstOffset)
+   time := b.EarliestPresentationTime
+   for i, ref := range b.References {
+      if ref.ReferenceType {
+         if src == nil {
+            return nil, errors.New("hierarchical sidx needs a reader")
+         }
+         nested, err := ReadSidx(src, start)
+         if err != nil {
+            return nil, fmt.Errorf("reading sidx of reference %d: %w", i, err)
+         }
+         nestedRanges, err := nested.Ranges(start, src)
+         if err != nil {
+            return nil, err
+         }
+         ranges = append(ranges, nestedRanges...)
+      } else {
+         ranges = append(ranges, ByteRange{
+            Start:         start,
+            Size:          int64(ref.ReferencedSize),
+            Time:          time,
+            Duration:      uint64(ref.SubsegmentDuration),
+            Timescale:     b.Timescale,
+            StartsWithSAP: ref.StartsWithSAP,
+         })
+      }
+      start += int64(ref.ReferencedSize)
+      time += uint64(ref.SubsegmentDuration)
+   }
+   return ranges, nil
+}
+
+// maxSidxSize is the size of a version 1 sidx with the most references
+// reference_count allows.
+const maxSidxSize = 40 + 12*0xFFFF
+
+// ReadSidx decodes the sidx box at file offset offset.
+func ReadSidx(src io.ReaderAt, offset int64) (*SidxBox, error) {
+   var header [8]byte
+   if err := readAt(src, header[:], offset); err != nil {
+      return nil, fmt.Errorf("reading box header at offset %d: %w", offset, err)
+   }
+   if string(header[4:]) != "sidx" {
+      return nil, fmt.Errorf("expected sidx at offset %d, found %q", offset, header[4:])
+   }
+   size := binary.BigEndian.Uint32(header[:])
+   if size < 8 {
+      return nil, &BoxError{
+         Path: "sidx", Offset: offset, Expected: 8, Actual: int(size),
+         Err: errInvalidSize,
+      }
+   }
+   // the size is read before anything checks it, so keep a corrupt one from
+   // allocating gigabytes
+   if size > maxSidxSize {
+      return nil, &BoxError{
+         Path: "sidx", Offset: offset, Expected: maxSidxSize, Actual: int(size),
+         Err: errInvalidSize,
+      }
+   }
+   data := make([]byte, size)
+   if err := readAt(src, data, offset); err != nil {
+      return nil, fmt.Errorf("reading sidx at offset %d: %w", offset, err)
+   }
+   var d decoder
+   d.path, d.offset = []string{"sidx"}, offset
+   sidx, err := DecodeSidxBox(data)
+   return sidx, d.wrap(err)
+}
+
+// readAt fills p from src at offset. A full read is a success even with an
+// error, such as the io.EOF io.ReaderAt allows at the end of the input.
+func readAt(src io.ReaderAt, p []byte, offset int64) error {
+   n, err := src.ReadAt(p, offset)
+   if n == len(p) {
+      return nil
+   }
+   if err == nil {
+      err = io.ErrUnexpectedEOF
+   }
+   return err
+}
+
+// BuildSidx indexes the moof and mdat pairs of data, one reference per
+// moof. Boxes such as styp, emsg or prft directly ahead of a moof count as
+// part of its subsegment. timescale is that of the track, from mdhd. The
+// sidx is meant to go directly ahead of the first subsegment, so
+// FirstOffset is 0.
+func BuildSidx(data []byte, timescale uint32) (*SidxBox, error) {
+   subsegments, err := findSubsegments(data)
+   if err != nil {
+      return nil, err
+   }
+   return buildSidx(subsegments, timescale)
+}
+
+func buildSidx(subsegments []subsegment, timescale uint32) (*SidxBox, error) {
+   if len(subsegments) == 0 {
+      return nil, errors.New("no moof to index")
+   }
+   b := &SidxBox{
+      Header:    &BoxHeader{Type: [4]byte{'s', 'i', 'd', 'x'}},
+      Timescale: timescale,
+   }
+   for i, sub := range subsegments {
+      traf := sub.moof.Traf
+      if traf == nil || traf.Tfhd == nil {
+         return nil, fmt.Errorf("moof %d has no traf with tfhd", i)
+      }
+      if traf.Tfdt == nil {
+         return nil, fmt.Errorf("moof %d has no tfdt", i)
+      }
+      if i == 0 {
+         b.ReferenceID = traf.Tfhd.TrackID
+      }
+      samples := traf.samples()
+      if len(samples) == 0 {
+         return nil, fmt.Errorf("moof %d has no samples", i)
+      }
+      // earliest presentation time over all the samples
+      decodeTime := traf.Tfdt.BaseMediaDecodeTime
+      var earliest, duration uint64
+      for j, sample := range samples {
+         presentation := uint64(int64(decodeTime) + int64(sample.CompositionTimeOffset))
+         if j == 0 || presentation < earliest {
+            earliest = presentation
+         }
+         decodeTime += uint64(sample.Duration)
+         duration += uint64(sample.Duration)
+      }
+      if i == 0 {
+         b.EarliestPresentationTime = earliest
+      }
+      // referenced_size has 31 bits
+      if sub.size > 0x7FFFFFFF {
+         return nil, fmt.Errorf("moof %d: subsegment of %d bytes is too large for sidx", i, sub.size)
+      }
+      if duration > 0xFFFFFFFF {
+         return nil, fmt.Errorf("moof %d: subsegment duration %d is too long for sidx", i, duration)
+      }
+      ref := SidxReference{
+         ReferencedSize:     uint32(sub.size),
+         SubsegmentDuration: uint32(duration),
+      }
+      if first := samples[0]; first.IsSync {
+         ref.StartsWithSAP = true
+         ref.SAPType = 1
+         firstPresentation := int64(traf.Tfdt.BaseMediaDecodeTime) +
+            int64(first.CompositionTimeOffset)
+         if uint64(firstPresentation) != earliest {
+            ref.SAPType = 3 // leading samples are presented first
+         }
+      }
+      b.References = append(b.References, ref)
+   }
+   if b.EarliestPresentationTime > 0xFFFFFFFF {
+      b.Version = 1
+   }
+   return b, nil
+}
+
+// InsertSidx returns a copy of data with a sidx from BuildSidx inserted
+// ahead of the first subsegment.
+func InsertSidx(data []byte, timescale uint32) ([]byte, error) {
+   subsegments, err := findSubsegments(data)
+   if err != nil {
+      return nil, err
+   }
+   sidx, err := buildSidx(subsegments, timescale)
+   if err != nil {
+      return nil, err
+   }
+   start := subsegments[0].start
+   encoded := sidx.Encode()
+   output := make([]byte, 0, len(data)+len(encoded))
+   output = append(output, data[:start]...)
+   output = append(output, encoded...)
+   return append(output, data[start:]...), nil
+}
+
+type subsegment struct {
+   start int64
+   size  int64
+   moof  *MoofBox
+}
+
+// findSubsegments splits data into subsegments, each running from a moof,
+// or the boxes leading up to it, to the next one. The last one ends with
+// its mdat, ahead of any mfra or free box.
+func findSubsegments(data []byte) ([]subsegment, error) {
+   boxes, err := DecodeBoxes(data)
+   if err != nil {
+      return nil, err
+   }
+   var subsegments []subsegment
+   var offset, end int64  // end of the last moof or mdat
+   leadStart := int64(-1) // start of the boxes leading up to a moof
+   for _, box := range boxes {
+      boxOffset := offset
+      offset += box.size(int64(len(data)) - offset)
+      if box.Mdat != nil {
+         end = offset
+      }
+      if box.Moof == nil {
+         switch boxType(box) {
+         case "styp", "emsg", "prft":
+            if leadStart < 0 {
+               leadStart = boxOffset
+            }
+         default:
+            leadStart = -1
+         }
+         continue
+      }
+      start := boxOffset
+      if leadStart >= 0 {
+         start = leadStart
+         leadStart = -1
+      }
+      if count := len(subsegments); count > 0 {
+         subsegments[count-1].size = start - subsegments[count-1].start
+      }
+      subsegments = append(subsegments, subsegment{start: start, moof: box.Moof})
+      end = offset
+   }
+   if count := len(subsegments); count > 0 {
+      last := &subsegments[count-1]
+      last.size = end - last.start
+   }
+   return subsegments, nil
+}
+
+func boxType(box Box) string {
+   switch {
+   case box.Mdat != nil:
+      return "mdat"
+   case box.Custom != nil:
+      return box.Custom.Type()
+   case len(box.Raw) >= 8:
+      return string(box.Raw[4:8])
+   }
+   return ""
+}
@@ -0,0 +1,153 @@
+// sidx_test.go
+package sofia
+
+import (
+   "errors"
+   "io"
+   "testing"
+)
+
+func TestBuildSidx(t *testing.T) {
+   leading := []TrunSample{
+      testSample(10, 3000, true, 6000),
+      testSample(10, 3000, false, 0), // presented ahead of the sync sample
+      testSample(10, 3000, false, 3000),
+   }
+   first := testFragment(1, 0, []TrunSample{
+      testSample(10, 3000, true, 0), testSample(10, 3000, false, 0),
+   })
+   second := testFragment(2, 6000, leading)
+   // a size of 0 runs to the end of the data
+   last := len(second) - 8 - 30
+   second[last], second[last+1], second[last+2], second[last+3] = 0, 0, 0, 0
+
+   sidx, err := BuildSidx(append(first, second...), testTimescale)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(sidx.References) != 2 {
+      t.Fatalf("got %d references, want 2", len(sidx.References))
+   }
+   want := []SidxReference{
+      {ReferencedSize: uint32(len(first)), SubsegmentDuration: 6000, StartsWithSAP: true, SAPType: 1},
+      {ReferencedSize: uint32(len(second)), SubsegmentDuration: 9000, StartsWithSAP: true, SAPType: 3},
+   }
+   for i, ref := range sidx.References {
+      if ref != want[i] {
+         t.Errorf("reference %d: got %+v, want %+v", i, ref, want[i])
+      }
+   }
+}
+
+// eofReaderAt returns io.EOF with a read that reaches the end, as
+// io.ReaderAt allows.
+type eofReaderAt []byte
+
+func (e eofReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+   n := copy(p, e[offset:])
+   if offset+int64(n) == int64(len(e)) {
+      return n, io.EOF
+   }
+   return n, nil
+}
+
+func TestReadSidxEOF(t *testing.T) {
+   fragment := testFragment(1, 0, []TrunSample{testSample(10, 3000, true, 0)})
+   sidx, err := BuildSidx(fragment, testTimescale)
+   if err != nil {
+      t.Fatal(err)
+   }
+   data := sidx.Encode()
+   if _, err := ReadSidx(eofReaderAt(data), 0); err != nil {
+      t.Fatal(err)
+   }
+   if _, err := ReadSidx(eofReaderAt(data[:len(data)-1]), 0); err == nil {
+      t.Error("read a cut short sidx")
+   }
+}
+
+func TestRangesHierarchical(t *testing.T) {
+   // a sidx indexing two sidx boxes, each directly ahead of its subsegment
+   var nested [][]byte
+   var sidxSize int
+   for i := range 2 {
+      fragment := testFragment(uint32(i+1), uint64(i)*3000, []TrunSample{
+         testSample(10, 3000, true, 0),
+      })
+      sidx, err := BuildSidx(fragment, testTimescale)
+      if err != nil {
+         t.Fatal(err)
+      }
+      encoded := sidx.Encode()
+      sidxSize = len(encoded)
+      nested = append(nested, append(encoded, fragment...))
+   }
+   top := &SidxBox{
+      Header:    &BoxHeader{Type: [4]byte{'s', 'i', 'd', 'x'}},
+      Timescale: testTimescale,
+   }
+   for _, data := range nested {
+      top.References = append(top.References, SidxReference{
+         ReferenceType:      true,
+         ReferencedSize:     uint32(len(data)),
+         SubsegmentDuration: 3000,
+      })
+   }
+   data := top.Encode()
+   for _, sub := range nested {
+      data = append(data, sub...)
+   }
+   ranges, err := top.Ranges(0, eofReaderAt(data))
+   if err != nil {
+      t.Fatal(err)
+   }
+   start := int64(top.Header.Size) + int64(sidxSize)
+   want := []ByteRange{
+      {Start: start, Size: int64(len(nested[0]) - sidxSize), Time: 0},
+      {
+         Start: start + int64(len(nested[0])), Size: int64(len(nested[1]) - sidxSize),
+         Time: 3000,
+      },
+   }
+   if len(ranges) != len(want) {
+      t.Fatalf("got %d ranges, want %d", len(ranges), len(want))
+   }
+   for i := range want {
+      want[i].Duration, want[i].Timescale, want[i].StartsWithSAP = 3000, testTimescale, true
+      if ranges[i] != want[i] {
+         t.Errorf("range %d: got %+v, want %+v", i, ranges[i], want[i])
+      }
+   }
+   if _, err := top.Ranges(0, nil); err == nil {
+      t.Error("followed nested sidx boxes without a reader")
+   }
+}
+
+func TestReadSidxSize(t *testing.T) {
+   // a size of 4 GB, with nothing behind it
+   data := []byte{0xFF, 0xFF, 0xFF, 0xF0, 's', 'i', 'd', 'x'}
+   _, err := ReadSidx(eofReaderAt(data), 0)
+   var boxErr *BoxError
+   if !errors.As(err, &boxErr) || boxErr.Expected != maxSidxSize {
+      t.Errorf("got %v, want a size error", err)
+   }
+}
+
+func TestBuildSidxTrailing(t *testing.T) {
+   first := testFragment(1, 0, []TrunSample{testSample(10, 3000, true, 0)})
+   second := testFragment(2, 3000, []TrunSample{testSample(10, 3000, true, 0)})
+   // an mfra and a styp with no moof behind it are not part of the last
+   // subsegment
+   data := append(first, second...)
+   data = append(data, containerBox("mfra", containerBox("mfro", make([]byte, 8)))...)
+   data = append(data, containerBox("styp", []byte("msdh"))...)
+   sidx, err := BuildSidx(data, testTimescale)
+   if err != nil {
+      t.Fatal(err)
+   }
+   for i, want := range []int{len(first), len(second)} {
+      if got := sidx.References[i].ReferencedSize; got != uint32(want) {
+         t.Errorf("reference %d: size %d, want %d", i, got, want)
+      }
+   }
+}
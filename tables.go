@@ -1,8 +1,6 @@
 // tables.go
 package sofia
 
-import "errors"
-
 // buildChunkOffsetBox decides whether to use stco or co64.
 func buildChunkOffsetBox(offsets []uint64) []byte {
    use64bit := false
@@ -28,100 +26,6 @@ func buildChunkOffsetBox(offsets []uint64) []byte {
    return box.Encode()
 }
 
-func buildCtts(samples []RemuxSample) []byte {
-   hasCTO := false
-   for _, sample := range samples {
-      if sample.CompositionTimeOffset != 0 {
-         hasCTO = true
-         break
-      }
-   }
-   if !hasCTO {
-      return nil // No ctts box needed if all offsets are 0
-   }
-
-   var entries []CttsEntry
-   if len(samples) > 0 {
-      currentOffset := samples[0].CompositionTimeOffset
-      currentCount := uint32(0)
-      for _, sample := range samples {
-         if sample.CompositionTimeOffset == currentOffset {
-            currentCount++
-         } else {
-            entries = append(entries, CttsEntry{currentCount, currentOffset})
-            currentOffset = sample.CompositionTimeOffset
-            currentCount = 1
-         }
-      }
-      entries = append(entries, CttsEntry{currentCount, currentOffset})
-   }
-
-   box := CttsBox{Header: &BoxHeader{}, Entries: entries}
-   return box.Encode()
-}
-
-func buildStsc(counts []uint32) []byte {
-   var entries []StscEntry
-   chunkIdx := uint32(1)
-   for _, count := range counts {
-      if len(entries) > 0 {
-         last := &entries[len(entries)-1]
-         if last.SamplesPerChunk == count {
-            chunkIdx++
-            continue
-         }
-      }
-      entries = append(entries, StscEntry{chunkIdx, count, 1})
-      chunkIdx++
-   }
-   box := StscBox{Header: &BoxHeader{}, Entries: entries}
-   return box.Encode()
-}
-
-func buildStss(samples []RemuxSample) []byte {
-   var indices []uint32
-   for i, sample := range samples {
-      if sample.IsSync {
-         indices = append(indices, uint32(i+1))
-      }
-   }
-   if len(indices) == len(samples) {
-      return nil
-   }
-   box := StssBox{Header: &BoxHeader{}, Indices: indices}
-   return box.Encode()
-}
-
-func buildStsz(samples []RemuxSample) []byte {
-   entries := make([]uint32, len(samples))
-   for i, sample := range samples {
-      entries[i] = sample.Size
-   }
-   box := StszBox{Header: &BoxHeader{}, SampleSize: 0, SampleCount: uint32(len(samples)), EntrySizes: entries}
-   return box.Encode()
-}
-
-func buildStts(samples []RemuxSample) []byte {
-   if len(samples) == 0 {
-      return nil
-   }
-   var entries []SttsEntry
-   currentDuration := samples[0].Duration
-   currentCount := uint32(0)
-   for _, sample := range samples {
-      if sample.Duration == currentDuration {
-         currentCount++
-      } else {
-         entries = append(entries, SttsEntry{currentCount, currentDuration})
-         currentDuration = sample.Duration
-         currentCount = 1
-      }
-   }
-   entries = append(entries, SttsEntry{currentCount, currentDuration})
-   box := SttsBox{Header: &BoxHeader{}, Entries: entries}
-   return box.Encode()
-}
-
 // --- CO64 ---
 type Co64Box struct {
    Header  *BoxHeader
@@ -145,6 +49,18 @@ func (b *Co64Box) Encode() []byte {
    return buffer
 }
 
+func DecodeCo64Box(data []byte) (*Co64Box, error) {
+   p, count, err := tableEntries(data, "co64", 8)
+   if err != nil {
+      return nil, err
+   }
+   b := &Co64Box{Header: p.header, Offsets: make([]uint64, count)}
+   for i := range b.Offsets {
+      b.Offsets[i] = p.Uint64()
+   }
+   return b, nil
+}
+
 type CttsBox struct {
    Header  *BoxHeader
    Entries []CttsEntry
@@ -168,6 +84,20 @@ func (b *CttsBox) Encode() []byte {
    return buffer
 }
 
+// DecodeCttsBox reads the offsets as signed in version 0 as well, as
+// writers commonly do.
+func DecodeCttsBox(data []byte) (*CttsBox, error) {
+   p, count, err := tableEntries(data, "ctts", 8)
+   if err != nil {
+      return nil, err
+   }
+   b := &CttsBox{Header: p.header, Entries: make([]CttsEntry, count)}
+   for i := range b.Entries {
+      b.Entries[i] = CttsEntry{p.Uint32(), p.Int32()}
+   }
+   return b, nil
+}
+
 // --- CTTS ---
 type CttsEntry struct {
    SampleCount  uint32
@@ -178,10 +108,16 @@ type CttsEntry struct {
 type StblBox struct {
    Header      *BoxHeader
    Stsd        *StsdBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeStblBox(data []byte) (*StblBox, error) {
+   var d decoder
+   return d.stbl(data)
+}
+
+func (d *decoder) stbl(data []byte) (*StblBox, error) {
    b := &StblBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -189,33 +125,23 @@ func DecodeStblBox(data []byte) (*StblBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "stsd":
-         stsd, err := DecodeStsdBox(content)
+         stsd, err := d.stsd(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Stsd = stsd
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("stbl", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
@@ -225,9 +151,7 @@ func (b *StblBox) Encode() []byte {
    if b.Stsd != nil {
       buffer = append(buffer, b.Stsd.Encode()...)
    }
-   for _, child := range b.RawChildren {
-      buffer = append(buffer, child...)
-   }
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
    b.Header.Size = uint32(len(buffer))
    b.Header.Put(buffer)
    return buffer
@@ -256,6 +180,18 @@ func (b *StcoBox) Encode() []byte {
    return buffer
 }
 
+func DecodeStcoBox(data []byte) (*StcoBox, error) {
+   p, count, err := tableEntries(data, "stco", 4)
+   if err != nil {
+      return nil, err
+   }
+   b := &StcoBox{Header: p.header, Offsets: make([]uint32, count)}
+   for i := range b.Offsets {
+      b.Offsets[i] = p.Uint32()
+   }
+   return b, nil
+}
+
 type StscBox struct {
    Header  *BoxHeader
    Entries []StscEntry
@@ -280,6 +216,18 @@ func (b *StscBox) Encode() []byte {
    return buffer
 }
 
+func DecodeStscBox(data []byte) (*StscBox, error) {
+   p, count, err := tableEntries(data, "stsc", 12)
+   if err != nil {
+      return nil, err
+   }
+   b := &StscBox{Header: p.header, Entries: make([]StscEntry, count)}
+   for i := range b.Entries {
+      b.Entries[i] = StscEntry{p.Uint32(), p.Uint32(), p.Uint32()}
+   }
+   return b, nil
+}
+
 // --- STSC ---
 type StscEntry struct {
    FirstChunk             uint32
@@ -310,6 +258,18 @@ func (b *StssBox) Encode() []byte {
    return buffer
 }
 
+func DecodeStssBox(data []byte) (*StssBox, error) {
+   p, count, err := tableEntries(data, "stss", 4)
+   if err != nil {
+      return nil, err
+   }
+   b := &StssBox{Header: p.header, Indices: make([]uint32, count)}
+   for i := range b.Indices {
+      b.Indices[i] = p.Uint32()
+   }
+   return b, nil
+}
+
 // --- STSZ ---
 type StszBox struct {
    Header      *BoxHeader
@@ -336,6 +296,34 @@ func (b *StszBox) Encode() []byte {
    return buffer
 }
 
+func DecodeStszBox(data []byte) (*StszBox, error) {
+   if len(data) < 20 {
+      return nil, sizeError("stsz too short", 20, len(data))
+   }
+   b := &StszBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   p := parser{data: data, offset: 12}
+   b.SampleSize = p.Uint32()
+   b.SampleCount = p.Uint32()
+   if b.SampleSize != 0 {
+      return b, nil
+   }
+   if uint64(len(data)) < 20+uint64(b.SampleCount)*4 {
+      return nil, sizeError(
+         "stsz too short for sample sizes", 20+int(b.SampleCount)*4, len(data),
+      )
+   }
+   b.EntrySizes = make([]uint32, b.SampleCount)
+   for i := range b.EntrySizes {
+      b.EntrySizes[i] = p.Uint32()
+   }
+   return b, nil
+}
+
 type SttsBox struct {
    Header  *BoxHeader
    Entries []SttsEntry
@@ -359,8 +347,47 @@ func (b *SttsBox) Encode() []byte {
    return buffer
 }
 
+func DecodeSttsBox(data []byte) (*SttsBox, error) {
+   p, count, err := tableEntries(data, "stts", 8)
+   if err != nil {
+      return nil, err
+   }
+   b := &SttsBox{Header: p.header, Entries: make([]SttsEntry, count)}
+   for i := range b.Entries {
+      b.Entries[i] = SttsEntry{p.Uint32(), p.Uint32()}
+   }
+   return b, nil
+}
+
 // --- STTS ---
 type SttsEntry struct {
    SampleCount    uint32
    SampleDuration uint32
 }
+
+// tableParser reads the entries of a sample table box.
+type tableParser struct {
+   parser
+   header *BoxHeader
+}
+
+// tableEntries checks that a full box with an entry count at offset 12
+// holds that many entries of entrySize bytes, and returns a parser at the
+// first one.
+func tableEntries(data []byte, name string, entrySize int) (*tableParser, int, error) {
+   if len(data) < 16 {
+      return nil, 0, sizeError(name+" too short", 16, len(data))
+   }
+   header, err := DecodeBoxHeader(data)
+   if err != nil {
+      return nil, 0, err
+   }
+   p := &tableParser{parser{data: data, offset: 12}, header}
+   count := p.Uint32()
+   if uint64(len(data)) < 16+uint64(count)*uint64(entrySize) {
+      return nil, 0, sizeError(
+         name+" too short for entries", 16+int(count)*entrySize, len(data),
+      )
+   }
+   return p, int(count), nil
+}
@@ -1,7 +1,147 @@
 // track.go
 package sofia
 
-import "errors"
+import (
+   "bytes"
+   "encoding/binary"
+   "errors"
+   "fmt"
+   "math"
+   "strings"
+)
+
+// --- TKHD ---
+type TkhdBox struct {
+   Header           *BoxHeader
+   Version          byte
+   Flags            [3]byte
+   CreationTime     uint64
+   ModificationTime uint64
+   TrackID          uint32
+   Duration         uint64 // in the mvhd timescale
+   Layer            int16
+   AlternateGroup   int16
+   Volume           int16 // 8.8 fixed point, 0x0100 for audio tracks
+   Matrix           [9]uint32
+   Width            uint32 // 16.16 fixed point
+   Height           uint32 // 16.16 fixed point
+}
+
+func DecodeTkhdBox(data []byte) (*TkhdBox, error) {
+   b := &TkhdBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+
+   if len(data) < 12 {
+      return nil, sizeError("tkhd box too small", 12, len(data))
+   }
+
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+
+   if b.Version == 1 {
+      if len(data) < 104 {
+         return nil, sizeError("tkhd v1 too short", 104, len(data))
+      }
+      b.CreationTime = p.Uint64()
+      b.ModificationTime = p.Uint64()
+      b.TrackID = p.Uint32()
+      p.offset += 4 // reserved
+      b.Duration = p.Uint64()
+   } else { // Version 0
+      if len(data) < 92 {
+         return nil, sizeError("tkhd v0 too short", 92, len(data))
+      }
+      b.CreationTime = uint64(p.Uint32())
+      b.ModificationTime = uint64(p.Uint32())
+      b.TrackID = p.Uint32()
+      p.offset += 4 // reserved
+      b.Duration = uint64(p.Uint32())
+   }
+
+   p.offset += 8 // reserved
+   b.Layer = int16(p.Uint16())
+   b.AlternateGroup = int16(p.Uint16())
+   b.Volume = int16(p.Uint16())
+   p.offset += 2 // reserved
+   for i := range b.Matrix {
+      b.Matrix[i] = p.Uint32()
+   }
+   b.Width = p.Uint32()
+   b.Height = p.Uint32()
+   return b, nil
+}
+
+func (b *TkhdBox) Encode() []byte {
+   var size uint32
+   if b.Version == 1 {
+      size = 104
+   } else {
+      size = 92
+   }
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+
+   w.PutUint32(size)
+   w.PutBytes(b.Header.Type[:])
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+
+   if b.Version == 1 {
+      w.PutUint64(b.CreationTime)
+      w.PutUint64(b.ModificationTime)
+      w.PutUint32(b.TrackID)
+      w.offset += 4
+      w.PutUint64(b.Duration)
+   } else {
+      w.PutUint32(uint32(b.CreationTime))
+      w.PutUint32(uint32(b.ModificationTime))
+      w.PutUint32(b.TrackID)
+      w.offset += 4
+      w.PutUint32(uint32(b.Duration))
+   }
+
+   w.offset += 8
+   w.PutUint16(uint16(b.Layer))
+   w.PutUint16(uint16(b.AlternateGroup))
+   w.PutUint16(uint16(b.Volume))
+   w.offset += 2
+   for _, value := range b.Matrix {
+      w.PutUint32(value)
+   }
+   w.PutUint32(b.Width)
+   w.PutUint32(b.Height)
+
+   b.Header.Size = size
+   return buffer
+}
+
+func (b *TkhdBox) SetDuration(duration uint64) {
+   b.Duration = duration
+   if b.Duration > 0xFFFFFFFF {
+      b.Version = 1
+   }
+}
+
+// Enabled reports the track_enabled flag.
+func (b *TkhdBox) Enabled() bool {
+   return b.Flags[2]&0x01 != 0
+}
+
+// InMovie reports the track_in_movie flag.
+func (b *TkhdBox) InMovie() bool {
+   return b.Flags[2]&0x02 != 0
+}
+
+// InPreview reports the track_in_preview flag.
+func (b *TkhdBox) InPreview() bool {
+   return b.Flags[2]&0x04 != 0
+}
 
 // --- MDHD ---
 type MdhdBox struct {
@@ -25,7 +165,7 @@ func DecodeMdhdBox(data []byte) (*MdhdBox, error) {
    }
 
    if len(data) < 12 {
-      return nil, errors.New("mdhd box too small")
+      return nil, sizeError("mdhd box too small", 12, len(data))
    }
 
    p := parser{data: data, offset: 8}
@@ -35,7 +175,7 @@ func DecodeMdhdBox(data []byte) (*MdhdBox, error) {
 
    if b.Version == 1 {
       if len(data) < 44 {
-         return nil, errors.New("mdhd v1 too short")
+         return nil, sizeError("mdhd v1 too short", 44, len(data))
       }
       b.CreationTime = p.Uint64()
       b.ModificationTime = p.Uint64()
@@ -43,7 +183,7 @@ func DecodeMdhdBox(data []byte) (*MdhdBox, error) {
       b.Duration = p.Uint64()
    } else { // Version 0
       if len(data) < 32 {
-         return nil, errors.New("mdhd v0 too short")
+         return nil, sizeError("mdhd v0 too short", 32, len(data))
       }
       b.CreationTime = uint64(p.Uint32())
       b.ModificationTime = uint64(p.Uint32())
@@ -52,7 +192,10 @@ func DecodeMdhdBox(data []byte) (*MdhdBox, error) {
    }
 
    if len(data) < p.offset+4 {
-      return nil, errors.New("mdhd truncated at language/quality")
+      return nil, sizeError(
+         "mdhd truncated at language/quality",
+         p.offset+4, len(data),
+      )
    }
    copy(b.Language[:], p.Bytes(2))
    copy(b.Quality[:], p.Bytes(2))
@@ -100,15 +243,159 @@ func (b *MdhdBox) SetDuration(duration uint64) {
    }
 }
 
+// LanguageCode returns the ISO 639-2/T code, such as "eng", or "" if
+// Language does not hold one.
+func (b *MdhdBox) LanguageCode() string {
+   packed := binary.BigEndian.Uint16(b.Language[:])
+   code := []byte{
+      byte(packed>>10&0x1F) + 0x60,
+      byte(packed>>5&0x1F) + 0x60,
+      byte(packed&0x1F) + 0x60,
+   }
+   for _, char := range code {
+      if char < 'a' || char > 'z' {
+         return ""
+      }
+   }
+   return string(code)
+}
+
+// SetLanguageCode packs a three letter ISO 639-2/T code into Language.
+func (b *MdhdBox) SetLanguageCode(code string) error {
+   if len(code) != 3 {
+      return fmt.Errorf("invalid ISO 639-2 code %q", code)
+   }
+   var packed uint16
+   for i := 0; i < 3; i++ {
+      char := code[i]
+      if char < 'a' || char > 'z' {
+         return fmt.Errorf("invalid ISO 639-2 code %q", code)
+      }
+      packed = packed<<5 | uint16(char-0x60)
+   }
+   binary.BigEndian.PutUint16(b.Language[:], packed)
+   return nil
+}
+
+// --- ELNG ---
+// ElngBox holds an extended language tag, such as "pt-BR", which takes
+// precedence over the mdhd language.
+type ElngBox struct {
+   Header           *BoxHeader
+   Version          byte
+   Flags            [3]byte
+   ExtendedLanguage string // BCP 47
+}
+
+func DecodeElngBox(data []byte) (*ElngBox, error) {
+   b := &ElngBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 12 {
+      return nil, sizeError("elng box too small", 12, len(data))
+   }
+   b.Version = data[8]
+   copy(b.Flags[:], data[9:12])
+   language := data[12:]
+   if end := bytes.IndexByte(language, 0); end >= 0 {
+      language = language[:end]
+   }
+   b.ExtendedLanguage = string(language)
+   return b, nil
+}
+
+func (b *ElngBox) Encode() []byte {
+   size := uint32(13 + len(b.ExtendedLanguage))
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+
+   w.PutUint32(size)
+   w.PutBytes(b.Header.Type[:])
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+   w.PutBytes([]byte(b.ExtendedLanguage)) // null terminated
+
+   b.Header.Size = size
+   return buffer
+}
+
+// --- HDLR ---
+type HdlrBox struct {
+   Header      *BoxHeader
+   Version     byte
+   Flags       [3]byte
+   HandlerType [4]byte // such as vide, soun, subt, text or meta
+   Name        string
+}
+
+func DecodeHdlrBox(data []byte) (*HdlrBox, error) {
+   b := &HdlrBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 32 {
+      return nil, sizeError("hdlr box too small", 32, len(data))
+   }
+
+   p := parser{data: data, offset: 8}
+   versionAndFlags := p.Bytes(4)
+   b.Version = versionAndFlags[0]
+   copy(b.Flags[:], versionAndFlags[1:])
+   p.offset += 4 // pre_defined
+   copy(b.HandlerType[:], p.Bytes(4))
+   p.offset += 12 // reserved
+   name := data[p.offset:]
+   if end := bytes.IndexByte(name, 0); end >= 0 {
+      name = name[:end]
+   }
+   b.Name = string(name)
+   return b, nil
+}
+
+func (b *HdlrBox) Encode() []byte {
+   size := uint32(33 + len(b.Name))
+   buffer := make([]byte, size)
+   w := writer{buf: buffer}
+
+   w.PutUint32(size)
+   w.PutBytes(b.Header.Type[:])
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+   w.offset += 4
+   w.PutBytes(b.HandlerType[:])
+   w.offset += 12
+   w.PutBytes([]byte(b.Name)) // null terminated
+
+   b.Header.Size = size
+   return buffer
+}
+
 // --- MDIA ---
 type MdiaBox struct {
    Header      *BoxHeader
    Mdhd        *MdhdBox
+   Elng        *ElngBox
+   Hdlr        *HdlrBox
    Minf        *MinfBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeMdiaBox(data []byte) (*MdiaBox, error) {
+   var d decoder
+   return d.mdia(data)
+}
+
+func (d *decoder) mdia(data []byte) (*MdiaBox, error) {
    b := &MdiaBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -116,39 +403,41 @@ func DecodeMdiaBox(data []byte) (*MdiaBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "mdhd":
          mdhd, err := DecodeMdhdBox(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Mdhd = mdhd
+      case "elng":
+         elng, err := DecodeElngBox(content)
+         if err != nil {
+            return err
+         }
+         b.Elng = elng
+      case "hdlr":
+         hdlr, err := DecodeHdlrBox(content)
+         if err != nil {
+            return err
+         }
+         b.Hdlr = hdlr
       case "minf":
-         minf, err := DecodeMinfBox(content)
+         minf, err := d.minf(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Minf = minf
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("mdia", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
@@ -158,25 +447,119 @@ func (b *MdiaBox) Encode() []byte {
    if b.Mdhd != nil {
       buffer = append(buffer, b.Mdhd.Encode()...)
    }
+   if b.Hdlr != nil {
+      buffer = append(buffer, b.Hdlr.Encode()...)
+   }
+   if b.Elng != nil {
+      buffer = append(buffer, b.Elng.Encode()...)
+   }
    if b.Minf != nil {
       buffer = append(buffer, b.Minf.Encode()...)
    }
-   for _, child := range b.RawChildren {
-      buffer = append(buffer, child...)
-   }
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
    b.Header.Size = uint32(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// Language returns the elng tag if there is one, and otherwise the mdhd
+// code.
+func (b *MdiaBox) Language() string {
+   if b.Elng != nil && b.Elng.ExtendedLanguage != "" {
+      return b.Elng.ExtendedLanguage
+   }
+   if b.Mdhd != nil {
+      return b.Mdhd.LanguageCode()
+   }
+   return ""
+}
+
+// SetLanguage sets the language from a BCP 47 tag. A three letter tag such
+// as "eng" only goes in mdhd, and removes any elng. Other tags, such as
+// "pt-BR" or "zh-Hans", go in elng, with mdhd holding the ISO 639-2/T code
+// of the primary subtag, such as "por" or "zho", and "und" if it has none.
+func (b *MdiaBox) SetLanguage(tag string) error {
+   if b.Mdhd == nil {
+      return errors.New("missing mdhd")
+   }
+   if tag == "" {
+      return errors.New("empty language tag")
+   }
+   primary, _, extended := strings.Cut(tag, "-")
+   if !extended && b.Mdhd.SetLanguageCode(tag) == nil {
+      b.Elng = nil
+      return nil
+   }
+   primary = strings.ToLower(primary)
+   if code, ok := iso639T[primary]; ok {
+      primary = code
+   }
+   if b.Mdhd.SetLanguageCode(primary) != nil {
+      b.Mdhd.SetLanguageCode("und")
+   }
+   if b.Elng == nil {
+      b.Elng = &ElngBox{Header: &BoxHeader{Type: [4]byte{'e', 'l', 'n', 'g'}}}
+   }
+   b.Elng.ExtendedLanguage = tag
+   return nil
+}
+
+// iso639T maps the two letter ISO 639-1 codes to the ISO 639-2/T codes
+// that mdhd holds.
+var iso639T = map[string]string{
+   "aa": "aar", "ab": "abk", "ae": "ave", "af": "afr", "ak": "aka",
+   "am": "amh", "an": "arg", "ar": "ara", "as": "asm", "av": "ava",
+   "ay": "aym", "az": "aze", "ba": "bak", "be": "bel", "bg": "bul",
+   "bi": "bis", "bm": "bam", "bn": "ben", "bo": "bod", "br": "bre",
+   "bs": "bos", "ca": "cat", "ce": "che", "ch": "cha", "co": "cos",
+   "cr": "cre", "cs": "ces", "cu": "chu", "cv": "chv", "cy": "cym",
+   "da": "dan", "de": "deu", "dv": "div", "dz": "dzo", "ee": "ewe",
+   "el": "ell", "en": "eng", "eo": "epo", "es": "spa", "et": "est",
+   "eu": "eus", "fa": "fas", "ff": "ful", "fi": "fin", "fj": "fij",
+   "fo": "fao", "fr": "fra", "fy": "fry", "ga": "gle", "gd": "gla",
+   "gl": "glg", "gn": "grn", "gu": "guj", "gv": "glv", "ha": "hau",
+   "he": "heb", "hi": "hin", "ho": "hmo", "hr": "hrv", "ht": "hat",
+   "hu": "hun", "hy": "hye", "hz": "her", "ia": "ina", "id": "ind",
+   "ie": "ile", "ig": "ibo", "ii": "iii", "ik": "ipk", "io": "ido",
+   "is": "isl", "it": "ita", "iu": "iku", "ja": "jpn", "jv": "jav",
+   "ka": "kat", "kg": "kon", "ki": "kik", "kj": "kua", "kk": "kaz",
+   "kl": "kal", "km": "khm", "kn": "kan", "ko": "kor", "kr": "kau",
+   "ks": "kas", "ku": "kur", "kv": "kom", "kw": "cor", "ky": "kir",
+   "la": "lat", "lb": "ltz", "lg": "lug", "li": "lim", "ln": "lin",
+   "lo": "lao", "lt": "lit", "lu": "lub", "lv": "lav", "mg": "mlg",
+   "mh": "mah", "mi": "mri", "mk": "mkd", "ml": "mal", "mn": "mon",
+   "mr": "mar", "ms": "msa", "mt": "mlt", "my": "mya", "na": "nau",
+   "nb": "nob", "nd": "nde", "ne": "nep", "ng": "ndo", "nl": "nld",
+   "nn": "nno", "no": "nor", "nr": "nbl", "nv": "nav", "ny": "nya",
+   "oc": "oci", "oj": "oji", "om": "orm", "or": "ori", "os": "oss",
+   "pa": "pan", "pi": "pli", "pl": "pol", "ps": "pus", "pt": "por",
+   "qu": "que", "rm": "roh", "rn": "run", "ro": "ron", "ru": "rus",
+   "rw": "kin", "sa": "san", "sc": "srd", "sd": "snd", "se": "sme",
+   "sg": "sag", "si": "sin", "sk": "slk", "sl": "slv", "sm": "smo",
+   "sn": "sna", "so": "som", "sq": "sqi", "sr": "srp", "ss": "ssw",
+   "st": "sot", "su": "sun", "sv": "swe", "sw": "swa", "ta": "tam",
+   "te": "tel", "tg": "tgk", "th": "tha", "ti": "tir", "tk": "tuk",
+   "tl": "tgl", "tn": "tsn", "to": "ton", "tr": "tur", "ts": "tso",
+   "tt": "tat", "tw": "twi", "ty": "tah", "ug": "uig", "uk": "ukr",
+   "ur": "urd", "uz": "uzb", "ve": "ven", "vi": "vie", "vo": "vol",
+   "wa": "wln", "wo": "wol", "xh": "xho", "yi": "yid", "yo": "yor",
+   "za": "zha", "zh": "zho", "zu": "zul",
+}
+
 // --- MINF ---
 type MinfBox struct {
    Header      *BoxHeader
    Stbl        *StblBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeMinfBox(data []byte) (*MinfBox, error) {
+   var d decoder
+   return d.minf(data)
+}
+
+func (d *decoder) minf(data []byte) (*MinfBox, error) {
    b := &MinfBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -184,33 +567,23 @@ func DecodeMinfBox(data []byte) (*MinfBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
       case "stbl":
-         stbl, err := DecodeStblBox(content)
+         stbl, err := d.stbl(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Stbl = stbl
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("minf", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
@@ -220,22 +593,185 @@ func (b *MinfBox) Encode() []byte {
    if b.Stbl != nil {
       buffer = append(buffer, b.Stbl.Encode()...)
    }
-   for _, child := range b.RawChildren {
-      buffer = append(buffer, child...)
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
+   b.Header.Size = uint32(len(buffer))
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// --- EDTS ---
+// EdtsBox holds the edit list of a track.
+type EdtsBox struct {
+   Header      *BoxHeader
+   Elst        *ElstBox
+   Custom      []*CustomBox
+   RawChildren [][]byte
+}
+
+func DecodeEdtsBox(data []byte) (*EdtsBox, error) {
+   var d decoder
+   return d.edts(data)
+}
+
+func (d *decoder) edts(data []byte) (*EdtsBox, error) {
+   b := &EdtsBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
    }
+
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
+      switch string(header.Type[:]) {
+      case "elst":
+         elst, err := DecodeElstBox(content)
+         if err != nil {
+            return err
+         }
+         b.Elst = elst
+      default:
+         if err := keepChild("edts", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
+      }
+      return nil
+   })
+   if err != nil {
+      return nil, err
+   }
+   return b, nil
+}
+
+func (b *EdtsBox) Encode() []byte {
+   buffer := make([]byte, 8)
+   if b.Elst != nil {
+      buffer = append(buffer, b.Elst.Encode()...)
+   }
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
    b.Header.Size = uint32(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// --- ELST ---
+type ElstBox struct {
+   Header  *BoxHeader
+   Version byte
+   Flags   [3]byte
+   Entries []ElstEntry
+}
+
+// ElstEntry maps SegmentDuration, in the movie timescale, of the
+// presentation to the media from MediaTime, in the media timescale. A
+// MediaTime of -1 is an empty edit.
+type ElstEntry struct {
+   SegmentDuration   uint64
+   MediaTime         int64
+   MediaRateInteger  int16
+   MediaRateFraction int16
+}
+
+func DecodeElstBox(data []byte) (*ElstBox, error) {
+   b := &ElstBox{}
+   var err error
+   b.Header, err = DecodeBoxHeader(data)
+   if err != nil {
+      return nil, err
+   }
+   data = data[:b.Header.end(data)]
+
+   if len(data) < 16 {
+      return nil, sizeError("elst box too small", 16, len(data))
+   }
+   p := parser{data: data, offset: 8}
+   b.Version = p.Byte()
+   copy(b.Flags[:], p.Bytes(3))
+   count := int(p.Uint32())
+   entrySize := 12
+   if b.Version == 1 {
+      entrySize = 20
+   }
+   if len(data) < p.offset+count*entrySize {
+      return nil, sizeError(
+         "elst box too small for entries", p.offset+count*entrySize, len(data),
+      )
+   }
+   b.Entries = make([]ElstEntry, count)
+   for i := range b.Entries {
+      entry := &b.Entries[i]
+      if b.Version == 1 {
+         entry.SegmentDuration = p.Uint64()
+         entry.MediaTime = int64(p.Uint64())
+      } else {
+         entry.SegmentDuration = uint64(p.Uint32())
+         entry.MediaTime = int64(p.Int32())
+      }
+      entry.MediaRateInteger = int16(p.Uint16())
+      entry.MediaRateFraction = int16(p.Uint16())
+   }
+   return b, nil
+}
+
+func (b *ElstBox) Encode() []byte {
+   entrySize := 12
+   if b.Version == 1 {
+      entrySize = 20
+   }
+   size := 16 + len(b.Entries)*entrySize
+   buffer := make([]byte, size)
+   w := writer{buf: buffer, offset: 8}
+   w.PutByte(b.Version)
+   w.PutBytes(b.Flags[:])
+   w.PutUint32(uint32(len(b.Entries)))
+   for _, entry := range b.Entries {
+      if b.Version == 1 {
+         w.PutUint64(entry.SegmentDuration)
+         w.PutUint64(uint64(entry.MediaTime))
+      } else {
+         w.PutUint32(uint32(entry.SegmentDuration))
+         w.PutUint32(uint32(entry.MediaTime))
+      }
+      w.PutUint16(uint16(entry.MediaRateInteger))
+      w.PutUint16(uint16(entry.MediaRateFraction))
+   }
+   b.Header.Size = uint32(size)
+   b.Header.Put(buffer)
+   return buffer
+}
+
+// NewEdts returns an edit list with a single edit, of duration in the
+// movie timescale starting at mediaTime in the media timescale, choosing
+// version 1 if either needs 64 bits.
+func NewEdts(duration uint64, mediaTime int64) *EdtsBox {
+   elst := &ElstBox{
+      Header:  &BoxHeader{Type: [4]byte{'e', 'l', 's', 't'}},
+      Entries: []ElstEntry{{duration, mediaTime, 1, 0}},
+   }
+   if duration > math.MaxUint32 || mediaTime > math.MaxInt32 || mediaTime < math.MinInt32 {
+      elst.Version = 1
+   }
+   return &EdtsBox{
+      Header: &BoxHeader{Type: [4]byte{'e', 'd', 't', 's'}},
+      Elst:   elst,
+   }
+}
+
 // --- TRAK ---
 type TrakBox struct {
    Header      *BoxHeader
+   Tkhd        *TkhdBox
+   Edts        *EdtsBox
    Mdia        *MdiaBox
+   Custom      []*CustomBox
    RawChildren [][]byte
 }
 
 func DecodeTrakBox(data []byte) (*TrakBox, error) {
+   var d decoder
+   return d.trak(data)
+}
+
+func (d *decoder) trak(data []byte) (*TrakBox, error) {
    b := &TrakBox{}
    var err error
    b.Header, err = DecodeBoxHeader(data)
@@ -243,51 +779,75 @@ func DecodeTrakBox(data []byte) (*TrakBox, error) {
       return nil, err
    }
 
-   payload := data[8:b.Header.Size]
-   offset := 0
-   for offset < len(payload) {
-      header, err := DecodeBoxHeader(payload[offset:])
-      if err != nil {
-         break
-      }
-      boxSize := int(header.Size)
-      if boxSize == 0 {
-         boxSize = len(payload) - offset
-      }
-      if boxSize < 8 || offset+boxSize > len(payload) {
-         return nil, errors.New("invalid child box size")
-      }
-
-      content := payload[offset : offset+boxSize]
+   err = d.boxes(data[8:b.Header.end(data)], 8, func(header *BoxHeader, content []byte) error {
       switch string(header.Type[:]) {
+      case "tkhd":
+         tkhd, err := DecodeTkhdBox(content)
+         if err != nil {
+            return err
+         }
+         b.Tkhd = tkhd
+      case "edts":
+         edts, err := d.edts(content)
+         if err != nil {
+            return err
+         }
+         b.Edts = edts
       case "mdia":
-         mdia, err := DecodeMdiaBox(content)
+         mdia, err := d.mdia(content)
          if err != nil {
-            return nil, err
+            return err
          }
          b.Mdia = mdia
       default:
-         b.RawChildren = append(b.RawChildren, content)
+         if err := keepChild("trak", content, &b.Custom, &b.RawChildren); err != nil {
+            return err
+         }
       }
-      offset += boxSize
+      return nil
+   })
+   if err != nil {
+      return nil, err
    }
    return b, nil
 }
 
 func (b *TrakBox) Encode() []byte {
    buffer := make([]byte, 8)
+   if b.Tkhd != nil {
+      buffer = append(buffer, b.Tkhd.Encode()...)
+   }
+   if b.Edts != nil {
+      buffer = append(buffer, b.Edts.Encode()...)
+   }
    if b.Mdia != nil {
       buffer = append(buffer, b.Mdia.Encode()...)
    }
-   for _, child := range b.RawChildren {
-      buffer = append(buffer, child...)
-   }
+   buffer = appendChildren(buffer, b.Custom, b.RawChildren)
    b.Header.Size = uint32(len(buffer))
    b.Header.Put(buffer)
    return buffer
 }
 
+// HandlerType returns the handler type of the track, such as "vide" or
+// "soun", or "" if it has no hdlr.
+func (b *TrakBox) HandlerType() string {
+   if b.Mdia == nil || b.Mdia.Hdlr == nil {
+      return ""
+   }
+   return string(b.Mdia.Hdlr.HandlerType[:])
+}
+
 func (b *TrakBox) RemoveEdts() {
+   b.Edts = nil
+   var keptCustom []*CustomBox
+   for _, custom := range b.Custom {
+      if custom.Type() == "edts" {
+         continue
+      }
+      keptCustom = append(keptCustom, custom)
+   }
+   b.Custom = keptCustom
    var kept [][]byte
    for _, child := range b.RawChildren {
       if len(child) >= 8 && string(child[4:8]) == "edts" {
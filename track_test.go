@@ -0,0 +1,254 @@
+// track_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "strings"
+   "testing"
+)
+
+func TestTkhdBox(t *testing.T) {
+   moov := testMoov(t, testInit())
+   tkhd := moov.Trak[0].Tkhd
+   if tkhd.TrackID != 1 || tkhd.Width != 640<<16 || tkhd.Height != 360<<16 {
+      t.Errorf("got %+v", tkhd)
+   }
+   if !tkhd.Enabled() || !tkhd.InMovie() || tkhd.InPreview() {
+      t.Errorf("got flags %x", tkhd.Flags)
+   }
+   data := tkhd.Encode()
+   tkhd.SetDuration(1 << 32)
+   if tkhd.Version != 1 {
+      t.Fatal("a 64 bit duration did not move tkhd to version 1")
+   }
+   v1 := tkhd.Encode()
+   if len(v1) != 104 {
+      t.Fatalf("got %d bytes for version 1, want 104", len(v1))
+   }
+   decoded, err := DecodeTkhdBox(v1)
+   if err != nil {
+      t.Fatal(err)
+   }
+   decoded.Header = tkhd.Header
+   if *decoded != *tkhd {
+      t.Errorf("got  %+v\nwant %+v", decoded, tkhd)
+   }
+   decoded, err = DecodeTkhdBox(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := decoded.Encode(); !bytes.Equal(got, data) {
+      t.Errorf("got  %x\nwant %x", got, data)
+   }
+   for _, short := range [][]byte{data[:91], v1[:103]} {
+      if _, err := DecodeTkhdBox(short); err == nil {
+         t.Errorf("decoded a tkhd of %d bytes", len(short))
+      }
+   }
+}
+
+func TestRemuxTkhdDuration(t *testing.T) {
+   fragment := testFragment(1, 0, []TrunSample{
+      testSample(10, 3000, true, 0), testSample(10, 3000, false, 0),
+   })
+   remuxed := testRemux(t, true, func(r *Remuxer) error {
+      return r.AddSegment(fragment)
+   })
+   moov := testMoov(t, remuxed)
+   tkhd, mvhd := moov.Trak[0].Tkhd, moov.Mvhd
+   // both in the movie timescale
+   want := 6000 * uint64(mvhd.Timescale) / testTimescale
+   if tkhd.Duration != want || mvhd.Duration != want {
+      t.Errorf("got tkhd %d and mvhd %d, want %d", tkhd.Duration, mvhd.Duration, want)
+   }
+}
+
+func TestHdlrBox(t *testing.T) {
+   fields := append(make([]byte, 8), "soun"...)
+   fields = append(fields, make([]byte, 12)...)
+   for _, test := range []struct {
+      name, want string
+   }{
+      {"SoundHandler\x00", "SoundHandler"},
+      {"SoundHandler", "SoundHandler"}, // no terminator
+      {"", ""},
+   } {
+      data := containerBox("hdlr", fields, []byte(test.name))
+      hdlr, err := DecodeHdlrBox(data)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if string(hdlr.HandlerType[:]) != "soun" || hdlr.Name != test.want {
+         t.Errorf("%q: got %q, %q", test.name, hdlr.HandlerType, hdlr.Name)
+      }
+      want := containerBox("hdlr", fields, []byte(test.want), []byte{0})
+      if got := hdlr.Encode(); !bytes.Equal(got, want) {
+         t.Errorf("%q: got  %x\nwant %x", test.name, got, want)
+      }
+   }
+   if _, err := DecodeHdlrBox(containerBox("hdlr", fields[:23])); err == nil {
+      t.Error("decoded a cut short hdlr")
+   }
+   for _, handler := range []string{"vide", "soun"} {
+      moov := testMoov(t, testTrackInit(handler))
+      if got := moov.Trak[0].HandlerType(); got != handler {
+         t.Errorf("got handler type %q, want %q", got, handler)
+      }
+   }
+   if got := (&TrakBox{}).HandlerType(); got != "" {
+      t.Errorf("got handler type %q without a hdlr", got)
+   }
+}
+
+func TestSetLanguage(t *testing.T) {
+   tests := []struct {
+      tag, mdhd string
+      elng      bool
+   }{
+      {"fra", "fra", false},
+      {"pt-BR", "por", true},
+      {"pt", "por", true},
+      {"zh-Hans", "zho", true},
+      {"EN-gb", "eng", true},
+      {"yue-HK", "yue", true},
+      {"x-klingon", "und", true},
+      {"eng", "eng", false}, // removes the elng of the last tag
+   }
+   mdia := testMoov(t, testInit()).Trak[0].Mdia
+   if got := mdia.Language(); got != "eng" {
+      t.Errorf("got language %q, want eng", got)
+   }
+   for _, test := range tests {
+      if err := mdia.SetLanguage(test.tag); err != nil {
+         t.Fatal(err)
+      }
+      if got := mdia.Mdhd.LanguageCode(); got != test.mdhd {
+         t.Errorf("%s: got mdhd %q, want %q", test.tag, got, test.mdhd)
+      }
+      if (mdia.Elng != nil) != test.elng {
+         t.Errorf("%s: got elng %v", test.tag, mdia.Elng)
+      }
+      want := test.tag
+      if !test.elng {
+         want = test.mdhd
+      }
+      // the tag survives a round trip
+      decoded, err := DecodeMdiaBox(mdia.Encode())
+      if err != nil {
+         t.Fatal(err)
+      }
+      if got := decoded.Language(); got != want {
+         t.Errorf("%s: got language %q, want %q", test.tag, got, want)
+      }
+   }
+   if err := mdia.SetLanguage(""); err == nil {
+      t.Error("set an empty language")
+   }
+   for _, code := range []string{"en", "ENG", "e1g", "engl"} {
+      if err := mdia.Mdhd.SetLanguageCode(code); err == nil {
+         t.Errorf("set language code %q", code)
+      }
+   }
+}
+
+func TestElngBox(t *testing.T) {
+   mdia := testMoov(t, testInit()).Trak[0].Mdia
+   if err := mdia.SetLanguage("pt-BR"); err != nil {
+      t.Fatal(err)
+   }
+   data := mdia.Encode()
+   var types []string
+   for offset := 8; offset < len(data); {
+      types = append(types, string(data[offset+4:offset+8]))
+      offset += int(binary.BigEndian.Uint32(data[offset:]))
+   }
+   // elng follows hdlr
+   if got := strings.Join(types, " "); got != "mdhd hdlr elng minf" {
+      t.Errorf("got children %s", got)
+   }
+   elng := containerBox("elng", make([]byte, 4), []byte("pt-BR\x00"))
+   box, err := DecodeElngBox(elng)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := box.Encode(); box.ExtendedLanguage != "pt-BR" || !bytes.Equal(got, elng) {
+      t.Errorf("got %q, %x", box.ExtendedLanguage, got)
+   }
+   // without the terminator
+   box, err = DecodeElngBox(elng[:len(elng)-1])
+   if err != nil || box.ExtendedLanguage != "pt-BR" {
+      t.Errorf("got %v, %v", box, err)
+   }
+}
+
+func TestElstBox(t *testing.T) {
+   be := binary.BigEndian
+   // an empty edit of 1000, then the media from 3000 at normal rate
+   v0 := be.AppendUint32([]byte{0, 0, 0, 0}, 2)
+   v0 = be.AppendUint32(v0, 1000)
+   v0 = be.AppendUint32(v0, 0xFFFFFFFF)
+   v0 = append(v0, 0, 1, 0, 0)
+   v0 = be.AppendUint32(v0, 9000)
+   v0 = be.AppendUint32(v0, 3000)
+   v0 = append(v0, 0, 1, 0, 0)
+   v1 := be.AppendUint32([]byte{1, 0, 0, 0}, 1)
+   v1 = be.AppendUint64(v1, 1<<33)
+   v1 = be.AppendUint64(v1, 1<<32)
+   v1 = append(v1, 0, 1, 0, 0)
+   for _, test := range []struct {
+      data []byte
+      want []ElstEntry
+   }{
+      {containerBox("elst", v0), []ElstEntry{{1000, -1, 1, 0}, {9000, 3000, 1, 0}}},
+      {containerBox("elst", v1), []ElstEntry{{1 << 33, 1 << 32, 1, 0}}},
+   } {
+      elst, err := DecodeElstBox(test.data)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if len(elst.Entries) != len(test.want) {
+         t.Fatalf("version %d: got %d entries", elst.Version, len(elst.Entries))
+      }
+      for i, entry := range elst.Entries {
+         if entry != test.want[i] {
+            t.Errorf("version %d entry %d: got %+v, want %+v", elst.Version, i, entry, test.want[i])
+         }
+      }
+      if got := elst.Encode(); !bytes.Equal(got, test.data) {
+         t.Errorf("version %d: got %x\nwant %x", elst.Version, got, test.data)
+      }
+      // an entry count past the end
+      if _, err := DecodeElstBox(test.data[:len(test.data)-1]); err == nil {
+         t.Errorf("version %d: decoded a cut short elst", elst.Version)
+      }
+   }
+}
+
+func TestNewEdts(t *testing.T) {
+   for _, test := range []struct {
+      duration  uint64
+      mediaTime int64
+      version   byte
+   }{
+      {90000, 3000, 0},
+      {90000, -1, 0},
+      {1 << 32, 0, 1},
+      {90000, 1 << 31, 1},
+      {90000, -1 << 32, 1},
+   } {
+      edts := NewEdts(test.duration, test.mediaTime)
+      if edts.Elst.Version != test.version {
+         t.Errorf("%d at %d: got version %d, want %d",
+            test.duration, test.mediaTime, edts.Elst.Version, test.version)
+      }
+      decoded, err := DecodeEdtsBox(edts.Encode())
+      if err != nil {
+         t.Fatal(err)
+      }
+      want := ElstEntry{test.duration, test.mediaTime, 1, 0}
+      if got := decoded.Elst.Entries; len(got) != 1 || got[0] != want {
+         t.Errorf("got %+v, want %+v", got, want)
+      }
+   }
+}
@@ -0,0 +1,81 @@
+// trim.go
+package sofia
+
+import (
+   "errors"
+   "math"
+   "time"
+)
+
+// trim decides whether the sample at decode time t is written. Samples
+// from the last sync sample ahead of Start are held back, and are returned
+// to be written first when Start is reached.
+func (r *Remuxer) trim(t uint64, sample RemuxSample, data []byte) ([]RemuxSample, []byte, bool, error) {
+   start, end, err := r.trimRange()
+   if err != nil {
+      return nil, nil, false, err
+   }
+   if t >= end {
+      return nil, nil, false, nil
+   }
+   if r.trimStarted {
+      return nil, nil, true, nil
+   }
+   if t < start {
+      if sample.IsSync {
+         r.held, r.heldData = r.held[:0], r.heldData[:0]
+         r.trimOrigin = t
+      }
+      if sample.IsSync || len(r.held) > 0 {
+         r.held = append(r.held, sample)
+         r.heldData = append(r.heldData, data...)
+      }
+      return nil, nil, false, nil
+   }
+   if len(r.held) == 0 {
+      if !sample.IsSync {
+         return nil, nil, false, nil // wait for a sync sample
+      }
+      r.trimOrigin = t
+   }
+   r.trimStarted = true
+   held, heldData := r.held, r.heldData
+   r.held, r.heldData = nil, nil
+   return held, heldData, true, nil
+}
+
+// trimRange returns Start and End in the media timescale, with an End of
+// zero as the largest time.
+func (r *Remuxer) trimRange() (uint64, uint64, error) {
+   mdia := r.Moov.Trak[0].Mdia
+   if mdia == nil || mdia.Mdhd == nil {
+      return 0, 0, errors.New("trimming needs mdhd")
+   }
+   mdhd := mdia.Mdhd
+   end := uint64(math.MaxUint64)
+   if r.End > 0 {
+      end = ticks(r.End, mdhd.Timescale)
+   }
+   return ticks(r.Start, mdhd.Timescale), end, nil
+}
+
+// trimEdts returns the edit list that starts playback at Start, and ends
+// it at End or the last sample.
+func (r *Remuxer) trimEdts() (*EdtsBox, error) {
+   start, end, err := r.trimRange()
+   if err != nil {
+      return nil, err
+   }
+   // times relative to the first sample written
+   skip := max(start, r.trimOrigin) - r.trimOrigin
+   stop := min(end-r.trimOrigin, r.index.duration)
+   // media_time is a composition time, which is ahead of decode time by
+   // the smallest composition offset of the samples written
+   mediaTime := max(int64(skip)+r.index.minOffset(), 0)
+   return NewEdts(max(stop, skip)-skip, mediaTime), nil
+}
+
+func ticks(d time.Duration, timescale uint32) uint64 {
+   return uint64(d/time.Second)*uint64(timescale) +
+      uint64(d%time.Second)*uint64(timescale)/uint64(time.Second)
+}
@@ -0,0 +1,73 @@
+// trim_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/binary"
+   "testing"
+   "time"
+)
+
+func TestTrimCompositionOffsets(t *testing.T) {
+   var b bytes.Buffer
+   r := Remuxer{Output: &b, Start: 150 * time.Millisecond}
+   if err := r.Initialize(testInit()); err != nil {
+      t.Fatal(err)
+   }
+   for i := range 3 {
+      // presented 3000 to 6000 ticks after they are decoded
+      segment := testFragment(uint32(i+1), uint64(i)*9000, []TrunSample{
+         testSample(10, 3000, true, 6000),
+         testSample(10, 3000, false, 3000),
+         testSample(10, 3000, false, 6000),
+      })
+      if err := r.AddSegment(segment); err != nil {
+         t.Fatal(err)
+      }
+   }
+   if err := r.Finish(); err != nil {
+      t.Fatal(err)
+   }
+   edit := r.Moov.Trak[0].Edts.Elst.Entries[0]
+   // Start is 13500 ticks, and the sync sample before it is at 9000
+   if edit.MediaTime != 4500+3000 || edit.SegmentDuration != 18000-4500 {
+      t.Errorf("got media_time %d, segment_duration %d", edit.MediaTime, edit.SegmentDuration)
+   }
+}
+
+func TestTrimEdts(t *testing.T) {
+   data := testRemux(t, true, func(r *Remuxer) error {
+      r.Start, r.End = 50*time.Millisecond, 150*time.Millisecond
+      for _, segment := range testSegments() {
+         if err := r.AddSegment(segment); err != nil {
+            return err
+         }
+      }
+      return nil
+   })
+   boxes, err := DecodeBoxes(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   moov, ok := FindMoov(boxes)
+   if !ok {
+      t.Fatal("no moov")
+   }
+   trak := moov.Trak[0]
+   if trak.Edts == nil || trak.Edts.Elst == nil {
+      t.Fatal("no edit list")
+   }
+   // output starts with the sync sample at 0, and playback at 4500
+   want := ElstEntry{SegmentDuration: 9000, MediaTime: 4500, MediaRateInteger: 1}
+   if got := trak.Edts.Elst.Entries; len(got) != 1 || got[0] != want {
+      t.Errorf("got %+v, want %+v", got, want)
+   }
+   if moov.Mvhd.Duration != 9000 || trak.Tkhd.Duration != 9000 {
+      t.Errorf("got mvhd duration %d, tkhd duration %d", moov.Mvhd.Duration, trak.Tkhd.Duration)
+   }
+   // edts goes between tkhd and mdia
+   encoded := trak.Encode()
+   if tkhd := binary.BigEndian.Uint32(encoded[8:]); string(encoded[12+tkhd:16+tkhd]) != "edts" {
+      t.Errorf("got %q after tkhd", encoded[12+tkhd:16+tkhd])
+   }
+}
@@ -0,0 +1,161 @@
+// widevine.go
+package sofia
+
+import (
+   "encoding/binary"
+   "errors"
+   "fmt"
+)
+
+var WidevineSystemID = [16]byte{
+   0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce,
+   0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed,
+}
+
+// WidevinePsshData is the WidevinePsshData protobuf message carried in the
+// Data of a Widevine pssh box. Fields that are zero are left out on Encode;
+// fields sofia does not model are kept in UnknownFields.
+type WidevinePsshData struct {
+   Algorithm           uint32 // deprecated, 1 for AES-CTR
+   KeyIDs              [][]byte
+   Provider            string
+   ContentID           []byte
+   Policy              string
+   CryptoPeriodIndex   uint32
+   GroupedLicense      []byte
+   ProtectionScheme    uint32 // four character code, such as cenc or cbcs
+   CryptoPeriodSeconds uint32
+   UnknownFields       []byte
+}
+
+// field numbers of WidevinePsshData
+const (
+   widevineAlgorithm           = 1
+   widevineKeyID               = 2
+   widevineProvider            = 3
+   widevineContentID           = 4
+   widevinePolicy              = 6
+   widevineCryptoPeriodIndex   = 7
+   widevineGroupedLicense      = 8
+   widevineProtectionScheme    = 9
+   widevineCryptoPeriodSeconds = 10
+)
+
+// protobuf wire types
+const (
+   wireVarint  = 0
+   wireFixed64 = 1
+   wireBytes   = 2
+   wireFixed32 = 5
+)
+
+func DecodeWidevinePsshData(data []byte) (*WidevinePsshData, error) {
+   w := &WidevinePsshData{}
+   for len(data) > 0 {
+      start := data
+      key, n := binary.Uvarint(data)
+      if n <= 0 {
+         return nil, errors.New("invalid protobuf field key")
+      }
+      data = data[n:]
+      number, wireType := key>>3, key&0x07
+      var value uint64
+      var payload []byte
+      switch wireType {
+      case wireVarint:
+         value, n = binary.Uvarint(data)
+         if n <= 0 {
+            return nil, fmt.Errorf("invalid varint in field %d", number)
+         }
+         data = data[n:]
+      case wireFixed64:
+         if len(data) < 8 {
+            return nil, fmt.Errorf("protobuf field %d truncated", number)
+         }
+         data = data[8:]
+      case wireBytes:
+         size, n := binary.Uvarint(data)
+         if n <= 0 || uint64(len(data)-n) < size {
+            return nil, fmt.Errorf("protobuf field %d truncated", number)
+         }
+         payload = data[n : n+int(size)]
+         data = data[n+int(size):]
+      case wireFixed32:
+         if len(data) < 4 {
+            return nil, fmt.Errorf("protobuf field %d truncated", number)
+         }
+         data = data[4:]
+      default:
+         return nil, fmt.Errorf("unknown protobuf wire type %d", wireType)
+      }
+
+      known := true
+      switch {
+      case number == widevineAlgorithm && wireType == wireVarint:
+         w.Algorithm = uint32(value)
+      case number == widevineKeyID && wireType == wireBytes:
+         w.KeyIDs = append(w.KeyIDs, payload)
+      case number == widevineProvider && wireType == wireBytes:
+         w.Provider = string(payload)
+      case number == widevineContentID && wireType == wireBytes:
+         w.ContentID = payload
+      case number == widevinePolicy && wireType == wireBytes:
+         w.Policy = string(payload)
+      case number == widevineCryptoPeriodIndex && wireType == wireVarint:
+         w.CryptoPeriodIndex = uint32(value)
+      case number == widevineGroupedLicense && wireType == wireBytes:
+         w.GroupedLicense = payload
+      case number == widevineProtectionScheme && wireType == wireVarint:
+         w.ProtectionScheme = uint32(value)
+      case number == widevineCryptoPeriodSeconds && wireType == wireVarint:
+         w.CryptoPeriodSeconds = uint32(value)
+      default:
+         known = false
+      }
+      if !known {
+         w.UnknownFields = append(w.UnknownFields, start[:len(start)-len(data)]...)
+      }
+   }
+   return w, nil
+}
+
+func (w *WidevinePsshData) Encode() []byte {
+   var buffer []byte
+   buffer = appendProtoVarint(buffer, widevineAlgorithm, uint64(w.Algorithm))
+   for _, kid := range w.KeyIDs {
+      buffer = appendProtoBytes(buffer, widevineKeyID, kid)
+   }
+   buffer = appendProtoBytes(buffer, widevineProvider, []byte(w.Provider))
+   buffer = appendProtoBytes(buffer, widevineContentID, w.ContentID)
+   buffer = appendProtoBytes(buffer, widevinePolicy, []byte(w.Policy))
+   buffer = appendProtoVarint(
+      buffer, widevineCryptoPeriodIndex, uint64(w.CryptoPeriodIndex),
+   )
+   buffer = appendProtoBytes(buffer, widevineGroupedLicense, w.GroupedLicense)
+   buffer = appendProtoVarint(
+      buffer, widevineProtectionScheme, uint64(w.ProtectionScheme),
+   )
+   buffer = appendProtoVarint(
+      buffer, widevineCryptoPeriodSeconds, uint64(w.CryptoPeriodSeconds),
+   )
+   return append(buffer, w.UnknownFields...)
+}
+
+// appendProtoVarint leaves out zero values, as proto3 does.
+func appendProtoVarint(buffer []byte, number int, value uint64) []byte {
+   if value == 0 {
+      return buffer
+   }
+   buffer = binary.AppendUvarint(buffer, uint64(number)<<3|wireVarint)
+   return binary.AppendUvarint(buffer, value)
+}
+
+// appendProtoBytes leaves out empty values, as proto3 does.
+func appendProtoBytes(buffer []byte, number int, value []byte) []byte {
+   if len(value) == 0 {
+      return buffer
+   }
+   buffer = binary.AppendUvarint(buffer, uint64(number)<<3|wireBytes)
+   buffer = binary.AppendUvarint(buffer, uint64(len(value)))
+   return append(buffer, value...)
+}
@@ -0,0 +1,95 @@
+// widevine_test.go
+package sofia
+
+import (
+   "bytes"
+   "encoding/hex"
+   "testing"
+)
+
+// a WidevinePsshData as packagers write it, ending with field 5, which
+// sofia does not model
+const testWidevineData = "0801" +
+   "1210" + "00112233445566778899aabbccddeeff" +
+   "1210" + "ffeeddccbbaa99887766554433221100" +
+   "1a0d" + "7769646576696e655f74657374" + // widevine_test
+   "2204" + "61626364" + // abcd
+   "48" + "e3dc959b06" + // cenc
+   "2807"
+
+func TestDecodeWidevinePsshData(t *testing.T) {
+   data, err := hex.DecodeString(testWidevineData)
+   if err != nil {
+      t.Fatal(err)
+   }
+   w, err := DecodeWidevinePsshData(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if w.Algorithm != 1 {
+      t.Errorf("algorithm %d, want 1", w.Algorithm)
+   }
+   if len(w.KeyIDs) != 2 {
+      t.Fatalf("got %d KIDs, want 2", len(w.KeyIDs))
+   }
+   if got := hex.EncodeToString(w.KeyIDs[1]); got != "ffeeddccbbaa99887766554433221100" {
+      t.Errorf("second KID %s", got)
+   }
+   if w.Provider != "widevine_test" {
+      t.Errorf("provider %q", w.Provider)
+   }
+   if string(w.ContentID) != "abcd" {
+      t.Errorf("content ID %q", w.ContentID)
+   }
+   if w.ProtectionScheme != 0x63656e63 {
+      t.Errorf("protection scheme %#x, want cenc", w.ProtectionScheme)
+   }
+   if !bytes.Equal(w.UnknownFields, []byte{0x28, 0x07}) {
+      t.Errorf("unknown fields %x", w.UnknownFields)
+   }
+   if got := w.Encode(); !bytes.Equal(got, data) {
+      t.Errorf("got %x\nwant %x", got, data)
+   }
+}
+
+func TestWidevinePsshDataRoundTrip(t *testing.T) {
+   w := WidevinePsshData{
+      KeyIDs:              [][]byte{bytes.Repeat([]byte{1}, 16)},
+      Policy:              "policy",
+      CryptoPeriodIndex:   300,
+      GroupedLicense:      []byte{2, 3},
+      ProtectionScheme:    0x63626373, // cbcs
+      CryptoPeriodSeconds: 10,
+   }
+   decoded, err := DecodeWidevinePsshData(w.Encode())
+   if err != nil {
+      t.Fatal(err)
+   }
+   if decoded.Algorithm != 0 || decoded.Provider != "" || decoded.ContentID != nil {
+      t.Errorf("zero fields decoded as %+v", decoded)
+   }
+   if !bytes.Equal(decoded.Encode(), w.Encode()) {
+      t.Errorf("got %+v, want %+v", decoded, w)
+   }
+   if decoded.CryptoPeriodIndex != 300 || decoded.Policy != "policy" {
+      t.Errorf("got %+v", decoded)
+   }
+}
+
+func TestDecodeWidevinePsshDataInvalid(t *testing.T) {
+   for _, data := range []string{
+      "12",         // no length
+      "1210001122", // length past the end
+      "09001122",   // fixed64 cut short
+      "0b",         // start group
+      "0880",       // varint cut short
+   } {
+      raw, err := hex.DecodeString(data)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if _, err := DecodeWidevinePsshData(raw); err == nil {
+         t.Errorf("%s: decoded", data)
+      }
+   }
+}